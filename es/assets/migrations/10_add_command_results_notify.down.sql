@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS commands_results_notify ON commands;
+DROP FUNCTION IF EXISTS es_notify_command_results();
+DROP INDEX IF EXISTS "events_command_id_idx";
@@ -0,0 +1,12 @@
+CREATE INDEX "events_command_id_idx" ON "events" (command_id);
+
+CREATE OR REPLACE FUNCTION es_notify_command_results() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('es_command_results', NEW.id);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER commands_results_notify AFTER UPDATE OF status ON commands
+    FOR EACH ROW WHEN (NEW.status IN ('finished', 'failure'))
+    EXECUTE PROCEDURE es_notify_command_results();
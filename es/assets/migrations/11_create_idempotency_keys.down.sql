@@ -0,0 +1,2 @@
+DROP TABLE "idempotency_keys";
+ALTER TABLE "commands" DROP COLUMN idempotency_key;
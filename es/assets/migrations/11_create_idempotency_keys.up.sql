@@ -0,0 +1,9 @@
+ALTER TABLE "commands" ADD COLUMN idempotency_key VARCHAR(255) NOT NULL DEFAULT '';
+
+CREATE TABLE "idempotency_keys" (
+    domain VARCHAR(100) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    command_id VARCHAR(26) NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (domain, key)
+);
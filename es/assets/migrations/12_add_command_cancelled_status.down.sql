@@ -0,0 +1,2 @@
+-- enum values cannot be dropped, the cancelled commands are marked as failed instead
+UPDATE "commands" SET status = 'failure', last_error = 'cancelled' WHERE status = 'cancelled';
@@ -0,0 +1 @@
+ALTER TYPE "command_status" ADD VALUE IF NOT EXISTS 'cancelled';
@@ -0,0 +1,6 @@
+DROP TRIGGER IF EXISTS commands_results_notify ON commands;
+CREATE TRIGGER commands_results_notify AFTER UPDATE OF status ON commands
+    FOR EACH ROW WHEN (NEW.status IN ('finished', 'failure'))
+    EXECUTE PROCEDURE es_notify_command_results();
+
+ALTER TABLE "commands" DROP COLUMN not_before;
@@ -0,0 +1,6 @@
+ALTER TABLE "commands" ADD COLUMN not_before TIMESTAMP WITH TIME ZONE DEFAULT NULL;
+
+DROP TRIGGER IF EXISTS commands_results_notify ON commands;
+CREATE TRIGGER commands_results_notify AFTER UPDATE OF status ON commands
+    FOR EACH ROW WHEN (NEW.status IN ('finished', 'failure', 'cancelled'))
+    EXECUTE PROCEDURE es_notify_command_results();
@@ -0,0 +1,12 @@
+CREATE TABLE "saga_instances" (
+    saga VARCHAR(100) NOT NULL,
+    id VARCHAR(255) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    state JSONB,
+    compensations JSONB NOT NULL DEFAULT '[]',
+    position BIGINT NOT NULL DEFAULT 0,
+    version INTEGER NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (saga, id)
+);
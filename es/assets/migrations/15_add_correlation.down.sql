@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS "events_correlation_id_idx";
+ALTER TABLE "events" DROP COLUMN correlation_id, DROP COLUMN causation_id;
+ALTER TABLE "commands" DROP COLUMN correlation_id, DROP COLUMN causation_id;
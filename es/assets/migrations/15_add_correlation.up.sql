@@ -0,0 +1,9 @@
+ALTER TABLE "commands"
+    ADD COLUMN correlation_id VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN causation_id VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE "events"
+    ADD COLUMN correlation_id VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN causation_id VARCHAR(255) NOT NULL DEFAULT '';
+
+CREATE INDEX "events_correlation_id_idx" ON "events" (correlation_id) WHERE correlation_id != '';
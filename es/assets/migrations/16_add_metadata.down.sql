@@ -0,0 +1,2 @@
+ALTER TABLE "events" DROP COLUMN metadata;
+ALTER TABLE "commands" DROP COLUMN metadata;
@@ -0,0 +1,3 @@
+ALTER TABLE "commands" ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}';
+
+ALTER TABLE "events" ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}';
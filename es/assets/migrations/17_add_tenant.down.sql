@@ -0,0 +1,43 @@
+ALTER TABLE "saga_instances" DISABLE ROW LEVEL SECURITY;
+ALTER TABLE "idempotency_keys" DISABLE ROW LEVEL SECURITY;
+ALTER TABLE "dead_letter_events" DISABLE ROW LEVEL SECURITY;
+ALTER TABLE "subscriptions" DISABLE ROW LEVEL SECURITY;
+ALTER TABLE "snapshots" DISABLE ROW LEVEL SECURITY;
+ALTER TABLE "aggregate_versions" DISABLE ROW LEVEL SECURITY;
+ALTER TABLE "events" DISABLE ROW LEVEL SECURITY;
+ALTER TABLE "commands" DISABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS "saga_instances_tenant" ON "saga_instances";
+DROP POLICY IF EXISTS "idempotency_keys_tenant" ON "idempotency_keys";
+DROP POLICY IF EXISTS "dead_letter_events_tenant" ON "dead_letter_events";
+DROP POLICY IF EXISTS "subscriptions_tenant" ON "subscriptions";
+DROP POLICY IF EXISTS "snapshots_tenant" ON "snapshots";
+DROP POLICY IF EXISTS "aggregate_versions_tenant" ON "aggregate_versions";
+DROP POLICY IF EXISTS "events_tenant" ON "events";
+DROP POLICY IF EXISTS "commands_tenant" ON "commands";
+
+ALTER TABLE "saga_instances" DROP CONSTRAINT "saga_instances_pkey", ADD PRIMARY KEY (saga, id);
+ALTER TABLE "saga_instances" DROP COLUMN tenant;
+
+ALTER TABLE "idempotency_keys" DROP CONSTRAINT "idempotency_keys_pkey", ADD PRIMARY KEY (domain, key);
+ALTER TABLE "idempotency_keys" DROP COLUMN tenant;
+
+ALTER TABLE "dead_letter_events" DROP CONSTRAINT "dead_letter_events_tenant_subscription_group_fkey";
+ALTER TABLE "dead_letter_events" DROP CONSTRAINT "dead_letter_events_pkey", ADD PRIMARY KEY (subscription_group, event_id);
+ALTER TABLE "dead_letter_events" DROP COLUMN tenant;
+
+ALTER TABLE "subscriptions" DROP CONSTRAINT "subscriptions_pkey", ADD PRIMARY KEY (subscription_group);
+ALTER TABLE "subscriptions" DROP COLUMN tenant;
+
+ALTER TABLE "dead_letter_events"
+    ADD FOREIGN KEY (subscription_group) REFERENCES "subscriptions" (subscription_group) ON DELETE CASCADE;
+
+ALTER TABLE "snapshots" DROP CONSTRAINT "snapshots_pkey", ADD PRIMARY KEY (aggregate_id);
+ALTER TABLE "snapshots" DROP COLUMN tenant;
+
+ALTER TABLE "aggregate_versions" DROP CONSTRAINT "aggregate_versions_pkey", ADD PRIMARY KEY (aggregate_id);
+ALTER TABLE "aggregate_versions" DROP COLUMN tenant;
+
+DROP INDEX IF EXISTS "events_tenant_aggregate_id_idx";
+ALTER TABLE "events" DROP COLUMN tenant;
+ALTER TABLE "commands" DROP COLUMN tenant;
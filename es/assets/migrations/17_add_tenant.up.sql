@@ -0,0 +1,56 @@
+ALTER TABLE "commands" ADD COLUMN tenant VARCHAR(100) NOT NULL DEFAULT '';
+
+ALTER TABLE "events" ADD COLUMN tenant VARCHAR(100) NOT NULL DEFAULT '';
+
+CREATE INDEX "events_tenant_aggregate_id_idx" ON "events" (tenant, aggregate_id, version);
+
+ALTER TABLE "aggregate_versions" ADD COLUMN tenant VARCHAR(100) NOT NULL DEFAULT '';
+ALTER TABLE "aggregate_versions" DROP CONSTRAINT "aggregate_versions_pkey", ADD PRIMARY KEY (tenant, aggregate_id);
+
+ALTER TABLE "snapshots" ADD COLUMN tenant VARCHAR(100) NOT NULL DEFAULT '';
+ALTER TABLE "snapshots" DROP CONSTRAINT "snapshots_pkey", ADD PRIMARY KEY (tenant, aggregate_id);
+
+ALTER TABLE "dead_letter_events" DROP CONSTRAINT "dead_letter_events_subscription_group_fkey";
+
+ALTER TABLE "subscriptions" ADD COLUMN tenant VARCHAR(100) NOT NULL DEFAULT '';
+ALTER TABLE "subscriptions" DROP CONSTRAINT "subscriptions_pkey", ADD PRIMARY KEY (tenant, subscription_group);
+
+ALTER TABLE "dead_letter_events" ADD COLUMN tenant VARCHAR(100) NOT NULL DEFAULT '';
+ALTER TABLE "dead_letter_events"
+    DROP CONSTRAINT "dead_letter_events_pkey",
+    ADD PRIMARY KEY (tenant, subscription_group, event_id),
+    ADD FOREIGN KEY (tenant, subscription_group) REFERENCES "subscriptions" (tenant, subscription_group) ON DELETE CASCADE;
+
+ALTER TABLE "idempotency_keys" ADD COLUMN tenant VARCHAR(100) NOT NULL DEFAULT '';
+ALTER TABLE "idempotency_keys" DROP CONSTRAINT "idempotency_keys_pkey", ADD PRIMARY KEY (tenant, domain, key);
+
+ALTER TABLE "saga_instances" ADD COLUMN tenant VARCHAR(100) NOT NULL DEFAULT '';
+ALTER TABLE "saga_instances" DROP CONSTRAINT "saga_instances_pkey", ADD PRIMARY KEY (tenant, saga, id);
+
+-- The policies restrict the sessions that set es.tenant to the rows of the
+-- tenant. They do not apply to the owner of the tables.
+CREATE POLICY "commands_tenant" ON "commands"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
+CREATE POLICY "events_tenant" ON "events"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
+CREATE POLICY "aggregate_versions_tenant" ON "aggregate_versions"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
+CREATE POLICY "snapshots_tenant" ON "snapshots"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
+CREATE POLICY "subscriptions_tenant" ON "subscriptions"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
+CREATE POLICY "dead_letter_events_tenant" ON "dead_letter_events"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
+CREATE POLICY "idempotency_keys_tenant" ON "idempotency_keys"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
+CREATE POLICY "saga_instances_tenant" ON "saga_instances"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
+
+ALTER TABLE "commands" ENABLE ROW LEVEL SECURITY;
+ALTER TABLE "events" ENABLE ROW LEVEL SECURITY;
+ALTER TABLE "aggregate_versions" ENABLE ROW LEVEL SECURITY;
+ALTER TABLE "snapshots" ENABLE ROW LEVEL SECURITY;
+ALTER TABLE "subscriptions" ENABLE ROW LEVEL SECURITY;
+ALTER TABLE "dead_letter_events" ENABLE ROW LEVEL SECURITY;
+ALTER TABLE "idempotency_keys" ENABLE ROW LEVEL SECURITY;
+ALTER TABLE "saga_instances" ENABLE ROW LEVEL SECURITY;
@@ -0,0 +1,8 @@
+-- Only JSON payloads can be converted back.
+ALTER TABLE "events"
+    DROP COLUMN codec,
+    ALTER COLUMN data TYPE JSONB USING convert_from(data, 'UTF8')::jsonb;
+
+ALTER TABLE "commands"
+    DROP COLUMN codec,
+    ALTER COLUMN data TYPE JSONB USING convert_from(data, 'UTF8')::jsonb;
@@ -0,0 +1,8 @@
+-- The payloads are stored as bytes, so codecs other than JSON can be used.
+ALTER TABLE "commands"
+    ALTER COLUMN data TYPE BYTEA USING convert_to(data::text, 'UTF8'),
+    ADD COLUMN codec VARCHAR(50) NOT NULL DEFAULT 'json';
+
+ALTER TABLE "events"
+    ALTER COLUMN data TYPE BYTEA USING convert_to(data::text, 'UTF8'),
+    ADD COLUMN codec VARCHAR(50) NOT NULL DEFAULT 'json';
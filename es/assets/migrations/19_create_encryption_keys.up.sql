@@ -0,0 +1,14 @@
+-- A forgotten subject keeps its row without a key, so it never gets a new one.
+CREATE TABLE "encryption_keys" (
+    tenant VARCHAR(100) NOT NULL DEFAULT '',
+    subject VARCHAR(255) NOT NULL,
+    key BYTEA,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT (now() at time zone 'utc'),
+    forgotten_at TIMESTAMP WITH TIME ZONE,
+    PRIMARY KEY (tenant, subject)
+);
+
+CREATE POLICY "encryption_keys_tenant" ON "encryption_keys"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
+
+ALTER TABLE "encryption_keys" ENABLE ROW LEVEL SECURITY;
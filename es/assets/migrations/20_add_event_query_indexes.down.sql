@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS "events_tenant_created_at_idx";
+
+DROP INDEX IF EXISTS "events_tenant_event_type_idx";
+
+DROP INDEX IF EXISTS "events_tenant_domain_idx";
+
+DROP INDEX IF EXISTS "events_tenant_global_position_idx";
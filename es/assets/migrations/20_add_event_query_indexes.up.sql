@@ -0,0 +1,7 @@
+CREATE INDEX "events_tenant_global_position_idx" ON "events" (tenant, global_position);
+
+CREATE INDEX "events_tenant_domain_idx" ON "events" (tenant, split_part(aggregate_id, '-', 1), global_position);
+
+CREATE INDEX "events_tenant_event_type_idx" ON "events" (tenant, event_type, global_position);
+
+CREATE INDEX "events_tenant_created_at_idx" ON "events" (tenant, created_at);
@@ -0,0 +1,3 @@
+-- This migration is intentionally irreversible: the renumbered events cannot
+-- be told apart from the others, so the versions are kept.
+SELECT 1;
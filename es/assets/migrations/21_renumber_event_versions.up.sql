@@ -0,0 +1,13 @@
+-- The first event of an aggregate used to have version 0, one behind the
+-- version of the aggregate after applying it. Such streams cannot be loaded,
+-- the first event is not newer than the empty aggregate. The events stored
+-- since have the right versions and follow a gap, e.g. 0, 1, 2, 4, 5, so only
+-- the gapless prefix that starts at 0 is moved up by one.
+UPDATE "events" e SET version = e.version + 1
+FROM (
+    SELECT id, version,
+        row_number() OVER (PARTITION BY tenant, aggregate_id ORDER BY version, global_position) - 1 AS position
+    FROM "events"
+    WHERE (tenant, aggregate_id) IN (SELECT tenant, aggregate_id FROM "events" WHERE version = 0)
+) o
+WHERE e.id = o.id AND o.version = o.position;
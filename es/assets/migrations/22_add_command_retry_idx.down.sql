@@ -0,0 +1 @@
+DROP INDEX IF EXISTS "commands_retrying_idx";
@@ -0,0 +1 @@
+CREATE INDEX "commands_retrying_idx" ON "commands" (tenant, aggregate_id, id) WHERE status = 'pending' AND attempts > 0;
@@ -0,0 +1,38 @@
+ALTER TABLE "encryption_keys" NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE "saga_instances" NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE "idempotency_keys" NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE "dead_letter_events" NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE "subscriptions" NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE "snapshots" NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE "aggregate_versions" NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE "events" NO FORCE ROW LEVEL SECURITY;
+ALTER TABLE "commands" NO FORCE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS "encryption_keys_tenant" ON "encryption_keys";
+DROP POLICY IF EXISTS "saga_instances_tenant" ON "saga_instances";
+DROP POLICY IF EXISTS "idempotency_keys_tenant" ON "idempotency_keys";
+DROP POLICY IF EXISTS "dead_letter_events_tenant" ON "dead_letter_events";
+DROP POLICY IF EXISTS "subscriptions_tenant" ON "subscriptions";
+DROP POLICY IF EXISTS "snapshots_tenant" ON "snapshots";
+DROP POLICY IF EXISTS "aggregate_versions_tenant" ON "aggregate_versions";
+DROP POLICY IF EXISTS "events_tenant" ON "events";
+DROP POLICY IF EXISTS "commands_tenant" ON "commands";
+
+CREATE POLICY "commands_tenant" ON "commands"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
+CREATE POLICY "events_tenant" ON "events"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
+CREATE POLICY "aggregate_versions_tenant" ON "aggregate_versions"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
+CREATE POLICY "snapshots_tenant" ON "snapshots"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
+CREATE POLICY "subscriptions_tenant" ON "subscriptions"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
+CREATE POLICY "dead_letter_events_tenant" ON "dead_letter_events"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
+CREATE POLICY "idempotency_keys_tenant" ON "idempotency_keys"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
+CREATE POLICY "saga_instances_tenant" ON "saga_instances"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
+CREATE POLICY "encryption_keys_tenant" ON "encryption_keys"
+    USING (COALESCE(current_setting('es.tenant', true), '') IN ('', tenant));
@@ -0,0 +1,51 @@
+-- The sessions that set es.scope to tenant only see the rows of es.tenant,
+-- an empty es.tenant is the default tenant and not all of them. The system
+-- scope and the sessions that do not set es.scope see all the rows. FORCE
+-- applies the policies to the owner of the tables too.
+DROP POLICY IF EXISTS "commands_tenant" ON "commands";
+DROP POLICY IF EXISTS "events_tenant" ON "events";
+DROP POLICY IF EXISTS "aggregate_versions_tenant" ON "aggregate_versions";
+DROP POLICY IF EXISTS "snapshots_tenant" ON "snapshots";
+DROP POLICY IF EXISTS "subscriptions_tenant" ON "subscriptions";
+DROP POLICY IF EXISTS "dead_letter_events_tenant" ON "dead_letter_events";
+DROP POLICY IF EXISTS "idempotency_keys_tenant" ON "idempotency_keys";
+DROP POLICY IF EXISTS "saga_instances_tenant" ON "saga_instances";
+DROP POLICY IF EXISTS "encryption_keys_tenant" ON "encryption_keys";
+
+CREATE POLICY "commands_tenant" ON "commands"
+    USING (COALESCE(current_setting('es.scope', true), '') IN ('', 'system')
+        OR tenant = current_setting('es.tenant', true));
+CREATE POLICY "events_tenant" ON "events"
+    USING (COALESCE(current_setting('es.scope', true), '') IN ('', 'system')
+        OR tenant = current_setting('es.tenant', true));
+CREATE POLICY "aggregate_versions_tenant" ON "aggregate_versions"
+    USING (COALESCE(current_setting('es.scope', true), '') IN ('', 'system')
+        OR tenant = current_setting('es.tenant', true));
+CREATE POLICY "snapshots_tenant" ON "snapshots"
+    USING (COALESCE(current_setting('es.scope', true), '') IN ('', 'system')
+        OR tenant = current_setting('es.tenant', true));
+CREATE POLICY "subscriptions_tenant" ON "subscriptions"
+    USING (COALESCE(current_setting('es.scope', true), '') IN ('', 'system')
+        OR tenant = current_setting('es.tenant', true));
+CREATE POLICY "dead_letter_events_tenant" ON "dead_letter_events"
+    USING (COALESCE(current_setting('es.scope', true), '') IN ('', 'system')
+        OR tenant = current_setting('es.tenant', true));
+CREATE POLICY "idempotency_keys_tenant" ON "idempotency_keys"
+    USING (COALESCE(current_setting('es.scope', true), '') IN ('', 'system')
+        OR tenant = current_setting('es.tenant', true));
+CREATE POLICY "saga_instances_tenant" ON "saga_instances"
+    USING (COALESCE(current_setting('es.scope', true), '') IN ('', 'system')
+        OR tenant = current_setting('es.tenant', true));
+CREATE POLICY "encryption_keys_tenant" ON "encryption_keys"
+    USING (COALESCE(current_setting('es.scope', true), '') IN ('', 'system')
+        OR tenant = current_setting('es.tenant', true));
+
+ALTER TABLE "commands" FORCE ROW LEVEL SECURITY;
+ALTER TABLE "events" FORCE ROW LEVEL SECURITY;
+ALTER TABLE "aggregate_versions" FORCE ROW LEVEL SECURITY;
+ALTER TABLE "snapshots" FORCE ROW LEVEL SECURITY;
+ALTER TABLE "subscriptions" FORCE ROW LEVEL SECURITY;
+ALTER TABLE "dead_letter_events" FORCE ROW LEVEL SECURITY;
+ALTER TABLE "idempotency_keys" FORCE ROW LEVEL SECURITY;
+ALTER TABLE "saga_instances" FORCE ROW LEVEL SECURITY;
+ALTER TABLE "encryption_keys" FORCE ROW LEVEL SECURITY;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS "events_pii_subject_idx";
@@ -0,0 +1,3 @@
+-- ForgetSubject deletes the snapshots of the aggregates with events of the subject.
+CREATE INDEX "events_pii_subject_idx" ON "events" (tenant, (metadata->>'pii_subject'))
+    WHERE metadata->>'pii_subject' IS NOT NULL;
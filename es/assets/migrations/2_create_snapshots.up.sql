@@ -0,0 +1,8 @@
+CREATE TABLE "snapshots" (
+    aggregate_id VARCHAR(50) PRIMARY KEY,
+    aggregate_type VARCHAR(100) NOT NULL,
+    version INTEGER NOT NULL,
+    schema_version INTEGER NOT NULL,
+    data JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT (now() at time zone 'utc')
+);
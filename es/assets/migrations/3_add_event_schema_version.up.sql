@@ -0,0 +1 @@
+ALTER TABLE "events" ADD COLUMN schema_version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,10 @@
+DROP INDEX "commands_unprocessed_idx";
+
+ALTER TABLE "commands"
+    DROP COLUMN processed_at,
+    DROP COLUMN last_error,
+    DROP COLUMN attempts,
+    ALTER COLUMN status DROP NOT NULL,
+    ALTER COLUMN status SET DEFAULT NULL;
+
+UPDATE "commands" SET status = NULL WHERE status IN ('pending', 'running');
@@ -0,0 +1,10 @@
+UPDATE "commands" SET status = 'pending' WHERE status IS NULL;
+
+ALTER TABLE "commands"
+    ALTER COLUMN status SET DEFAULT 'pending',
+    ALTER COLUMN status SET NOT NULL,
+    ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN last_error TEXT NOT NULL DEFAULT '',
+    ADD COLUMN processed_at TIMESTAMP WITH TIME ZONE DEFAULT NULL;
+
+CREATE INDEX "commands_unprocessed_idx" ON "commands" (id) WHERE status IN ('pending', 'running');
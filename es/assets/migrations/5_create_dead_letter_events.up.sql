@@ -0,0 +1,7 @@
+CREATE TABLE "dead_letter_events" (
+    subscription_group VARCHAR(50) NOT NULL REFERENCES "subscriptions" (subscription_group) ON DELETE CASCADE,
+    event_id VARCHAR(26) NOT NULL REFERENCES "events" (id),
+    last_error TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT (now() at time zone 'utc'),
+    PRIMARY KEY (subscription_group, event_id)
+);
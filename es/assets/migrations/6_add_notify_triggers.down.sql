@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS events_notify ON events;
+DROP TRIGGER IF EXISTS commands_notify ON commands;
+DROP FUNCTION IF EXISTS es_notify_events();
+DROP FUNCTION IF EXISTS es_notify_commands();
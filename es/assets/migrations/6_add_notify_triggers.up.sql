@@ -0,0 +1,19 @@
+CREATE OR REPLACE FUNCTION es_notify_commands() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('es_commands', '');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION es_notify_events() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('es_events', '');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER commands_notify AFTER INSERT ON commands
+    FOR EACH STATEMENT EXECUTE PROCEDURE es_notify_commands();
+
+CREATE TRIGGER events_notify AFTER INSERT ON events
+    FOR EACH STATEMENT EXECUTE PROCEDURE es_notify_events();
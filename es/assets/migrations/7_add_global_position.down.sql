@@ -0,0 +1,9 @@
+ALTER TABLE "subscriptions" ADD COLUMN last_event_id VARCHAR(26) DEFAULT NULL REFERENCES "events" (id);
+
+UPDATE "subscriptions" s SET last_event_id = e.id
+FROM "events" e
+WHERE e.global_position = s.position;
+
+ALTER TABLE "subscriptions" DROP COLUMN position;
+
+ALTER TABLE "events" DROP COLUMN global_position;
@@ -0,0 +1,25 @@
+CREATE SEQUENCE "events_global_position_seq" AS BIGINT;
+
+ALTER TABLE "events" ADD COLUMN global_position BIGINT;
+
+UPDATE "events" e SET global_position = o.position
+FROM (SELECT id, ROW_NUMBER() OVER (ORDER BY id, version) AS position FROM "events") o
+WHERE e.id = o.id;
+
+SELECT setval('events_global_position_seq', COALESCE((SELECT MAX(global_position) FROM "events"), 0) + 1, false);
+
+ALTER TABLE "events"
+    ALTER COLUMN global_position SET DEFAULT nextval('events_global_position_seq'),
+    ALTER COLUMN global_position SET NOT NULL;
+
+ALTER SEQUENCE "events_global_position_seq" OWNED BY "events".global_position;
+
+CREATE UNIQUE INDEX "events_global_position_idx" ON "events" (global_position);
+
+ALTER TABLE "subscriptions" ADD COLUMN position BIGINT NOT NULL DEFAULT 0;
+
+UPDATE "subscriptions" s SET position = e.global_position
+FROM "events" e
+WHERE e.id = s.last_event_id;
+
+ALTER TABLE "subscriptions" DROP COLUMN last_event_id;
@@ -0,0 +1,5 @@
+CREATE TABLE "leases" (
+    name VARCHAR(100) PRIMARY KEY,
+    owner VARCHAR(100) NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
@@ -0,0 +1,200 @@
+// Command esgen generates the registry wiring of the commands and the events
+// of a package. It finds the struct types that embed es.CommandBase or
+// es.EventBase and writes a file with their constructors, a function that
+// registers them with any codec and compile time assertions that they
+// implement es.ICommand and es.IEvent. Embedding the bases by pointer is an
+// error.
+//
+// Use it with go generate:
+//
+//	//go:generate go run github.com/gosom/kit/es/cmd/esgen
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const esPath = "github.com/gosom/kit/es"
+
+func main() {
+	output := flag.String("output", "es_gen.go", "the name of the generated file")
+	register := flag.String("register", "Register", "the name of the function that registers the types")
+	flag.Parse()
+	dir := "."
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+	src, err := generate(dir, *output, *register)
+	if err != nil {
+		log.Fatalf("esgen: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, *output), src, 0o644); err != nil {
+		log.Fatalf("esgen: %s", err)
+	}
+}
+
+// pkg is what the generated file needs to know about the scanned package.
+type pkg struct {
+	Name     string
+	Register string
+	Commands []string
+	Events   []string
+}
+
+// generate scans the package in dir, skipping the output file and the
+// tests, and returns the generated source.
+func generate(dir string, output string, register string) ([]byte, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(info os.FileInfo) bool {
+		return info.Name() != output && !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("expected one package in %s, found %d", dir, len(pkgs))
+	}
+	ans := pkg{Register: register}
+	for name, p := range pkgs {
+		ans.Name = name
+		for _, file := range p.Files {
+			commands, events, err := scan(file)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", fset.Position(file.Package).Filename, err)
+			}
+			ans.Commands = append(ans.Commands, commands...)
+			ans.Events = append(ans.Events, events...)
+		}
+	}
+	if len(ans.Commands) == 0 && len(ans.Events) == 0 {
+		return nil, errors.New("no commands or events found")
+	}
+	sort.Strings(ans.Commands)
+	sort.Strings(ans.Events)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, ans); err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+// scan returns the commands and the events declared in the file. It fails
+// on the types that embed es.CommandBase or es.EventBase by pointer, their
+// constructors would return them with a nil base.
+func scan(file *ast.File) (commands []string, events []string, err error) {
+	alias := esAlias(file)
+	if alias == "" {
+		return nil, nil, nil
+	}
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			typ := spec.(*ast.TypeSpec)
+			st, ok := typ.Type.(*ast.StructType)
+			if !ok || typ.TypeParams != nil {
+				continue
+			}
+			base, pointer := embedded(st, alias)
+			if pointer && (base == "CommandBase" || base == "EventBase") {
+				return nil, nil, fmt.Errorf("%s embeds *%s.%s, embed %s.%s instead", typ.Name.Name, alias, base, alias, base)
+			}
+			switch base {
+			case "CommandBase":
+				commands = append(commands, typ.Name.Name)
+			case "EventBase":
+				events = append(events, typ.Name.Name)
+			}
+		}
+	}
+	return commands, events, nil
+}
+
+// esAlias returns the name the file imports the es package with.
+func esAlias(file *ast.File) string {
+	for _, imp := range file.Imports {
+		path, err := strconv.Unquote(imp.Path.Value)
+		if err != nil || path != esPath {
+			continue
+		}
+		if imp.Name != nil {
+			return imp.Name.Name
+		}
+		return "es"
+	}
+	return ""
+}
+
+// embedded returns the es type that the struct embeds, if any, and whether
+// it is embedded by pointer.
+func embedded(st *ast.StructType, alias string) (string, bool) {
+	for _, field := range st.Fields.List {
+		if len(field.Names) > 0 {
+			continue
+		}
+		typ, pointer := field.Type, false
+		if star, ok := typ.(*ast.StarExpr); ok {
+			typ, pointer = star.X, true
+		}
+		sel, ok := typ.(*ast.SelectorExpr)
+		if !ok {
+			continue
+		}
+		if x, ok := sel.X.(*ast.Ident); ok && x.Name == alias {
+			return sel.Sel.Name, pointer
+		}
+	}
+	return "", false
+}
+
+var tmpl = template.Must(template.New("esgen").Parse(`// Code generated by esgen. DO NOT EDIT.
+
+package {{ .Name }}
+
+import "github.com/gosom/kit/es"
+
+var (
+{{- range .Commands }}
+	_ es.ICommand = (*{{ . }})(nil)
+{{- end }}
+{{- range .Events }}
+	_ es.IEvent = (*{{ . }})(nil)
+{{- end }}
+)
+
+// {{ .Register }} registers the commands and the events of the package.
+func {{ .Register }}(registry *es.Registry) {
+{{- range .Commands }}
+	registry.RegisterCommandType("{{ . }}", new{{ . }})
+{{- end }}
+{{- range .Events }}
+	registry.RegisterEventType("{{ . }}", new{{ . }})
+{{- end }}
+}
+{{ range .Commands }}
+func new{{ . }}() es.ICommand {
+	return &{{ . }}{}
+}
+{{ end }}
+{{- range .Events }}
+func new{{ . }}() es.IEvent {
+	return &{{ . }}{}
+}
+{{ end -}}
+`))
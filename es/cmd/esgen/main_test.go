@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, src := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644))
+	}
+	return dir
+}
+
+func TestGenerate(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"commands.go": `package orders
+
+import kit "github.com/gosom/kit/es"
+
+type PlaceOrder struct {
+	kit.CommandBase
+	ID string
+}
+
+type Generic[T any] struct {
+	kit.CommandBase
+}
+
+type notACommand struct {
+	ID string
+}
+`,
+		"events.go": `package orders
+
+import "github.com/gosom/kit/es"
+
+type OrderPlaced struct {
+	es.EventBase
+	ID string
+}
+
+type AnotherEvent struct {
+	es.EventBase
+}
+`,
+		"orders_test.go": `package orders
+
+import "github.com/gosom/kit/es"
+
+type TestEvent struct {
+	es.EventBase
+}
+`,
+		"es_gen.go": `package orders
+
+this file is replaced
+`,
+	})
+	src, err := generate(dir, "es_gen.go", "RegisterOrders")
+	require.NoError(t, err)
+	got := string(src)
+	require.Contains(t, got, "// Code generated by esgen. DO NOT EDIT.")
+	require.Contains(t, got, "package orders")
+	require.Contains(t, got, "_ es.ICommand = (*PlaceOrder)(nil)")
+	require.Contains(t, got, "func RegisterOrders(registry *es.Registry) {")
+	require.Contains(t, got, `registry.RegisterCommandType("PlaceOrder", newPlaceOrder)`)
+	require.Contains(t, got, `registry.RegisterEventType("OrderPlaced", newOrderPlaced)`)
+	require.Contains(t, got, "func newOrderPlaced() es.IEvent {")
+	require.Less(t, strings.Index(got, `"AnotherEvent"`), strings.Index(got, `"OrderPlaced"`), "the types are sorted")
+	for _, skipped := range []string{"Generic", "notACommand", "TestEvent"} {
+		require.NotContains(t, got, skipped)
+	}
+}
+
+func TestGenerateWithoutTypes(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.go": "package empty\n",
+	})
+	_, err := generate(dir, "es_gen.go", "Register")
+	require.Error(t, err)
+}
+
+func TestGeneratePointerEmbed(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"events.go": `package orders
+
+import "github.com/gosom/kit/es"
+
+type OrderPlaced struct {
+	*es.EventBase
+	ID string
+}
+`,
+	})
+	_, err := generate(dir, "es_gen.go", "Register")
+	require.ErrorContains(t, err, "OrderPlaced embeds *es.EventBase")
+}
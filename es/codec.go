@@ -0,0 +1,167 @@
+package es
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// CodecJSON is the name of the default codec.
+const CodecJSON = "json"
+
+// Codec encodes the payloads of the commands and the events.
+// The name of the codec is stored with every record, so records of
+// different codecs can be decoded side by side.
+type Codec interface {
+	// Name identifies the codec, it must be unique within a registry.
+	Name() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// JSON is the codec that encodes the payloads with encoding/json.
+var JSON Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return CodecJSON
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// RegisterCodec registers the codec, so the records encoded with it can be
+// decoded.
+func (r *Registry) RegisterCodec(codec Codec) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.codecs[codec.Name()] = codec
+}
+
+// SetCodec sets the registered codec that encodes the new commands and
+// events, JSON by default.
+func (r *Registry) SetCodec(name string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	codec, ok := r.getCodec(name)
+	if !ok {
+		return fmt.Errorf("codec %s: %w", name, ErrUnknownCodec)
+	}
+	r.codec = codec
+	return nil
+}
+
+// GetCodec returns the registered codec with the name.
+// Records without a codec name are JSON.
+func (r *Registry) GetCodec(name string) (Codec, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.getCodec(name)
+}
+
+func (r *Registry) getCodec(name string) (Codec, bool) {
+	if name == "" {
+		name = CodecJSON
+	}
+	codec, ok := r.codecs[name]
+	return codec, ok
+}
+
+func (r *Registry) defaultCodec() Codec {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.codec
+}
+
+// EncodeCommand converts the command to a command record that is encoded
+// with the codec of the registry. Commands registered with a converter are
+// encoded as JSON, the only codec they can be decoded from.
+func (r *Registry) EncodeCommand(domain string, cmd ICommand) (CommandRecord, error) {
+	r.mutex.RLock()
+	name := recordName(cmd.GetEventType(), cmd)
+	_, typed := r.commandTypes[name]
+	_, converted := r.commands[name]
+	r.mutex.RUnlock()
+	if converted && !typed {
+		return commandToCommandRecord(domain, cmd, JSON)
+	}
+	return commandToCommandRecord(domain, cmd, r.defaultCodec())
+}
+
+// EncodeEvent converts the event to an event record that is encoded with
+// the codec of the registry. Events registered with a converter are encoded
+// as JSON, the only codec they can be decoded from.
+func (r *Registry) EncodeEvent(ev IEvent) (EventRecord, error) {
+	r.mutex.RLock()
+	name := recordName(ev.GetEventType(), ev)
+	_, typed := r.eventTypes[name]
+	_, converted := r.events[name]
+	r.mutex.RUnlock()
+	if converted && !typed {
+		return eventToEventRecord(ev, JSON)
+	}
+	return eventToEventRecord(ev, r.defaultCodec())
+}
+
+// recordName returns the name of a command or an event, its struct name when
+// it has no event type yet.
+func recordName(eventType string, v any) string {
+	if eventType != "" {
+		return eventType
+	}
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// DecodeCommand decodes the payload of the command with the named codec.
+// Commands registered with a converter can only be decoded from JSON.
+func (r *Registry) DecodeCommand(codec string, name string, data []byte) (ICommand, error) {
+	r.mutex.RLock()
+	c, ok := r.getCodec(codec)
+	newFn, typed := r.commandTypes[name]
+	convFn, converted := r.commands[name]
+	r.mutex.RUnlock()
+	switch {
+	case !typed && !converted:
+		return nil, fmt.Errorf("command type %s not found in registry", name)
+	case !ok:
+		return nil, fmt.Errorf("command %s codec %s: %w", name, codec, ErrUnknownCodec)
+	case typed:
+		cmd := newFn()
+		return cmd, c.Unmarshal(data, cmd)
+	case c.Name() != CodecJSON:
+		return nil, fmt.Errorf("command %s has a JSON converter and cannot be decoded with %s: %w", name, codec, ErrUnknownCodec)
+	}
+	return convFn(data)
+}
+
+// DecodeEvent decodes the payload of the event with the named codec.
+// Events registered with a converter can only be decoded from JSON.
+func (r *Registry) DecodeEvent(codec string, name string, data []byte) (IEvent, error) {
+	r.mutex.RLock()
+	c, ok := r.getCodec(codec)
+	newFn, typed := r.eventTypes[name]
+	convFn, converted := r.events[name]
+	r.mutex.RUnlock()
+	switch {
+	case !typed && !converted:
+		return nil, fmt.Errorf("event type %s not found in registry", name)
+	case !ok:
+		return nil, fmt.Errorf("event %s codec %s: %w", name, codec, ErrUnknownCodec)
+	case typed:
+		ev := newFn()
+		return ev, c.Unmarshal(data, ev)
+	case c.Name() != CodecJSON:
+		return nil, fmt.Errorf("event %s has a JSON converter and cannot be decoded with %s: %w", name, codec, ErrUnknownCodec)
+	}
+	return convFn(data)
+}
@@ -0,0 +1,162 @@
+package es_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gosom/kit/es"
+	"github.com/gosom/kit/es/mock"
+	"github.com/gosom/kit/es/msgpack"
+	"github.com/gosom/kit/es/protobuf"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type labelled struct {
+	es.EventBase
+	*wrapperspb.StringValue
+}
+
+func (e *labelled) ProtoReflect() protoreflect.Message {
+	if e.StringValue == nil {
+		e.StringValue = new(wrapperspb.StringValue)
+	}
+	return e.StringValue.ProtoReflect()
+}
+
+func TestCodecs(t *testing.T) {
+	reg := newOrderRegistry()
+	reg.RegisterCodec(msgpack.NewCodec())
+	reg.RegisterCodec(protobuf.NewCodec())
+	require.NoError(t, es.RegisterEvent[labelled](reg))
+	require.ErrorIs(t, reg.SetCodec("xml"), es.ErrUnknownCodec)
+
+	t.Run("MessagePack", func(t *testing.T) {
+		require.NoError(t, reg.SetCodec(msgpack.Name))
+		rec, err := reg.EncodeCommand("order", &placeOrder{ID: "1", Quantity: 2})
+		require.NoError(t, err)
+		require.Equal(t, msgpack.Name, rec.Codec)
+		cmd, err := es.CommandRecordToCommand(reg, rec)
+		require.NoError(t, err)
+		require.Equal(t, rec.ID, cmd.GetID())
+		require.Equal(t, "order-1", cmd.GetAggregateID())
+		require.Equal(t, 2, cmd.(*placeOrder).Quantity)
+
+		// the bus carries the binary payload and its codec
+		msg, err := es.CommandRecordToBusMessage(rec)
+		require.NoError(t, err)
+		require.Equal(t, msgpack.Name, msg.Headers[es.CodecHeader])
+		var got es.CommandRecord
+		require.NoError(t, es.BusMessageToCommandRecord(msg, &got))
+		require.Equal(t, rec.Data, got.Data)
+		require.Equal(t, msgpack.Name, got.Codec)
+	})
+
+	t.Run("Protobuf", func(t *testing.T) {
+		require.NoError(t, reg.SetCodec(protobuf.Name))
+		ev := &labelled{StringValue: wrapperspb.String("urgent")}
+		ev.SetEventType("labelled")
+		rec, err := reg.EncodeEvent(ev)
+		require.NoError(t, err)
+		require.Equal(t, protobuf.Name, rec.Codec)
+		decoded, err := es.EventRecordToEvent(reg, rec)
+		require.NoError(t, err)
+		require.Equal(t, "urgent", decoded.(*labelled).Value)
+
+		_, err = reg.EncodeEvent(&orderPlaced{Quantity: 1})
+		require.Error(t, err, "only proto messages can be encoded")
+	})
+
+	t.Run("Mixed", func(t *testing.T) {
+		require.NoError(t, reg.SetCodec(msgpack.Name))
+		packed, err := reg.EncodeEvent(&orderPlaced{Quantity: 1})
+		require.NoError(t, err)
+		packed.EventType = "orderPlaced"
+		require.NoError(t, reg.SetCodec(es.CodecJSON))
+		plain, err := reg.EncodeEvent(&orderPlaced{Quantity: 2})
+		require.NoError(t, err)
+		plain.EventType = "orderPlaced"
+		legacy := plain
+		legacy.Codec = ""
+		events, err := es.EventRecordsToEvents(reg, []es.EventRecord{packed, plain, legacy})
+		require.NoError(t, err)
+		require.Equal(t, 1, events[0].(*orderPlaced).Quantity)
+		require.Equal(t, 2, events[1].(*orderPlaced).Quantity)
+		require.Equal(t, 2, events[2].(*orderPlaced).Quantity)
+
+		unknown := plain
+		unknown.Codec = "xml"
+		_, err = es.EventRecordToEvent(reg, unknown)
+		require.ErrorIs(t, err, es.ErrUnknownCodec)
+	})
+
+	t.Run("Converter", func(t *testing.T) {
+		// converters decode JSON only
+		reg := es.NewRegistry()
+		reg.RegisterCodec(msgpack.NewCodec())
+		reg.RegisterEvent("titleChanged", func(data []byte) (es.IEvent, error) {
+			return &titleChanged{}, nil
+		})
+		_, err := reg.DecodeEvent(es.CodecJSON, "titleChanged", []byte(`{}`))
+		require.NoError(t, err)
+		_, err = reg.DecodeEvent(msgpack.Name, "titleChanged", []byte{0x80})
+		require.ErrorIs(t, err, es.ErrUnknownCodec)
+
+		// and are encoded as JSON whatever the codec of the registry
+		require.NoError(t, reg.SetCodec(msgpack.Name))
+		ev := &titleChanged{}
+		ev.SetEventType("titleChanged")
+		rec, err := reg.EncodeEvent(ev)
+		require.NoError(t, err)
+		require.Equal(t, es.CodecJSON, rec.Codec)
+		_, err = es.EventRecordToEvent(reg, rec)
+		require.NoError(t, err)
+
+		reg.RegisterCommand("placeOrder", func(data []byte) (es.ICommand, error) {
+			cmd := &placeOrder{}
+			return cmd, json.Unmarshal(data, cmd)
+		})
+		cmdRec, err := reg.EncodeCommand("order", &placeOrder{ID: "1", Quantity: 2})
+		require.NoError(t, err)
+		require.Equal(t, es.CodecJSON, cmdRec.Codec)
+		cmd, err := es.CommandRecordToCommand(reg, cmdRec)
+		require.NoError(t, err)
+		require.Equal(t, 2, cmd.(*placeOrder).Quantity)
+	})
+}
+
+func TestCommandProcessorCodec(t *testing.T) {
+	store := mock.NewEventStore()
+	registry := newOrderRegistry()
+	registry.RegisterCodec(msgpack.NewCodec())
+	require.NoError(t, registry.SetCodec(msgpack.Name))
+	processor, err := es.NewCommandProcessor(1, store, registry, "order")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- processor.Start(ctx)
+	}()
+	defer func() {
+		cancel()
+		require.NoError(t, <-done)
+	}()
+
+	rec, err := registry.EncodeCommand("order", &placeOrder{ID: "1", Quantity: 3})
+	require.NoError(t, err)
+	_, err = store.SaveCommandRecords(ctx, rec)
+	require.NoError(t, err)
+
+	result, err := es.WaitForCommand(ctx, store, rec.ID)
+	require.NoError(t, err)
+	require.NoError(t, result.Err())
+	require.Len(t, result.Events, 1)
+	require.Equal(t, msgpack.Name, result.Events[0].Codec)
+	ev, err := es.EventRecordToEvent(registry, result.Events[0])
+	require.NoError(t, err)
+	require.Equal(t, 3, ev.(*orderPlaced).Quantity)
+}
@@ -54,19 +54,72 @@ func (e *CommandBase) Validate() error {
 	return nil
 }
 
+// The statuses of a command.
+// A command is pending until the processor picks it up, running while it is
+// being processed and finished once its results are stored.
+// Commands that fail more than the allowed attempts end up in failure.
+// A pending command can be cancelled.
+const (
+	CommandStatusPending   = "pending"
+	CommandStatusRunning   = "running"
+	CommandStatusFinished  = "finished"
+	CommandStatusFailure   = "failure"
+	CommandStatusCancelled = "cancelled"
+)
+
 // CommandRecord is the record for a command.
 type CommandRecord struct {
 	RecordBase
 	AggregateHash int32
 	Status        string
+	Attempts      int
+	LastError     string
+	ProcessedAt   *time.Time
+	// IdempotencyKey is an optional client supplied key. Commands of the same
+	// domain with the same key are saved only once while the key is valid.
+	IdempotencyKey string
+	// NotBefore schedules the command, it is not processed before that time.
+	NotBefore     *time.Time
+	CorrelationID string
+	CausationID   string
+	Metadata      Metadata
+	// Tenant is the tenant the command belongs to, see ResolveTenant.
+	Tenant string
+	// Codec is the name of the codec of Data, see Registry.EncodeCommand.
+	Codec string
 }
 
 func (o *CommandRecord) Bind() []any {
 	ans := o.RecordBase.Bind()
-	ans = append(ans, &o.AggregateHash, &o.Status)
+	ans = append(ans, &o.AggregateHash, &o.Status, &o.Attempts, &o.LastError, &o.ProcessedAt, &o.IdempotencyKey, &o.NotBefore,
+		&o.CorrelationID, &o.CausationID, &o.Metadata, &o.Tenant, &o.Codec)
 	return ans
 }
 
+// Correlation returns the correlation of the command.
+func (o *CommandRecord) Correlation() Correlation {
+	return Correlation{CorrelationID: o.CorrelationID, CausationID: o.CausationID}
+}
+
+// SetCorrelation sets the correlation of the command.
+func (o *CommandRecord) SetCorrelation(c Correlation) {
+	o.CorrelationID, o.CausationID = c.CorrelationID, c.CausationID
+}
+
+// Domain returns the domain of the command, the prefix of its aggregate ID.
+func (o *CommandRecord) Domain() string {
+	domain, _, _ := strings.Cut(o.AggregateID, "-")
+	return domain
+}
+
+// Due reports whether the command can be processed at the given time.
+func (o *CommandRecord) Due(now time.Time) bool {
+	return o.NotBefore == nil || !o.NotBefore.After(now)
+}
+
+// DefaultIdempotencyTTL is how long an idempotency key is valid.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
 // prepareCommand sets the command ID and the event type and the aggregate ID.
 // It also validates the command.
 // this method is called before a command is published to the command bus.
@@ -119,13 +172,17 @@ func prepareCommand(domain string, ev ICommand) (err error) {
 	return
 }
 
-// CommandToCommandRecord converts a command to a command record.
+// CommandToCommandRecord converts a command to a JSON encoded command record.
 func CommandToCommandRecord(domain string, ev ICommand) (CommandRecord, error) {
+	return commandToCommandRecord(domain, ev, JSON)
+}
+
+func commandToCommandRecord(domain string, ev ICommand, codec Codec) (CommandRecord, error) {
 	err := prepareCommand(domain, ev)
 	if err != nil {
 		return CommandRecord{}, err
 	}
-	data, err := json.Marshal(ev)
+	data, err := codec.Marshal(ev)
 	if err != nil {
 		return CommandRecord{}, err
 	}
@@ -138,19 +195,57 @@ func CommandToCommandRecord(domain string, ev ICommand) (CommandRecord, error) {
 			CreatedAt:   time.Now().UTC(),
 		},
 		AggregateHash: ev.GetAggregateHash(),
+		Metadata:      ev.GetMetadata(),
+		Codec:         codec.Name(),
 	}, nil
 }
 
+// CommandRecordToCommand decodes the command of the record. Its personal
+// data is decrypted, the personal data of forgotten subjects is Redacted.
+func CommandRecordToCommand(registry *Registry, record CommandRecord) (ICommand, error) {
+	cmd, err := registry.DecodeCommand(record.Codec, record.EventType, record.Data)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := registry.decryptCommand(record, cmd); err != nil {
+		return nil, err
+	}
+	cmd.SetID(record.ID)
+	cmd.SetEventType(record.EventType)
+	cmd.SetAggregateID(record.AggregateID)
+	cmd.SetAggregateHash()
+	cmd.SetMetadata(record.Metadata)
+	return cmd, nil
+}
+
 type CommandRequest struct {
 	Name    string          `json:"name" validate:"required,gte=1,lte=100"`
 	Payload json.RawMessage `json:"payload"`
+	// IdempotencyKey deduplicates requests that are sent more than once.
+	IdempotencyKey string `json:"idempotency_key,omitempty" validate:"lte=255"`
+	// NotBefore schedules the command to be processed not before that time.
+	NotBefore *time.Time `json:"not_before,omitempty"`
 }
 
 func ParseCommandRequest(registry *Registry, r io.Reader) (ICommand, error) {
+	req, err := DecodeCommandRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	return CommandFromRequest(registry, req)
+}
+
+// DecodeCommandRequest decodes a JSON command request.
+func DecodeCommandRequest(r io.Reader) (CommandRequest, error) {
 	var req CommandRequest
 	if err := json.NewDecoder(r).Decode(&req); err != nil {
-		return nil, fmt.Errorf("%w %s", ErrInvalidCommand, err.Error())
+		return req, fmt.Errorf("%w %s", ErrInvalidCommand, err.Error())
 	}
+	return req, nil
+}
+
+// CommandFromRequest converts the request to the registered command.
+func CommandFromRequest(registry *Registry, req CommandRequest) (ICommand, error) {
 	if err := lib.Validate(req); err != nil {
 		return nil, fmt.Errorf("%w %s", ErrInvalidCommand, err.Error())
 	}
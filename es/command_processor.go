@@ -2,6 +2,7 @@ package es
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"reflect"
@@ -22,12 +23,95 @@ type CommandProcessor interface {
 
 var _ CommandProcessor = (*commandProcessor)(nil)
 
+// DefaultMaxAttempts is the number of times a command is attempted before it
+// is moved to failure.
+const DefaultMaxAttempts = 5
+
+// DefaultRetryBackoff and DefaultMaxRetryBackoff bound the delay before the
+// next attempt of a failed command, see WithRetryBackoff.
+const (
+	DefaultRetryBackoff    = time.Second
+	DefaultMaxRetryBackoff = time.Minute
+)
+
 type commandProcessor struct {
-	store     EventStore
-	reg       *Registry
-	workerNum int
-	domain    string
-	log       logging.Logger
+	store       EventStore
+	reg         *Registry
+	workerNum   int
+	domain      string
+	snapshotter *Snapshotter
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	wakeup      Wakeup
+	leaseTTL    time.Duration
+	leases      *partitionLeases
+	log         logging.Logger
+}
+
+// ProcessorOption configures the command processor.
+type ProcessorOption func(*commandProcessor) error
+
+// WithSnapshotter makes the command processor load aggregates from snapshots.
+// The aggregate of a command is snapshotted once the events of the command are
+// stored, the events are applied to the aggregate the handler loaded, so the
+// handlers must change the aggregates only through the events.
+func WithSnapshotter(snapshotter *Snapshotter) ProcessorOption {
+	return func(c *commandProcessor) error {
+		c.snapshotter = snapshotter
+		return nil
+	}
+}
+
+// WithMaxAttempts sets the number of times a command is attempted before it
+// is moved to failure.
+func WithMaxAttempts(attempts int) ProcessorOption {
+	return func(c *commandProcessor) error {
+		if attempts <= 0 {
+			return errors.New("max attempts must be positive")
+		}
+		c.maxAttempts = attempts
+		return nil
+	}
+}
+
+// WithRetryBackoff sets the delay before the second attempt of a failed
+// command. It doubles with every attempt up to max. A zero delay retries the
+// command right away.
+func WithRetryBackoff(delay, max time.Duration) ProcessorOption {
+	return func(c *commandProcessor) error {
+		if delay < 0 || max < delay {
+			return errors.New("retry backoff must not be negative or greater than its max")
+		}
+		c.backoff, c.maxBackoff = delay, max
+		return nil
+	}
+}
+
+// WithProcessorWakeup sets when the command processor looks for new commands.
+// By default the event store is used as the trigger if it implements Trigger.
+func WithProcessorWakeup(wakeup Wakeup) ProcessorOption {
+	return func(c *commandProcessor) error {
+		if err := wakeup.validate(); err != nil {
+			return err
+		}
+		c.wakeup = wakeup
+		return nil
+	}
+}
+
+// WithProcessorLease sets the ttl of the leases that spread the partitions
+// of the command processor over the running instances. All the instances
+// must use the same number of workers. A ttl of 0 disables the leases,
+// which is only safe when a single instance processes the domain.
+func WithProcessorLease(ttl time.Duration) ProcessorOption {
+	return func(c *commandProcessor) error {
+		if ttl < 0 {
+			return errors.New("lease ttl cannot be negative")
+		}
+		c.leaseTTL = ttl
+		return nil
+	}
 }
 
 func NewCommandProcessor(
@@ -35,74 +119,134 @@ func NewCommandProcessor(
 	store EventStore,
 	registry *Registry,
 	domain string,
+	options ...ProcessorOption,
 ) (CommandProcessor, error) {
 	var ans commandProcessor
 	ans.workerNum = workerNum
 	ans.store = store
 	ans.reg = registry
 	ans.domain = domain
+	ans.maxAttempts = DefaultMaxAttempts
+	ans.backoff = DefaultRetryBackoff
+	ans.maxBackoff = DefaultMaxRetryBackoff
+	ans.wakeup = defaultWakeup(store)
+	ans.leaseTTL = DefaultLeaseTTL
 	ans.log = logging.Get().With("component", "command_processor")
+	for _, opt := range options {
+		if err := opt(&ans); err != nil {
+			return nil, err
+		}
+	}
+	if ans.leaseTTL > 0 {
+		ans.leases = newPartitionLeases(store, domain, workerNum, ans.leaseTTL, ans.log)
+	}
 	return &ans, nil
 }
 
 func (c *commandProcessor) Start(ctx context.Context) error {
 	c.log.Info("starting command processor")
 	defer c.log.Info("command processor stopped")
-	ticker := time.NewTicker(300 * time.Millisecond)
-	defer ticker.Stop()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wake, err := newPoller(ctx, c.wakeup, CommandsChannel)
+	if err != nil {
+		c.log.Warn("cannot subscribe to trigger, polling only", "error", err)
+	}
+	if c.leases != nil {
+		defer c.leases.release()
+	}
 	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-ticker.C:
-			_, err := c.work(ctx, 100)
-			if err != nil {
-				c.log.Error("failed to process commands", "error", err)
+		var partitions []int
+		if c.leases != nil {
+			if partitions = c.leases.hold(ctx); len(partitions) == 0 {
+				if !wake.wait(ctx, false) {
+					return nil
+				}
+				continue
 			}
 		}
+		num, err := c.work(ctx, 100, partitions)
+		if err != nil {
+			c.log.Error("failed to process commands", "error", err)
+		}
+		if !wake.wait(ctx, num > 0) {
+			return nil
+		}
 	}
 }
 
 func (c *commandProcessor) Load(ctx context.Context, aggregateID string, aggregate AggregateRoot) error {
-	records, err := c.store.LoadEvents(ctx, aggregateID)
+	return LoadAggregate(ctx, c.store, c.reg, c.snapshotter, aggregateID, aggregate)
+}
+
+// commandLoader loads the aggregates for the handler of a command and keeps
+// the aggregate of the command, which is snapshotted after its events are stored.
+type commandLoader struct {
+	*commandProcessor
+	aggregateID string
+	agg         AggregateRoot
+	// restored is the version of the snapshot the aggregate was restored from
+	restored int
+}
+
+func (l *commandLoader) Load(ctx context.Context, aggregateID string, aggregate AggregateRoot) error {
+	restored, err := loadAggregate(ctx, l.store, l.reg, l.snapshotter, aggregateID, aggregate)
 	if err != nil {
 		return err
 	}
-	events := make([]IEvent, len(records))
-	for i := range records {
-		convFn, ok := c.reg.GetEvent(records[i].EventType)
-		if !ok {
-			return err
-		}
-		events[i], err = convFn(records[i].Data)
-	}
-	if err := Load(aggregate, events); err != nil {
-		return err
+	if aggregateID == l.aggregateID {
+		l.agg, l.restored = aggregate, restored
 	}
 	return nil
 }
 
-func (c *commandProcessor) work(ctx context.Context, limit int) (int, error) {
+// snapshot applies the stored events to the aggregate of the command and
+// takes a snapshot when it crossed a snapshot boundary since the snapshot it
+// was restored from. A failed snapshot is only logged, the events are stored.
+func (c *commandProcessor) snapshot(ctx context.Context, loader *commandLoader, events []IEvent) {
+	if c.snapshotter == nil || loader.agg == nil {
+		return
+	}
+	if err := Load(loader.agg, events); err != nil {
+		c.log.Error("failed to apply the events to take a snapshot", "aggregate_id", loader.aggregateID, "error", err)
+		return
+	}
+	if !c.snapshotter.ShouldSnapshot(loader.restored, int(loader.agg.GetVersion())) {
+		return
+	}
+	if err := c.snapshotter.Take(ctx, loader.aggregateID, loader.agg); err != nil {
+		c.log.Error("failed to take snapshot", "aggregate_id", loader.aggregateID, "error", err)
+	}
+}
+
+// work processes the pending commands of the partitions, or of all the
+// partitions when none is given.
+func (c *commandProcessor) work(ctx context.Context, limit int, partitions []int) (int, error) {
 	t0 := time.Now()
-	items, err := c.store.SelectForProcessing(ctx, c.workerNum, limit)
+	// the processor serves all the tenants
+	items, err := c.store.SelectForProcessing(ContextWithSystemScope(ctx), c.workerNum, limit, partitions...)
 	if err != nil {
 		return 0, fmt.Errorf("%w when selecting commands", err)
 	}
 	t1 := time.Now()
 	g, ctx := errgroup.WithContext(ctx)
-	total := 0
+	done := make([]int, len(items))
 	for i := 0; i < len(items); i++ {
-		total += len(items[i])
 		if len(items[i]) > 0 {
 			num := i
 			g.Go(func() error {
-				return c.processGroup(ctx, items[num])
+				done[num] = c.processGroup(ctx, items[num])
+				return nil
 			})
 		}
 	}
 	if err := g.Wait(); err != nil {
 		return 0, fmt.Errorf("%w when processing commands", err)
 	}
+	total := 0
+	for i := range done {
+		total += done[i]
+	}
 	t2 := time.Now()
 	speed := float64(total) / t2.Sub(t0).Seconds()
 	if total > 0 {
@@ -118,32 +262,83 @@ func (c *commandProcessor) work(ctx context.Context, limit int) (int, error) {
 	return total, nil
 }
 
-func (c *commandProcessor) processGroup(ctx context.Context, items []CommandRecord) error {
+// processGroup processes the commands of a group in order.
+// It stops at the first command that has to be retried, so the commands
+// of the same aggregate are never reordered.
+// It returns the number of commands that are done.
+func (c *commandProcessor) processGroup(ctx context.Context, items []CommandRecord) int {
 	for i := 0; i < len(items); i++ {
 		select {
 		case <-ctx.Done():
-			return nil
+			return i
 		default:
 		}
 		if err := c.process(ctx, items[i]); err != nil {
-			return err
+			c.log.With(items[i].Correlation().LogArgs()...).Error("failed to process command, will retry",
+				"command_id", items[i].ID, "error", err)
+			return i
 		}
 	}
-	return nil
+	return len(items)
+}
+
+// process runs a single attempt of the command and records its outcome.
+// It returns an error when the command has to be retried.
+func (c *commandProcessor) process(ctx context.Context, rec CommandRecord) error {
+	// the command is handled in the scope of its tenant
+	ctx = ContextWithTenant(ctx, rec.Tenant)
+	attempts, err := c.store.MarkCommandRunning(ctx, rec.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// cancelled after it was selected
+		c.log.With(rec.Correlation().LogArgs()...).Info("command is not pending anymore", "command_id", rec.ID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w when marking command as running", err)
+	}
+	err = c.handle(ctx, rec)
+	if err == nil {
+		return nil
+	}
+	final := errors.Is(err, ErrSkipEvent) || attempts >= c.maxAttempts
+	var retryAt time.Time
+	if !final && c.backoff > 0 {
+		retryAt = time.Now().UTC().Add(c.retryDelay(attempts))
+	}
+	if ferr := c.store.MarkCommandFailed(ctx, rec.ID, err.Error(), final, retryAt); ferr != nil {
+		return fmt.Errorf("%w when marking command as failed: %s", ferr, err)
+	}
+	if final {
+		c.log.With(rec.Correlation().LogArgs()...).Error("command failed", "command_id", rec.ID, "attempts", attempts, "error", err)
+		return nil
+	}
+	return err
+}
+
+// retryDelay returns the delay before the next attempt of a command that
+// failed the given number of attempts.
+func (c *commandProcessor) retryDelay(attempts int) time.Duration {
+	delay := c.backoff
+	for i := 1; i < attempts && delay < c.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > c.maxBackoff {
+		delay = c.maxBackoff
+	}
+	return delay
 }
 
-func (c *commandProcessor) process(ctx context.Context, rec CommandRecord) (err error) {
+func (c *commandProcessor) handle(ctx context.Context, rec CommandRecord) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			var ok bool
 			err, ok = r.(error)
 			if !ok {
-				err = errors.New("unknown error")
+				err = fmt.Errorf("panic: %v", r)
 			}
 		}
 	}()
-	convFn, ok := c.reg.GetCommand(rec.EventType)
-	if !ok {
+	if _, ok := c.reg.GetCommand(rec.EventType); !ok {
 		err = fmt.Errorf("no converter for event type %s %w", rec.EventType, ErrSkipEvent)
 		return
 	}
@@ -153,20 +348,24 @@ func (c *commandProcessor) process(ctx context.Context, rec CommandRecord) (err
 		return
 	}
 	var cmd ICommand
-	cmd, err = convFn(rec.Data)
+	cmd, err = CommandRecordToCommand(c.reg, rec)
 	if err != nil {
-		err = fmt.Errorf("rec: %s %w", rec.EventType, err)
+		err = fmt.Errorf("rec: %s %s %w", rec.EventType, err, ErrSkipEvent)
 		return
 	}
 
-	cmd.SetID(rec.ID)
-	cmd.SetEventType(rec.EventType)
-	cmd.SetAggregateID(rec.AggregateID)
-	cmd.SetAggregateHash()
+	// the commands that the handler saves or dispatches are caused by this one
+	// and inherit its metadata
+	caused := CausedBy(rec.ID, rec.CorrelationID)
+	ctx = ContextWithCorrelation(ctx, caused)
+	ctx = ContextWithMetadata(ctx, rec.Metadata)
 
 	var newEvents []IEvent
-	newEvents, err = cmd.Handle(ctx, c)
+	loader := &commandLoader{commandProcessor: c, aggregateID: rec.AggregateID}
+	newEvents, err = cmd.Handle(ctx, loader)
 	if err != nil {
+		// the aggregate does not change
+		loader.agg = nil
 		errorEvent := NewEventErrorFromError(err, expectedVersion, rec)
 		newEvents = nil
 		newEvents = append(newEvents, &errorEvent)
@@ -177,16 +376,40 @@ func (c *commandProcessor) process(ctx context.Context, rec CommandRecord) (err
 		newEvents[i].SetID(lib.MustNewULID())
 		newEvents[i].SetAggregateID(rec.AggregateID)
 		newEvents[i].SetEventType(reflect.TypeOf(newEvents[i]).Elem().Name())
-		newEvents[i].SetVersion(expectedVersion + i)
-		events[i], err = EventToEventRecord(newEvents[i])
+		// an event has the version of the aggregate after it is applied, the
+		// first event of an aggregate has version 1
+		newEvents[i].SetVersion(expectedVersion + i + 1)
+		newEvents[i].SetMetadata(rec.Metadata.Merge(newEvents[i].GetMetadata()))
+		events[i], err = c.encode(ctx, newEvents[i])
+		if errors.Is(err, ErrSubjectForgotten) {
+			// retrying cannot bring the key back
+			return fmt.Errorf("%s %w", err, ErrSkipEvent)
+		}
 		if err != nil {
 			return err
 		}
+		events[i].SchemaVersion = c.reg.EventSchemaVersion(events[i].EventType)
+		events[i].SetCorrelation(caused)
+		events[i].Tenant = rec.Tenant
 	}
 	err = c.store.StoreCommandResults(ctx, rec.ID, expectedVersion, events...)
 	if err != nil {
 		err = fmt.Errorf("%w when storing command results", err)
+		return
 	}
-
+	c.snapshot(ctx, loader, newEvents)
 	return
 }
+
+// encode encrypts the personal data of the event and encodes it with the
+// codec of the registry. The error events are always JSON, see CommandResult.Err.
+func (c *commandProcessor) encode(ctx context.Context, ev IEvent) (EventRecord, error) {
+	if _, ok := ev.(*EventError); ok {
+		return EventToEventRecord(ev)
+	}
+	ev, err := c.reg.EncryptEvent(ctx, ev)
+	if err != nil {
+		return EventRecord{}, err
+	}
+	return c.reg.EncodeEvent(ev)
+}
@@ -0,0 +1,76 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// CommandResult is the outcome of a command.
+type CommandResult struct {
+	Command CommandRecord
+	// Events are the events the command produced.
+	// A command rejected by the domain produces a single EventError.
+	Events []EventRecord
+}
+
+// Done reports whether the command reached a terminal status.
+func (r CommandResult) Done() bool {
+	switch r.Command.Status {
+	case CommandStatusFinished, CommandStatusFailure, CommandStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// Err returns ErrCommandRejected with the domain error when the command was
+// rejected, ErrCommandFailed when it failed to be processed and
+// ErrCommandCancelled when it was cancelled.
+func (r CommandResult) Err() error {
+	switch r.Command.Status {
+	case CommandStatusFailure:
+		return fmt.Errorf("%w: %s", ErrCommandFailed, r.Command.LastError)
+	case CommandStatusCancelled:
+		return ErrCommandCancelled
+	}
+	if len(r.Events) == 1 && r.Events[0].EventType == "EventError" {
+		var ev EventError
+		if err := json.Unmarshal(r.Events[0].Data, &ev); err != nil {
+			return fmt.Errorf("%w: %s", ErrCommandRejected, err)
+		}
+		return fmt.Errorf("%w: %s", ErrCommandRejected, ev.Err)
+	}
+	return nil
+}
+
+// WaitForCommand blocks until the command finishes, fails or is cancelled and
+// returns its result. When ctx is done first it returns the current state of
+// the command together with the error of ctx.
+func WaitForCommand(ctx context.Context, store EventStore, commandID string) (CommandResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wakeup := defaultWakeup(store)
+	wakeup.MinInterval = 10 * time.Millisecond
+	// a failed subscription only means waiting by polling
+	wake, _ := newPoller(ctx, wakeup, CommandResultsChannel)
+	for {
+		var ans CommandResult
+		cmd, err := store.GetCommand(ctx, commandID)
+		if err != nil {
+			return ans, err
+		}
+		ans.Command = cmd
+		if ans.Done() {
+			if cmd.Status == CommandStatusFinished {
+				if ans.Events, err = store.LoadCommandEvents(ctx, commandID); err != nil {
+					return ans, err
+				}
+			}
+			return ans, nil
+		}
+		if !wake.wait(ctx, false) {
+			return ans, ctx.Err()
+		}
+	}
+}
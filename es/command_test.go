@@ -153,7 +153,7 @@ func TestCommandToCommandRecord(t *testing.T) {
 
 		params := cr.Bind()
 		require.IsType(t, []any{}, params)
-		require.Len(t, params, 7)
+		require.Len(t, params, 17)
 		require.Equal(t, &cr.ID, params[0])
 		require.Equal(t, &cr.AggregateID, params[1])
 		require.Equal(t, &cr.EventType, params[2])
@@ -161,6 +161,16 @@ func TestCommandToCommandRecord(t *testing.T) {
 		require.Equal(t, &cr.CreatedAt, params[4])
 		require.Equal(t, &cr.AggregateHash, params[5])
 		require.Equal(t, &cr.Status, params[6])
+		require.Equal(t, &cr.Attempts, params[7])
+		require.Equal(t, &cr.LastError, params[8])
+		require.Equal(t, &cr.ProcessedAt, params[9])
+		require.Equal(t, &cr.IdempotencyKey, params[10])
+		require.Equal(t, &cr.NotBefore, params[11])
+		require.Equal(t, &cr.CorrelationID, params[12])
+		require.Equal(t, &cr.CausationID, params[13])
+		require.Equal(t, &cr.Metadata, params[14])
+		require.Equal(t, &cr.Tenant, params[15])
+		require.Equal(t, &cr.Codec, params[16])
 	})
 	t.Run("Test with problematic Command", func(t *testing.T) {
 		cb := problematicCommand{}
@@ -0,0 +1,50 @@
+package es
+
+import (
+	"context"
+
+	"github.com/gosom/kit/lib"
+)
+
+// Correlation links commands and events to the flow they belong to.
+// The correlation ID is shared by all the records of a flow, e.g. it is the
+// ID of the HTTP request that started it. The causation ID is the ID of the
+// request, command or event that directly caused the record.
+type Correlation struct {
+	CorrelationID string
+	CausationID   string
+}
+
+// CausedBy returns the correlation of the records caused by the record with
+// the given ID and correlation ID. A record without a correlation ID starts
+// a new flow.
+func CausedBy(id string, correlationID string) Correlation {
+	if correlationID == "" {
+		correlationID = id
+	}
+	return Correlation{CorrelationID: correlationID, CausationID: id}
+}
+
+// LogArgs returns the correlation as logging key value pairs.
+func (c Correlation) LogArgs() []any {
+	return []any{"correlation_id", c.CorrelationID, "causation_id", c.CausationID}
+}
+
+type correlationKey struct{}
+
+// ContextWithCorrelation returns a context that carries the correlation.
+// The commands that are saved or dispatched with the context inherit it.
+func ContextWithCorrelation(ctx context.Context, c Correlation) context.Context {
+	return context.WithValue(ctx, correlationKey{}, c)
+}
+
+// CorrelationFromContext returns the correlation of ctx. Without one the
+// request ID of ctx, see lib.RequestIDFromContext, is both the correlation
+// and the causation ID.
+func CorrelationFromContext(ctx context.Context) Correlation {
+	if c, ok := ctx.Value(correlationKey{}).(Correlation); ok {
+		return c
+	}
+	id := lib.RequestIDFromContext(ctx)
+	return Correlation{CorrelationID: id, CausationID: id}
+}
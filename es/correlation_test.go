@@ -0,0 +1,25 @@
+package es_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gosom/kit/es"
+	"github.com/gosom/kit/lib"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCorrelationFromContext(t *testing.T) {
+	ctx := context.Background()
+	require.Equal(t, es.Correlation{}, es.CorrelationFromContext(ctx))
+
+	ctx = lib.NewContextWithRequestID(ctx, "request-1")
+	require.Equal(t, es.Correlation{CorrelationID: "request-1", CausationID: "request-1"}, es.CorrelationFromContext(ctx))
+
+	caused := es.CausedBy("command-1", "request-1")
+	require.Equal(t, es.Correlation{CorrelationID: "request-1", CausationID: "command-1"}, caused)
+	require.Equal(t, caused, es.CorrelationFromContext(es.ContextWithCorrelation(ctx, caused)))
+
+	// a record without correlation starts a new flow
+	require.Equal(t, es.Correlation{CorrelationID: "event-1", CausationID: "event-1"}, es.CausedBy("event-1", ""))
+}
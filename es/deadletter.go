@@ -0,0 +1,55 @@
+package es
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DeadLetter is an event that a subscription group failed to publish.
+type DeadLetter struct {
+	Group     string
+	Event     EventRecord
+	LastError string
+	CreatedAt time.Time
+}
+
+func (o *DeadLetter) Bind() []any {
+	ans := []any{&o.Group}
+	ans = append(ans, o.Event.Bind()...)
+	return append(ans, &o.LastError, &o.CreatedAt)
+}
+
+// ReplayDeadLetters publishes the dead-lettered events of the subscription group again.
+// When no event ids are given all the dead letters of the group are replayed.
+// Events that are published successfully are removed from the dead letters.
+// It returns the number of replayed events.
+func ReplayDeadLetters(ctx context.Context, store EventStore, publisher Publisher, group string, eventIDs ...string) (int, error) {
+	items, err := store.ListDeadLetters(ctx, group, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(eventIDs) > 0 {
+		byID := make(map[string]DeadLetter, len(items))
+		for i := range items {
+			byID[items[i].Event.ID] = items[i]
+		}
+		items = items[:0]
+		for _, id := range eventIDs {
+			item, ok := byID[id]
+			if !ok {
+				return 0, fmt.Errorf("event %s is not dead-lettered: %w", id, ErrDeadLetterNotFound)
+			}
+			items = append(items, item)
+		}
+	}
+	for i := range items {
+		if err := publisher.Publish(ctx, items[i].Event); err != nil {
+			return i, fmt.Errorf("%w when replaying event %s", err, items[i].Event.ID)
+		}
+		if err := store.DeleteDeadLetter(ctx, group, items[i].Event.ID); err != nil {
+			return i, err
+		}
+	}
+	return len(items), nil
+}
@@ -0,0 +1,375 @@
+package es
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// The values of the `es` struct tag of the event and command fields.
+const (
+	// TagPII marks a string field as personal data. It is encrypted with the
+	// data key of its subject, see Registry.SetKeyStore.
+	TagPII = "pii"
+	// TagSubject marks the string field that holds the subject of the
+	// personal data of the event or command. Without it the subject is the
+	// aggregate ID.
+	TagSubject = "subject"
+)
+
+// Redacted is the value of the personal data of forgotten subjects.
+const Redacted = "[redacted]"
+
+// encryptedPrefix marks the encrypted values.
+const encryptedPrefix = "es:pii:"
+
+// DataKeySize is the size of the data keys, they are AES-256 keys.
+const DataKeySize = 32
+
+// KeyStore holds the data keys that encrypt the personal data of the
+// subjects. Forgetting a subject destroys its key, which makes its personal
+// data unreadable everywhere, including in the immutable events.
+type KeyStore interface {
+	//GetOrCreateKey returns the data key of the subject, it creates the key with
+	// NewDataKey when the subject has none.
+	// It returns ErrSubjectForgotten when the subject is forgotten.
+	GetOrCreateKey(ctx context.Context, subject string) ([]byte, error)
+	//GetKey returns the data key of the subject.
+	// It returns ErrSubjectForgotten when the subject is forgotten and
+	// sql.ErrNoRows when it has no key.
+	GetKey(ctx context.Context, subject string) ([]byte, error)
+	//ForgetSubject destroys the data key of the subject, a forgotten subject never
+	// gets a new one. The snapshots hold decrypted state, the snapshots of the
+	// aggregate with the subject as ID and of the aggregates with events of the
+	// subject, see MetadataSubject, are deleted too.
+	ForgetSubject(ctx context.Context, subject string) error
+}
+
+// NewDataKey returns a new random data key.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, DataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// SetKeyStore enables the encryption of the personal data of the events.
+// Without a key store the fields tagged pii are stored as they are.
+func (r *Registry) SetKeyStore(store KeyStore) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.keys = store
+}
+
+func (r *Registry) keyStore() KeyStore {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.keys
+}
+
+// EncryptEvent returns a copy of the event with its personal data encrypted
+// and its subject in the MetadataSubject metadata. The event is returned as it
+// is when it has no personal data or the registry has no key store.
+func (r *Registry) EncryptEvent(ctx context.Context, ev IEvent) (IEvent, error) {
+	keys := r.keyStore()
+	if keys == nil {
+		return ev, nil
+	}
+	fields, err := piiFieldsOf(ev)
+	if err != nil || len(fields.pii) == 0 {
+		return ev, err
+	}
+	v := reflect.New(reflect.TypeOf(ev).Elem())
+	v.Elem().Set(reflect.ValueOf(ev).Elem())
+	subject := fields.subject(v.Elem(), ev.GetAggregateID())
+	if err := encrypt(ctx, keys, fields, v.Elem(), subject, "event "+ev.GetEventType()); err != nil {
+		return nil, err
+	}
+	ans := v.Interface().(IEvent)
+	// the snapshots built from the event are found by its subject when the
+	// subject is forgotten
+	ans.SetMetadata(ev.GetMetadata().Merge(Metadata{MetadataSubject: subject}))
+	return ans, nil
+}
+
+// EncryptCommandRecord returns the record with the personal data of its
+// command encrypted, in the tenant the record is stored for, which it sets on
+// the record. Encrypted fields are left as they are. The command
+// fields are tagged like those of the events. The record is returned as it
+// is when the command has no personal data or the registry has no key store.
+func (r *Registry) EncryptCommandRecord(ctx context.Context, rec CommandRecord) (CommandRecord, error) {
+	keys := r.keyStore()
+	if keys == nil {
+		return rec, nil
+	}
+	cmd, err := r.DecodeCommand(rec.Codec, rec.EventType, rec.Data)
+	if err != nil {
+		return rec, err
+	}
+	fields, err := piiFieldsOf(cmd)
+	if err != nil || len(fields.pii) == 0 {
+		return rec, err
+	}
+	tenant, err := ResolveTenant(ctx, rec.Tenant)
+	if err != nil {
+		return rec, err
+	}
+	v := reflect.ValueOf(cmd).Elem()
+	subject := fields.subject(v, rec.AggregateID)
+	if err := encrypt(ContextWithTenant(ctx, tenant), keys, fields, v, subject, "command "+rec.EventType); err != nil {
+		return rec, err
+	}
+	// the record is decrypted with the keys of its tenant
+	rec.Tenant = tenant
+	return r.reencodeCommand(rec, cmd)
+}
+
+// DecryptCommandRecord returns the record with the personal data of its
+// command decrypted, see CommandRecordToCommand.
+func (r *Registry) DecryptCommandRecord(rec CommandRecord) (CommandRecord, error) {
+	cmd, err := r.DecodeCommand(rec.Codec, rec.EventType, rec.Data)
+	if err != nil {
+		return rec, err
+	}
+	ok, err := r.decryptCommand(rec, cmd)
+	if err != nil || !ok {
+		return rec, err
+	}
+	return r.reencodeCommand(rec, cmd)
+}
+
+// DecryptEventRecords returns the records with the personal data of their
+// events decrypted, see EventRecordsToEvents. The decrypted events are
+// encoded again with the codec of their record at the current schema
+// version. Records without encrypted data or of events unknown to the
+// registry are returned as they are.
+func (r *Registry) DecryptEventRecords(records []EventRecord) ([]EventRecord, error) {
+	ans := make([]EventRecord, len(records))
+	cache := make(keyCache)
+	for i, rec := range records {
+		ans[i] = rec
+		if _, ok := r.GetEvent(rec.EventType); !ok || !bytes.Contains(rec.Data, []byte(encryptedPrefix)) {
+			continue
+		}
+		ev, err := eventRecordToEvent(r, rec, cache)
+		if err != nil {
+			return nil, err
+		}
+		codec, ok := r.GetCodec(rec.Codec)
+		if !ok {
+			return nil, fmt.Errorf("event %s codec %s: %w", rec.EventType, rec.Codec, ErrUnknownCodec)
+		}
+		if ans[i].Data, err = codec.Marshal(ev); err != nil {
+			return nil, err
+		}
+		ans[i].SchemaVersion = r.EventSchemaVersion(rec.EventType)
+	}
+	return ans, nil
+}
+
+// decryptCommand decrypts the personal data of the command of the record in
+// place. It reports whether the command has encrypted personal data.
+func (r *Registry) decryptCommand(rec CommandRecord, cmd ICommand) (bool, error) {
+	fields, err := piiFieldsOf(cmd)
+	if err != nil || len(fields.pii) == 0 {
+		return false, err
+	}
+	v := reflect.ValueOf(cmd).Elem()
+	// the keys belong to the tenant of the command
+	ctx := ContextWithTenant(context.Background(), rec.Tenant)
+	return r.decrypt(ctx, fields, v, fields.subject(v, rec.AggregateID), "command "+rec.EventType, make(keyCache))
+}
+
+// reencodeCommand returns the record with the command encoded again with
+// the codec of the record.
+func (r *Registry) reencodeCommand(rec CommandRecord, cmd ICommand) (CommandRecord, error) {
+	codec, ok := r.GetCodec(rec.Codec)
+	if !ok {
+		return rec, fmt.Errorf("command %s codec %s: %w", rec.EventType, rec.Codec, ErrUnknownCodec)
+	}
+	data, err := codec.Marshal(cmd)
+	if err != nil {
+		return rec, err
+	}
+	rec.Data = data
+	return rec, nil
+}
+
+// encrypt encrypts the personal data fields of v with the key of the subject.
+func encrypt(ctx context.Context, keys KeyStore, fields piiFields, v reflect.Value, subject string, name string) error {
+	if subject == "" {
+		return fmt.Errorf("%s has personal data without a subject", name)
+	}
+	key, err := keys.GetOrCreateKey(ctx, subject)
+	if err != nil {
+		return fmt.Errorf("%w when getting the key of subject %s", err, subject)
+	}
+	for _, i := range fields.pii {
+		field := v.Field(i)
+		if field.String() == "" || strings.HasPrefix(field.String(), encryptedPrefix) {
+			continue
+		}
+		sealed, err := seal(key, subject, field.String())
+		if err != nil {
+			return err
+		}
+		field.SetString(sealed)
+	}
+	return nil
+}
+
+// decryptEvent decrypts the personal data of the event in place. The
+// personal data of forgotten subjects is replaced by Redacted.
+func (r *Registry) decryptEvent(ctx context.Context, ev IEvent, cache keyCache) error {
+	fields, err := piiFieldsOf(ev)
+	if err != nil || len(fields.pii) == 0 {
+		return err
+	}
+	v := reflect.ValueOf(ev).Elem()
+	_, err = r.decrypt(ctx, fields, v, fields.subject(v, ev.GetAggregateID()), "event "+ev.GetEventType(), cache)
+	return err
+}
+
+// decrypt decrypts the personal data fields of v in place, those of
+// forgotten subjects are replaced by Redacted. It reports whether v has
+// encrypted fields.
+func (r *Registry) decrypt(ctx context.Context, fields piiFields, v reflect.Value, subject string, name string, cache keyCache) (bool, error) {
+	encrypted := false
+	for _, i := range fields.pii {
+		field := v.Field(i)
+		if !strings.HasPrefix(field.String(), encryptedPrefix) {
+			continue
+		}
+		encrypted = true
+		keys := r.keyStore()
+		if keys == nil {
+			return encrypted, fmt.Errorf("%s has encrypted personal data and there is no key store", name)
+		}
+		key, err := cache.get(ctx, keys, subject)
+		if err != nil {
+			return encrypted, err
+		}
+		if key == nil {
+			field.SetString(Redacted)
+			continue
+		}
+		plain, err := open(key, subject, field.String())
+		if err != nil {
+			return encrypted, fmt.Errorf("%w when decrypting field %s of %s", err, v.Type().Field(i).Name, name)
+		}
+		field.SetString(plain)
+	}
+	return encrypted, nil
+}
+
+// keyCache holds the data keys that decrypt a batch of records, so every
+// subject is read from the key store once. Forgotten subjects have a nil key.
+type keyCache map[string][]byte
+
+// get returns the data key of the subject in the tenant of ctx.
+func (o keyCache) get(ctx context.Context, keys KeyStore, subject string) ([]byte, error) {
+	name := TenantFromContext(ctx) + "/" + subject
+	if key, ok := o[name]; ok {
+		return key, nil
+	}
+	key, err := keys.GetKey(ctx, subject)
+	switch {
+	case errors.Is(err, ErrSubjectForgotten):
+		key = nil
+	case err != nil:
+		return nil, fmt.Errorf("%w when getting the key of subject %s", err, subject)
+	}
+	o[name] = key
+	return key, nil
+}
+
+// piiFields are the indexes of the tagged fields of an event or command struct.
+type piiFields struct {
+	pii          []int
+	subjectIndex int
+}
+
+// subject returns the subject of the record, the aggregate ID when it has no
+// subject field.
+func (o piiFields) subject(v reflect.Value, aggregateID string) string {
+	if o.subjectIndex < 0 {
+		return aggregateID
+	}
+	return v.Field(o.subjectIndex).String()
+}
+
+func piiFieldsOf(ev any) (piiFields, error) {
+	ans := piiFields{subjectIndex: -1}
+	t := reflect.TypeOf(ev)
+	if t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Struct {
+		return ans, nil
+	}
+	t = t.Elem()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("es")
+		if tag != TagPII && tag != TagSubject {
+			continue
+		}
+		if field.Type.Kind() != reflect.String || !field.IsExported() {
+			return ans, fmt.Errorf("field %s of %s tagged %s must be an exported string", field.Name, t.Name(), tag)
+		}
+		switch tag {
+		case TagPII:
+			ans.pii = append(ans.pii, i)
+		case TagSubject:
+			ans.subjectIndex = i
+		}
+	}
+	return ans, nil
+}
+
+// seal encrypts the value with AES-GCM, the subject is authenticated with it.
+func seal(key []byte, subject string, value string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(subject))
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func open(key []byte, subject string, value string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted value is too short")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(subject))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,246 @@
+package es_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gosom/kit/es"
+	"github.com/gosom/kit/es/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type registerCustomer struct {
+	es.CommandBase
+	ID    string `json:"id" aggregateID:"true" validate:"required" es:"subject"`
+	Email string `json:"email" validate:"required" es:"pii"`
+}
+
+func (c *registerCustomer) Handle(ctx context.Context, h es.AggregateLoader) ([]es.IEvent, error) {
+	return []es.IEvent{&customerRegistered{CustomerID: c.ID, Email: c.Email, Plan: "free"}}, nil
+}
+
+type customerRegistered struct {
+	es.EventBase
+	CustomerID string `json:"customer_id" es:"subject"`
+	Email      string `json:"email" es:"pii"`
+	Plan       string `json:"plan"`
+}
+
+type addressChanged struct {
+	es.EventBase
+	Address string `json:"address" es:"pii"`
+}
+
+func TestEncryption(t *testing.T) {
+	ctx := context.Background()
+	store := mock.NewEventStore()
+	reg := es.NewRegistry()
+	require.NoError(t, es.RegisterEvent[customerRegistered](reg))
+	require.NoError(t, es.RegisterEvent[addressChanged](reg))
+
+	encode := func(ev es.IEvent) es.EventRecord {
+		ev, err := reg.EncryptEvent(ctx, ev)
+		require.NoError(t, err)
+		rec, err := reg.EncodeEvent(ev)
+		require.NoError(t, err)
+		return rec
+	}
+	decode := func(rec es.EventRecord) es.IEvent {
+		ev, err := es.EventRecordToEvent(reg, rec)
+		require.NoError(t, err)
+		return ev
+	}
+	registered := &customerRegistered{CustomerID: "1", Email: "alice@example.com", Plan: "free"}
+	registered.SetEventType("customerRegistered")
+	registered.SetAggregateID("customer-1")
+
+	// without a key store the personal data is stored as it is
+	rec := encode(registered)
+	require.Contains(t, string(rec.Data), "alice@example.com")
+
+	reg.SetKeyStore(store)
+	rec = encode(registered)
+	require.NotContains(t, string(rec.Data), "alice@example.com")
+	require.Equal(t, "1", rec.Metadata[es.MetadataSubject])
+	require.Equal(t, "alice@example.com", registered.Email, "the event is not modified")
+	require.Equal(t, "alice@example.com", decode(rec).(*customerRegistered).Email)
+
+	// without a subject field the subject is the aggregate ID
+	moved := &addressChanged{Address: "1 Main St"}
+	moved.SetEventType("addressChanged")
+	moved.SetAggregateID("customer-1")
+	movedRec := encode(moved)
+	_, err := store.GetKey(ctx, "customer-1")
+	require.NoError(t, err)
+
+	require.NoError(t, store.ForgetSubject(ctx, "1"))
+	ev := decode(rec).(*customerRegistered)
+	require.Equal(t, es.Redacted, ev.Email)
+	require.Equal(t, "free", ev.Plan)
+	require.Equal(t, "1", ev.CustomerID)
+	require.Equal(t, "1 Main St", decode(movedRec).(*addressChanged).Address)
+	_, err = reg.EncryptEvent(ctx, registered)
+	require.ErrorIs(t, err, es.ErrSubjectForgotten)
+
+	// the ciphertext is bound to its subject
+	other := &customerRegistered{CustomerID: "2", Email: "bob@example.com"}
+	other.SetEventType("customerRegistered")
+	other.SetAggregateID("customer-2")
+	otherRec := encode(other)
+	var payload map[string]any
+	require.NoError(t, json.Unmarshal(otherRec.Data, &payload))
+	payload["customer_id"] = "3"
+	otherRec.Data, err = json.Marshal(payload)
+	require.NoError(t, err)
+	_, err = store.GetOrCreateKey(ctx, "3")
+	require.NoError(t, err)
+	_, err = es.EventRecordToEvent(reg, otherRec)
+	require.Error(t, err)
+}
+
+func TestCommandProcessorEncryption(t *testing.T) {
+	store := mock.NewEventStore()
+	registry := es.NewRegistry()
+	require.NoError(t, es.RegisterCommand[registerCustomer](registry))
+	require.NoError(t, es.RegisterEvent[customerRegistered](registry))
+	registry.SetKeyStore(store)
+	processor, err := es.NewCommandProcessor(1, store, registry, "customer")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- processor.Start(ctx)
+	}()
+	defer func() {
+		cancel()
+		require.NoError(t, <-done)
+	}()
+	encode := func(id string) es.CommandRecord {
+		rec, err := registry.EncodeCommand("customer", &registerCustomer{ID: id, Email: "alice@example.com"})
+		require.NoError(t, err)
+		return rec
+	}
+	send := func(rec es.CommandRecord) es.CommandResult {
+		_, err := store.SaveCommandRecords(ctx, rec)
+		require.NoError(t, err)
+		result, err := es.WaitForCommand(ctx, store, rec.ID)
+		require.NoError(t, err)
+		return result
+	}
+
+	rec, err := registry.EncryptCommandRecord(ctx, encode("1"))
+	require.NoError(t, err)
+	require.NotContains(t, string(rec.Data), "alice@example.com")
+	result := send(rec)
+	require.NoError(t, result.Err())
+	require.NotContains(t, string(result.Command.Data), "alice@example.com")
+	decrypted, err := registry.DecryptCommandRecord(result.Command)
+	require.NoError(t, err)
+	require.Contains(t, string(decrypted.Data), "alice@example.com")
+	cmd, err := es.CommandRecordToCommand(registry, result.Command)
+	require.NoError(t, err)
+	require.Equal(t, "alice@example.com", cmd.(*registerCustomer).Email)
+	require.Len(t, result.Events, 1)
+	require.NotContains(t, string(result.Events[0].Data), "alice@example.com")
+	ev, err := es.EventRecordToEvent(registry, result.Events[0])
+	require.NoError(t, err)
+	require.Equal(t, "alice@example.com", ev.(*customerRegistered).Email)
+
+	require.NoError(t, store.ForgetSubject(ctx, "1"))
+	ev, err = es.EventRecordToEvent(registry, result.Events[0])
+	require.NoError(t, err)
+	require.Equal(t, es.Redacted, ev.(*customerRegistered).Email)
+	cmd, err = es.CommandRecordToCommand(registry, result.Command)
+	require.NoError(t, err)
+	require.Equal(t, es.Redacted, cmd.(*registerCustomer).Email)
+
+	// the personal data of a forgotten subject cannot be stored again
+	_, err = registry.EncryptCommandRecord(ctx, encode("1"))
+	require.ErrorIs(t, err, es.ErrSubjectForgotten)
+	result = send(encode("1"))
+	require.ErrorIs(t, result.Err(), es.ErrCommandFailed)
+	require.Contains(t, result.Command.LastError, es.ErrSubjectForgotten.Error())
+}
+
+// countingKeys counts the reads of the data keys.
+type countingKeys struct {
+	es.KeyStore
+	reads int
+}
+
+func (o *countingKeys) GetKey(ctx context.Context, subject string) ([]byte, error) {
+	o.reads++
+	return o.KeyStore.GetKey(ctx, subject)
+}
+
+func TestEventRecordsToEventsKeys(t *testing.T) {
+	ctx := context.Background()
+	keys := &countingKeys{KeyStore: mock.NewEventStore()}
+	reg := es.NewRegistry()
+	require.NoError(t, es.RegisterEvent[addressChanged](reg))
+	reg.SetKeyStore(keys)
+
+	var records []es.EventRecord
+	for _, aggregateID := range []string{"customer-1", "customer-2", "customer-1", "customer-1"} {
+		ev := &addressChanged{Address: "1 Main St"}
+		ev.SetEventType("addressChanged")
+		ev.SetAggregateID(aggregateID)
+		encrypted, err := reg.EncryptEvent(ctx, ev)
+		require.NoError(t, err)
+		rec, err := reg.EncodeEvent(encrypted)
+		require.NoError(t, err)
+		records = append(records, rec)
+	}
+	events, err := es.EventRecordsToEvents(reg, records)
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+	require.Equal(t, "1 Main St", events[2].(*addressChanged).Address)
+	require.Equal(t, 2, keys.reads, "every subject is read once")
+
+	require.NoError(t, keys.ForgetSubject(ctx, "customer-1"))
+	keys.reads = 0
+	events, err = es.EventRecordsToEvents(reg, records)
+	require.NoError(t, err)
+	require.Equal(t, es.Redacted, events[3].(*addressChanged).Address)
+	require.Equal(t, "1 Main St", events[1].(*addressChanged).Address)
+	require.Equal(t, 2, keys.reads)
+}
+
+func TestDecryptEventRecords(t *testing.T) {
+	ctx := context.Background()
+	keys := mock.NewEventStore()
+	reg := es.NewRegistry()
+	require.NoError(t, es.RegisterEvent[addressChanged](reg))
+	reg.SetKeyStore(keys)
+
+	ev := &addressChanged{Address: "1 Main St"}
+	ev.SetEventType("addressChanged")
+	ev.SetAggregateID("customer-1")
+	encrypted, err := reg.EncryptEvent(ctx, ev)
+	require.NoError(t, err)
+	rec, err := reg.EncodeEvent(encrypted)
+	require.NoError(t, err)
+	unknown := es.EventRecord{Codec: es.CodecJSON}
+	unknown.EventType = "unknown"
+	unknown.Data = []byte(`{"address":"es:pii:abc"}`)
+
+	records, err := reg.DecryptEventRecords([]es.EventRecord{rec, unknown})
+	require.NoError(t, err)
+	require.JSONEq(t, `"1 Main St"`, jsonField(t, records[0].Data, "address"))
+	require.Equal(t, unknown, records[1], "unknown events are returned as they are")
+	require.Contains(t, string(rec.Data), "es:pii:", "the records are not changed")
+
+	require.NoError(t, keys.ForgetSubject(ctx, "customer-1"))
+	records, err = reg.DecryptEventRecords([]es.EventRecord{rec})
+	require.NoError(t, err)
+	require.JSONEq(t, `"`+es.Redacted+`"`, jsonField(t, records[0].Data, "address"))
+}
+
+func jsonField(t *testing.T, data []byte, name string) string {
+	var m map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(data, &m))
+	return string(m[name])
+}
@@ -17,11 +17,31 @@ var (
 	ErrInvalidEvent      = errors.New("invalid event")
 	ErrDuplicateEvent    = errors.New("duplicate event")
 	ErrUnregisteredEvent = errors.New("unregistered event")
+	ErrAlreadyRegistered = errors.New("already registered")
+
+	ErrUnknownSchemaVersion = errors.New("unknown schema version")
+	ErrUnknownCodec         = errors.New("unknown codec")
 
 	ErrSkipEvent        = errors.New("skip event")
 	ErrInvalidAggregate = errors.New("invalid aggregate")
 
 	ErrNilAggregate = errors.New("nil aggregate")
+
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+	ErrCommandRejected   = errors.New("command rejected")
+	ErrCommandFailed     = errors.New("command failed")
+	ErrCommandCancelled  = errors.New("command cancelled")
+	ErrCommandNotPending = errors.New("command is not pending")
+
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+	ErrSubscriptionChanged  = errors.New("subscription changed")
+
+	ErrTenantMismatch = errors.New("tenant mismatch")
+
+	ErrSubjectForgotten = errors.New("subject forgotten")
 )
 
 type EventError struct {
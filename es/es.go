@@ -13,6 +13,8 @@ type ICommandEvent interface {
 	SetAggregateID(aggregateID string)
 	GetEventType() string
 	SetEventType(eventType string)
+	GetMetadata() Metadata
+	SetMetadata(md Metadata)
 	Validate() error
 }
 
@@ -58,6 +60,7 @@ type CommandEventBase struct {
 	id          string
 	aggregateID string
 	eventType   string
+	metadata    Metadata
 }
 
 func (c *CommandEventBase) GetID() string {
@@ -84,6 +87,14 @@ func (c *CommandEventBase) SetEventType(eventType string) {
 	c.eventType = eventType
 }
 
+func (c *CommandEventBase) GetMetadata() Metadata {
+	return c.metadata
+}
+
+func (c *CommandEventBase) SetMetadata(md Metadata) {
+	c.metadata = md
+}
+
 func (c *CommandEventBase) Validate() error {
 	panic("not implemented")
 }
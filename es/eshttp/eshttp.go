@@ -1,48 +1,123 @@
 package eshttp
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gosom/kit/es"
 	"github.com/gosom/kit/lib"
+	"github.com/gosom/kit/logging"
 	"github.com/gosom/kit/web"
 )
 
-func RegisterDomainRoutes(domain string, mux web.Router, store es.EventStore, registry *es.Registry, aggFactory es.AggregateFactory) {
-	handler := NewDomainHandler(domain, store, registry, aggFactory)
+// RegisterDomainRoutes registers the routes of the domain. They serve the
+// tenant of the request, see es.TenantFromContext. The commands and events
+// are served with their personal data decrypted, the personal data of
+// forgotten subjects is es.Redacted.
+func RegisterDomainRoutes(domain string, mux web.Router, store es.EventStore, registry *es.Registry, aggFactory es.AggregateFactory, options ...DomainHandlerOption) {
+	handler := NewDomainHandler(domain, store, registry, aggFactory, options...)
 	mux.MethodFunc(http.MethodGet, fmt.Sprintf("/%s/commands/{commandId}", handler.domain), handler.GetCommand)
+	mux.MethodFunc(http.MethodDelete, fmt.Sprintf("/%s/commands/{commandId}", handler.domain), handler.CancelCommand)
 	mux.MethodFunc(http.MethodPost, fmt.Sprintf("/%s/commands", handler.domain), handler.PostCommand)
+	mux.MethodFunc(http.MethodGet, fmt.Sprintf("/%s/events", handler.domain), handler.GetDomainEvents)
 	mux.MethodFunc(http.MethodGet, fmt.Sprintf("/%s/events/{aggregateId}", handler.domain), handler.GetEvents)
 	mux.MethodFunc(http.MethodGet, fmt.Sprintf("/%s/aggregates/{aggregateId}", handler.domain), handler.GetAggregate)
+	mux.MethodFunc(http.MethodGet, fmt.Sprintf("/%s/aggregates/{aggregateId}/diff", handler.domain), handler.GetAggregateDiff)
 }
 
 type DomainHandler struct {
-	domain     string
-	store      es.EventStore
-	registry   *es.Registry
-	aggFactory es.AggregateFactory
+	domain      string
+	store       es.EventStore
+	registry    *es.Registry
+	aggFactory  es.AggregateFactory
+	snapshotter *es.Snapshotter
+	maxWait     time.Duration
 }
 
-func NewDomainHandler(domain string, store es.EventStore, registry *es.Registry, aggFactory es.AggregateFactory) *DomainHandler {
-	return &DomainHandler{
+// DomainHandlerOption configures the domain handler.
+type DomainHandlerOption func(*DomainHandler)
+
+// WithSnapshotter makes the handler load aggregates from snapshots, which the
+// command processor takes.
+func WithSnapshotter(snapshotter *es.Snapshotter) DomainHandlerOption {
+	return func(a *DomainHandler) {
+		a.snapshotter = snapshotter
+	}
+}
+
+// DefaultMaxWait is the longest a client can wait for the result of a command.
+const DefaultMaxWait = 30 * time.Second
+
+// WithMaxWait sets the longest a client can wait for the result of a command.
+func WithMaxWait(maxWait time.Duration) DomainHandlerOption {
+	return func(a *DomainHandler) {
+		a.maxWait = maxWait
+	}
+}
+
+func NewDomainHandler(domain string, store es.EventStore, registry *es.Registry, aggFactory es.AggregateFactory, options ...DomainHandlerOption) *DomainHandler {
+	ans := DomainHandler{
 		domain:     domain,
 		store:      store,
 		registry:   registry,
 		aggFactory: aggFactory,
+		maxWait:    DefaultMaxWait,
 	}
+	for _, opt := range options {
+		opt(&ans)
+	}
+	return &ans
 }
 
 type PostCommandResponse struct {
-	ID string `json:"id"`
+	ID            string `json:"id"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// The fields below are set when the client waits for the result.
+	Status string             `json:"status,omitempty"`
+	Events []GetEventResponse `json:"events,omitempty"`
+	Error  string             `json:"error,omitempty"`
 }
 
+// PostCommand saves the command. With the wait query parameter, e.g. ?wait=5s,
+// it waits for the command to finish and responds with its events, or with
+// 422 when the domain rejected it. If the command does not finish in time it
+// responds with 202.
+// A request with an idempotency key, in the Idempotency-Key header or in the
+// body, that was already used in the domain responds with the original command.
+// Commands with not_before are scheduled, they are processed once they are due.
 func (a *DomainHandler) PostCommand(w http.ResponseWriter, r *http.Request) {
-	command, err := es.ParseCommandRequest(a.registry, io.Reader(r.Body))
+	var wait time.Duration
+	if v := r.URL.Query().Get("wait"); v != "" {
+		var err error
+		wait, err = time.ParseDuration(v)
+		if err != nil || wait < 0 {
+			web.JSONError(w, r, lib.ErrBadRequest)
+			return
+		}
+		if wait > a.maxWait {
+			wait = a.maxWait
+		}
+	}
+	req, err := es.DecodeCommandRequest(io.Reader(r.Body))
+	if err != nil {
+		web.JSONError(w, r, lib.ErrBadRequest)
+		return
+	}
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		if req.IdempotencyKey != "" && req.IdempotencyKey != key {
+			web.JSONError(w, r, lib.ErrBadRequest)
+			return
+		}
+		req.IdempotencyKey = key
+	}
+	command, err := es.CommandFromRequest(a.registry, req)
 	if err != nil {
 		if errors.Is(err, es.ErrInvalidCommand) {
 			web.JSONError(w, r, lib.ErrBadRequest)
@@ -51,11 +126,25 @@ func (a *DomainHandler) PostCommand(w http.ResponseWriter, r *http.Request) {
 		web.JSONError(w, r, err)
 		return
 	}
-	cr, err := es.CommandToCommandRecord(a.domain, command)
+	cr, err := a.registry.EncodeCommand(a.domain, command)
 	if err != nil {
 		web.JSONError(w, r, err)
 		return
 	}
+	cr.IdempotencyKey = req.IdempotencyKey
+	cr.NotBefore = req.NotBefore
+	cr.SetCorrelation(es.CorrelationFromContext(r.Context()))
+	cr.Metadata = es.MetadataFromContext(r.Context()).Merge(cr.Metadata)
+	cr.Tenant = es.TenantFromContext(r.Context())
+	cr, err = a.registry.EncryptCommandRecord(r.Context(), cr)
+	if err != nil {
+		if errors.Is(err, es.ErrSubjectForgotten) {
+			web.JSONError(w, r, lib.ErrUnprocessable)
+			return
+		}
+		web.JSONError(w, r, err)
+		return
+	}
 	commandID, err := a.store.SaveCommandRecords(r.Context(), cr)
 	if err != nil {
 		web.JSONError(w, r, err)
@@ -65,13 +154,52 @@ func (a *DomainHandler) PostCommand(w http.ResponseWriter, r *http.Request) {
 		web.JSONError(w, r, lib.ErrInternal)
 		return
 	}
-	web.JSON(w, r, http.StatusOK, PostCommandResponse{ID: commandID[0]})
+	logging.Ctx(r.Context()).Debug("command saved", "command_id", commandID[0], "correlation_id", cr.CorrelationID)
+	if wait == 0 {
+		web.JSON(w, r, http.StatusOK, savedResponse(commandID[0], cr))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+	result, err := es.WaitForCommand(ctx, a.store, commandID[0])
+	switch {
+	case err != nil && ctx.Err() != nil:
+		web.JSON(w, r, http.StatusAccepted, a.acceptedResponse(r.Context(), commandID[0], cr))
+		return
+	case err != nil:
+		web.JSONError(w, r, err)
+		return
+	}
+	ans := PostCommandResponse{ID: commandID[0], CorrelationID: result.Command.CorrelationID, Status: result.Command.Status}
+	if err := result.Err(); err != nil {
+		ans.Error = err.Error()
+		code := http.StatusUnprocessableEntity
+		if errors.Is(err, es.ErrCommandFailed) {
+			code = http.StatusInternalServerError
+		}
+		web.JSON(w, r, code, ans)
+		return
+	}
+	events, err := a.registry.DecryptEventRecords(result.Events)
+	if err != nil {
+		web.JSONError(w, r, err)
+		return
+	}
+	ans.Events = make([]GetEventResponse, len(events))
+	for i := range events {
+		ans.Events[i] = GetEventResponse(events[i])
+	}
+	web.JSON(w, r, http.StatusOK, ans)
 }
 
 type GetCommandResponse es.CommandRecord
 
+// MarshalJSON embeds the JSON payload, payloads of other codecs are base64 encoded.
 func (u GetCommandResponse) MarshalJSON() ([]byte, error) {
 	type Alias GetCommandResponse
+	if u.Codec != "" && u.Codec != es.CodecJSON {
+		return json.Marshal((Alias)(u))
+	}
 	m := make(map[string]interface{})
 	if err := json.Unmarshal(u.Data, &m); err != nil {
 		return nil, err
@@ -101,13 +229,75 @@ func (a *DomainHandler) GetCommand(w http.ResponseWriter, r *http.Request) {
 		web.JSONError(w, r, err)
 		return
 	}
+	command, err = a.registry.DecryptCommandRecord(command)
+	if err != nil {
+		web.JSONError(w, r, err)
+		return
+	}
 	web.JSON(w, r, http.StatusOK, GetCommandResponse(command))
 }
 
+// CancelCommand cancels a pending command, typically a scheduled one.
+// It responds with 409 when the command is already running or done.
+func (a *DomainHandler) CancelCommand(w http.ResponseWriter, r *http.Request) {
+	commandId := web.StringURLParam(r, "commandId")
+	if len(commandId) == 0 {
+		web.JSONError(w, r, lib.ErrBadRequest)
+		return
+	}
+	err := a.store.CancelCommand(r.Context(), commandId)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		web.JSONError(w, r, lib.ErrNotFound)
+		return
+	case errors.Is(err, es.ErrCommandNotPending):
+		web.JSONError(w, r, lib.ErrConflict)
+		return
+	case err != nil:
+		web.JSONError(w, r, err)
+		return
+	}
+	web.JSON(w, r, http.StatusNoContent, nil)
+}
+
+// commandStateTimeout bounds the read of the state of a command that did not
+// finish in time.
+const commandStateTimeout = time.Second
+
+// savedResponse responds with the ID of the saved command.
+func savedResponse(commandID string, saved es.CommandRecord) PostCommandResponse {
+	ans := PostCommandResponse{ID: commandID}
+	if commandID == saved.ID {
+		// the original command of a repeated idempotency key has its own correlation
+		ans.CorrelationID = saved.CorrelationID
+	}
+	return ans
+}
+
+// acceptedResponse responds with the state of a command that did not finish
+// in time. The context of the wait is done, so the state is read with a short
+// context of its own. When the read fails it responds with the saved command.
+func (a *DomainHandler) acceptedResponse(ctx context.Context, commandID string, saved es.CommandRecord) PostCommandResponse {
+	ans := savedResponse(commandID, saved)
+	stateCtx, cancel := context.WithTimeout(es.ContextWithTenant(context.Background(), es.TenantFromContext(ctx)), commandStateTimeout)
+	defer cancel()
+	cmd, err := a.store.GetCommand(stateCtx, commandID)
+	if err != nil {
+		logging.Ctx(ctx).Warn("failed to get the state of the command", "command_id", commandID, "error", err)
+		return ans
+	}
+	ans.CorrelationID, ans.Status = cmd.CorrelationID, cmd.Status
+	return ans
+}
+
 type GetEventResponse es.EventRecord
 
+// MarshalJSON embeds the JSON payload, payloads of other codecs are base64 encoded.
 func (u GetEventResponse) MarshalJSON() ([]byte, error) {
 	type Alias GetEventResponse
+	if u.Codec != "" && u.Codec != es.CodecJSON {
+		return json.Marshal((Alias)(u))
+	}
 	m := make(map[string]interface{})
 	if err := json.Unmarshal(u.Data, &m); err != nil {
 		return nil, err
@@ -122,52 +312,225 @@ func (u GetEventResponse) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// DefaultEventsLimit and MaxEventsLimit bound the number of events of a page.
+const (
+	DefaultEventsLimit = 100
+	MaxEventsLimit     = 1000
+)
+
+// NextCursorHeader is the response header with the cursor of the next page
+// of events, pass it as the after query parameter. It is missing on the last
+// page.
+const NextCursorHeader = "X-Next-Cursor"
+
+// GetEvents responds with a page of the events of the aggregate, see
+// eventQueryParams for the query parameters.
 func (a *DomainHandler) GetEvents(w http.ResponseWriter, r *http.Request) {
 	aggregateId := web.StringURLParam(r, "aggregateId")
 	if len(aggregateId) == 0 {
 		web.JSONError(w, r, lib.ErrBadRequest)
 		return
 	}
-	events, err := a.store.LoadEvents(r.Context(), aggregateId)
+	query, err := eventQueryParams(r)
+	if err != nil {
+		web.JSONError(w, r, lib.ErrBadRequest)
+		return
+	}
+	query.AggregateID = aggregateId
+	a.queryEvents(w, r, query)
+}
+
+// GetDomainEvents responds with a page of the events of all the aggregates of
+// the domain, see eventQueryParams for the query parameters.
+func (a *DomainHandler) GetDomainEvents(w http.ResponseWriter, r *http.Request) {
+	query, err := eventQueryParams(r)
+	if err != nil {
+		web.JSONError(w, r, lib.ErrBadRequest)
+		return
+	}
+	query.Domain = a.domain
+	a.queryEvents(w, r, query)
+}
+
+func (a *DomainHandler) queryEvents(w http.ResponseWriter, r *http.Request, query es.EventQuery) {
+	limit := query.Limit
+	// one more event tells if there is a next page
+	query.Limit++
+	events, err := a.store.QueryEvents(r.Context(), query)
 	if err != nil {
 		web.JSONError(w, r, err)
 		return
 	}
-	items := make([]GetEventResponse, len(events))
+	if len(events) > limit {
+		events = events[:limit]
+		w.Header().Set(NextCursorHeader, strconv.FormatInt(events[limit-1].GlobalPosition, 10))
+	}
+	events, err = a.registry.DecryptEventRecords(events)
+	if err != nil {
+		web.JSONError(w, r, err)
+		return
+	}
+	ans := make([]GetEventResponse, 0, len(events))
 	for i := range events {
-		items[i] = GetEventResponse(events[i])
+		ans = append(ans, GetEventResponse(events[i]))
 	}
-	web.JSON(w, r, http.StatusOK, items)
+	web.JSON(w, r, http.StatusOK, ans)
 }
 
+// eventQueryParams parses the query parameters of the event routes:
+// limit, the size of the page, after, the cursor of the page, type, which
+// can be repeated, command_id, and from and to, the RFC 3339 bounds of the
+// time the events were stored at.
+func eventQueryParams(r *http.Request) (es.EventQuery, error) {
+	params := r.URL.Query()
+	query := es.EventQuery{
+		EventTypes: params["type"],
+		CommandID:  params.Get("command_id"),
+		Limit:      DefaultEventsLimit,
+	}
+	var err error
+	if v := params.Get("limit"); v != "" {
+		query.Limit, err = strconv.Atoi(v)
+		if err != nil || query.Limit <= 0 {
+			return query, fmt.Errorf("invalid limit %q", v)
+		}
+		if query.Limit > MaxEventsLimit {
+			query.Limit = MaxEventsLimit
+		}
+	}
+	if v := params.Get("after"); v != "" {
+		query.After, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || query.After < 0 {
+			return query, fmt.Errorf("invalid cursor %q", v)
+		}
+	}
+	if v := params.Get("from"); v != "" {
+		if query.From, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return query, err
+		}
+	}
+	if v := params.Get("to"); v != "" {
+		if query.To, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return query, err
+		}
+	}
+	if !query.From.IsZero() && !query.To.IsZero() && !query.From.Before(query.To) {
+		return query, errors.New("from must be before to")
+	}
+	return query, nil
+}
+
+// GetAggregate responds with the current state of the aggregate. With the
+// version or the at query parameter, e.g. ?version=3 or
+// ?at=2023-01-01T00:00:00Z, it responds with the state at that version or time.
 func (a *DomainHandler) GetAggregate(w http.ResponseWriter, r *http.Request) {
 	aggregateId := web.StringURLParam(r, "aggregateId")
 	if len(aggregateId) == 0 {
 		web.JSONError(w, r, lib.ErrBadRequest)
 		return
 	}
-	records, err := a.store.LoadEvents(r.Context(), aggregateId)
+	query := r.URL.Query()
+	version, err := versionParam(query.Get("version"))
+	if err != nil {
+		web.JSONError(w, r, lib.ErrBadRequest)
+		return
+	}
+	var at time.Time
+	if v := query.Get("at"); v != "" {
+		at, err = time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			web.JSONError(w, r, lib.ErrBadRequest)
+			return
+		}
+	}
+	agg, err := a.aggFactory()
 	if err != nil {
 		web.JSONError(w, r, err)
 		return
 	}
-	if len(records) == 0 {
+	if version > 0 || !at.IsZero() {
+		err = es.LoadAggregateUntil(r.Context(), a.store, a.registry, aggregateId, version, at, agg)
+	} else {
+		err = es.LoadAggregate(r.Context(), a.store, a.registry, a.snapshotter, aggregateId, agg)
+	}
+	if err != nil {
+		web.JSONError(w, r, err)
+		return
+	}
+	if agg.GetVersion() == 0 {
 		web.JSONError(w, r, lib.ErrNotFound)
 		return
 	}
-	events, err := es.EventRecordsToEvents(a.registry, records)
+	web.JSON(w, r, http.StatusOK, agg)
+}
+
+type GetAggregateDiffResponse struct {
+	From    int         `json:"from"`
+	To      int         `json:"to"`
+	Changes []es.Change `json:"changes"`
+}
+
+// GetAggregateDiff responds with the changes of the aggregate state between
+// the from and the to versions, e.g. ?from=2&to=5. Without from the changes
+// start from the empty state, without to they end at the current state.
+func (a *DomainHandler) GetAggregateDiff(w http.ResponseWriter, r *http.Request) {
+	aggregateId := web.StringURLParam(r, "aggregateId")
+	if len(aggregateId) == 0 {
+		web.JSONError(w, r, lib.ErrBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	from, err := versionParam(query.Get("from"))
+	if err != nil {
+		web.JSONError(w, r, lib.ErrBadRequest)
+		return
+	}
+	to, err := versionParam(query.Get("to"))
+	if err != nil || (to > 0 && from > to) {
+		web.JSONError(w, r, lib.ErrBadRequest)
+		return
+	}
+	// the state before the first event is the empty aggregate
+	before, err := a.aggFactory()
+	if err == nil && from > 0 {
+		err = es.LoadAggregateUntil(r.Context(), a.store, a.registry, aggregateId, from, time.Time{}, before)
+	}
 	if err != nil {
 		web.JSONError(w, r, err)
 		return
 	}
-	agg, err := a.aggFactory()
+	after, err := a.aggFactory()
+	if err == nil {
+		err = es.LoadAggregateUntil(r.Context(), a.store, a.registry, aggregateId, to, time.Time{}, after)
+	}
 	if err != nil {
 		web.JSONError(w, r, err)
 		return
 	}
-	if err := es.Load(agg, events); err != nil {
+	if after.GetVersion() == 0 || int(after.GetVersion()) < from {
+		web.JSONError(w, r, lib.ErrNotFound)
+		return
+	}
+	changes, err := es.Diff(before, after)
+	if err != nil {
 		web.JSONError(w, r, err)
 		return
 	}
-	web.JSON(w, r, http.StatusOK, agg)
+	web.JSON(w, r, http.StatusOK, GetAggregateDiffResponse{
+		From:    int(before.GetVersion()),
+		To:      int(after.GetVersion()),
+		Changes: changes,
+	})
+}
+
+// versionParam parses an optional aggregate version, 0 when it is empty.
+func versionParam(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(v)
+	if err == nil && version < 0 {
+		err = fmt.Errorf("negative version %d", version)
+	}
+	return version, err
 }
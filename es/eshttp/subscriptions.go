@@ -0,0 +1,283 @@
+package eshttp
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gosom/kit/es"
+	"github.com/gosom/kit/lib"
+	"github.com/gosom/kit/web"
+)
+
+// RegisterSubscriptionRoutes registers the admin routes of the subscription groups.
+// The publishers are needed to replay events and are matched to a group by their name.
+// The routes manage the groups of the tenant of the request, see es.TenantFromContext.
+func RegisterSubscriptionRoutes(mux web.Router, store es.EventStore, publishers ...es.Publisher) {
+	handler := NewSubscriptionHandler(store, publishers...)
+	mux.MethodFunc(http.MethodGet, "/subscriptions", handler.ListSubscriptions)
+	mux.MethodFunc(http.MethodDelete, "/subscriptions/{group}", handler.DeleteSubscription)
+	mux.MethodFunc(http.MethodPost, "/subscriptions/{group}/reset", handler.ResetSubscription)
+	mux.MethodFunc(http.MethodPost, "/subscriptions/{group}/pause", handler.PauseSubscription)
+	mux.MethodFunc(http.MethodPost, "/subscriptions/{group}/resume", handler.ResumeSubscription)
+	mux.MethodFunc(http.MethodPost, "/subscriptions/{group}/rebuild", handler.RebuildSubscription)
+	mux.MethodFunc(http.MethodGet, "/subscriptions/{group}/dead-letters", handler.ListDeadLetters)
+	mux.MethodFunc(http.MethodPost, "/subscriptions/{group}/dead-letters/replay", handler.ReplayDeadLetters)
+	mux.MethodFunc(http.MethodDelete, "/subscriptions/{group}/dead-letters/{eventId}", handler.DeleteDeadLetter)
+}
+
+type SubscriptionHandler struct {
+	store      es.EventStore
+	publishers map[string]es.Publisher
+}
+
+func NewSubscriptionHandler(store es.EventStore, publishers ...es.Publisher) *SubscriptionHandler {
+	ans := SubscriptionHandler{
+		store:      store,
+		publishers: make(map[string]es.Publisher, len(publishers)),
+	}
+	for i := range publishers {
+		ans.publishers[publishers[i].Name()] = publishers[i]
+	}
+	return &ans
+}
+
+type SubscriptionResponse struct {
+	Group         string    `json:"group"`
+	Position      int64     `json:"position"`
+	Paused        bool      `json:"paused"`
+	Lag           *int64    `json:"lag,omitempty"`
+	LastUpdatedAt time.Time `json:"last_updated_at"`
+	Tenant        string    `json:"tenant,omitempty"`
+}
+
+func newSubscriptionResponse(sub es.Subscription) SubscriptionResponse {
+	return SubscriptionResponse{
+		Group:         sub.Group,
+		Position:      sub.Position,
+		Paused:        sub.Paused,
+		LastUpdatedAt: sub.LastUpdatedAt,
+		Tenant:        sub.Tenant,
+	}
+}
+
+func (a *SubscriptionHandler) ListSubscriptions(w http.ResponseWriter, r *http.Request) {
+	items, err := a.store.ListSubscriptions(r.Context())
+	if err != nil {
+		web.JSONError(w, r, err)
+		return
+	}
+	ans := make([]SubscriptionResponse, len(items))
+	for i := range items {
+		lag := items[i].Lag
+		ans[i] = newSubscriptionResponse(items[i].Subscription)
+		ans[i].Lag = &lag
+	}
+	web.JSON(w, r, http.StatusOK, ans)
+}
+
+func (a *SubscriptionHandler) DeleteSubscription(w http.ResponseWriter, r *http.Request) {
+	group := web.StringURLParam(r, "group")
+	if len(group) == 0 {
+		web.JSONError(w, r, lib.ErrBadRequest)
+		return
+	}
+	if err := a.store.DeleteSubscription(r.Context(), group); err != nil {
+		subscriptionError(w, r, err)
+		return
+	}
+	web.JSON(w, r, http.StatusNoContent, nil)
+}
+
+// ResetSubscriptionRequest sets where the subscription restarts from.
+// At most one of the fields can be set. Without any the subscription
+// restarts from the beginning.
+type ResetSubscriptionRequest struct {
+	// Position is the global position of the last event to skip.
+	Position *int64 `json:"position,omitempty"`
+	// EventID is the first event to receive.
+	EventID string `json:"event_id,omitempty"`
+	// At is the creation time of the first event to receive.
+	At *time.Time `json:"at,omitempty"`
+}
+
+func (a *SubscriptionHandler) ResetSubscription(w http.ResponseWriter, r *http.Request) {
+	group := web.StringURLParam(r, "group")
+	if len(group) == 0 {
+		web.JSONError(w, r, lib.ErrBadRequest)
+		return
+	}
+	var req ResetSubscriptionRequest
+	if r.ContentLength != 0 {
+		if err := web.DecodeBody(r, &req, false); err != nil {
+			web.JSONError(w, r, lib.ErrBadRequest)
+			return
+		}
+	}
+	var (
+		sub es.Subscription
+		err error
+	)
+	switch {
+	case req.Position != nil && req.EventID == "" && req.At == nil:
+		if *req.Position < 0 {
+			web.JSONError(w, r, lib.ErrBadRequest)
+			return
+		}
+		sub, err = a.store.ResetSubscription(r.Context(), group, *req.Position)
+	case req.Position == nil && req.EventID != "" && req.At == nil:
+		sub, err = es.ResetSubscriptionToEvent(r.Context(), a.store, group, req.EventID)
+	case req.Position == nil && req.EventID == "" && req.At != nil:
+		sub, err = es.ResetSubscriptionToTime(r.Context(), a.store, group, *req.At)
+	case req.Position == nil && req.EventID == "" && req.At == nil:
+		sub, err = a.store.ResetSubscription(r.Context(), group, 0)
+	default:
+		web.JSONError(w, r, lib.ErrBadRequest)
+		return
+	}
+	if err != nil {
+		subscriptionError(w, r, err)
+		return
+	}
+	web.JSON(w, r, http.StatusOK, newSubscriptionResponse(sub))
+}
+
+func (a *SubscriptionHandler) PauseSubscription(w http.ResponseWriter, r *http.Request) {
+	a.setPaused(w, r, true)
+}
+
+func (a *SubscriptionHandler) ResumeSubscription(w http.ResponseWriter, r *http.Request) {
+	a.setPaused(w, r, false)
+}
+
+func (a *SubscriptionHandler) setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	group := web.StringURLParam(r, "group")
+	if len(group) == 0 {
+		web.JSONError(w, r, lib.ErrBadRequest)
+		return
+	}
+	sub, err := a.store.SetSubscriptionPaused(r.Context(), group, paused)
+	if err != nil {
+		subscriptionError(w, r, err)
+		return
+	}
+	web.JSON(w, r, http.StatusOK, newSubscriptionResponse(sub))
+}
+
+// RebuildSubscription resets the publisher of the group and replays all the events to it.
+// It waits for the running subscribers to pause, see es.RebuildSubscription.
+func (a *SubscriptionHandler) RebuildSubscription(w http.ResponseWriter, r *http.Request) {
+	group := web.StringURLParam(r, "group")
+	publisher, ok := a.publishers[group]
+	if !ok {
+		web.JSONError(w, r, lib.ErrNotFound)
+		return
+	}
+	sub, err := es.RebuildSubscription(r.Context(), a.store, publisher, group)
+	if err != nil {
+		subscriptionError(w, r, err)
+		return
+	}
+	web.JSON(w, r, http.StatusOK, newSubscriptionResponse(sub))
+}
+
+func subscriptionError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, es.ErrSubscriptionNotFound) || errors.Is(err, sql.ErrNoRows) {
+		web.JSONError(w, r, lib.ErrNotFound)
+		return
+	}
+	web.JSONError(w, r, err)
+}
+
+type DeadLetterResponse struct {
+	Group     string           `json:"group"`
+	Event     GetEventResponse `json:"event"`
+	LastError string           `json:"last_error"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+func (a *SubscriptionHandler) ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	group := web.StringURLParam(r, "group")
+	if len(group) == 0 {
+		web.JSONError(w, r, lib.ErrBadRequest)
+		return
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			web.JSONError(w, r, lib.ErrBadRequest)
+			return
+		}
+	}
+	items, err := a.store.ListDeadLetters(r.Context(), group, limit)
+	if err != nil {
+		web.JSONError(w, r, err)
+		return
+	}
+	ans := make([]DeadLetterResponse, len(items))
+	for i := range items {
+		ans[i] = DeadLetterResponse{
+			Group:     items[i].Group,
+			Event:     GetEventResponse(items[i].Event),
+			LastError: items[i].LastError,
+			CreatedAt: items[i].CreatedAt,
+		}
+	}
+	web.JSON(w, r, http.StatusOK, ans)
+}
+
+type ReplayDeadLettersRequest struct {
+	EventIDs []string `json:"event_ids"`
+}
+
+type ReplayDeadLettersResponse struct {
+	Replayed int `json:"replayed"`
+}
+
+func (a *SubscriptionHandler) ReplayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	group := web.StringURLParam(r, "group")
+	publisher, ok := a.publishers[group]
+	if !ok {
+		web.JSONError(w, r, lib.ErrNotFound)
+		return
+	}
+	var req ReplayDeadLettersRequest
+	if r.ContentLength != 0 {
+		if err := web.DecodeBody(r, &req, false); err != nil {
+			web.JSONError(w, r, lib.ErrBadRequest)
+			return
+		}
+	}
+	replayed, err := es.ReplayDeadLetters(r.Context(), a.store, publisher, group, req.EventIDs...)
+	if err != nil {
+		if errors.Is(err, es.ErrDeadLetterNotFound) {
+			web.JSONError(w, r, lib.ErrNotFound)
+			return
+		}
+		web.JSONError(w, r, err)
+		return
+	}
+	web.JSON(w, r, http.StatusOK, ReplayDeadLettersResponse{Replayed: replayed})
+}
+
+func (a *SubscriptionHandler) DeleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	group := web.StringURLParam(r, "group")
+	eventID := web.StringURLParam(r, "eventId")
+	if len(group) == 0 || len(eventID) == 0 {
+		web.JSONError(w, r, lib.ErrBadRequest)
+		return
+	}
+	if err := a.store.DeleteDeadLetter(r.Context(), group, eventID); err != nil {
+		if errors.Is(err, es.ErrDeadLetterNotFound) {
+			web.JSONError(w, r, lib.ErrNotFound)
+			return
+		}
+		web.JSONError(w, r, err)
+		return
+	}
+	web.JSON(w, r, http.StatusNoContent, nil)
+}
@@ -0,0 +1,1486 @@
+// Package estest contains helpers for testing code built on top of the es package.
+package estest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/gosom/kit/es"
+	"github.com/gosom/kit/lib"
+)
+
+// EventStoreFactory returns a new, empty event store.
+// It is called once for every test of the suite.
+type EventStoreFactory func(t *testing.T) es.EventStore
+
+// RunEventStoreSuite runs the behavioural test suite that every es.EventStore
+// implementation must pass.
+// When the store also implements es.SnapshotStore, es.KeyStore or es.Trigger
+// the snapshot, the key and the notification tests run as well.
+func RunEventStoreSuite(t *testing.T, factory EventStoreFactory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, store es.EventStore)
+	}{
+		{"SaveCommandRecords", testSaveCommandRecords},
+		{"IdempotencyKeys", testIdempotencyKeys},
+		{"GetCommand", testGetCommand},
+		{"Correlation", testCorrelation},
+		{"Metadata", testMetadata},
+		{"Tenants", testTenants},
+		{"Codecs", testCodecs},
+		{"SelectForProcessing", testSelectForProcessing},
+		{"ScheduledCommands", testScheduledCommands},
+		{"StoreCommandResults", testStoreCommandResults},
+		{"StoreCommandResultsDuplicateEvent", testStoreCommandResultsDuplicateEvent},
+		{"CommandLifecycle", testCommandLifecycle},
+		{"LoadEvents", testLoadEvents},
+		{"CommandRetry", testCommandRetry},
+		{"LoadEventsUntil", testLoadEventsUntil},
+		{"QueryEvents", testQueryEvents},
+		{"Subscriptions", testSubscriptions},
+		{"SubscriptionOrdering", testSubscriptionOrdering},
+		{"SubscriptionLateCommit", testSubscriptionLateCommit},
+		{"SubscriptionManagement", testSubscriptionManagement},
+		{"DeadLetters", testDeadLetters},
+		{"Leases", testLeases},
+		{"SagaInstances", testSagaInstances},
+		{"ConcurrentSaveCommandRecords", testConcurrentSaveCommandRecords},
+		{"ConcurrentStoreCommandResults", testConcurrentStoreCommandResults},
+		{"ConcurrentEventTimes", testConcurrentEventTimes},
+		{"ConcurrentGetOrCreate", testConcurrentGetOrCreate},
+		{"Snapshots", testSnapshots},
+		{"Keys", testKeys},
+		{"Notifications", testNotifications},
+	}
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, factory(t))
+		})
+	}
+}
+
+// NewCommandRecord returns a valid command record for the aggregate.
+func NewCommandRecord(aggregateID string) es.CommandRecord {
+	return es.CommandRecord{
+		RecordBase: es.RecordBase{
+			ID:          lib.MustNewULID(),
+			AggregateID: aggregateID,
+			EventType:   "TestCommand",
+			Data:        []byte(`{"value":1}`),
+			CreatedAt:   time.Now().UTC().Truncate(time.Microsecond),
+		},
+		AggregateHash: lib.Int32Ring(lib.HashToUInt32(aggregateID)),
+	}
+}
+
+// NewEventRecord returns a valid event record for the aggregate.
+func NewEventRecord(aggregateID string, version int) es.EventRecord {
+	return es.EventRecord{
+		RecordBase: es.RecordBase{
+			ID:          lib.MustNewULID(),
+			AggregateID: aggregateID,
+			EventType:   "TestEvent",
+			Data:        []byte(fmt.Sprintf(`{"version":%d}`, version)),
+		},
+		Version:       version,
+		SchemaVersion: 1,
+	}
+}
+
+// storeEvents saves a command for the aggregate and stores the given number of
+// events as its result.
+func storeEvents(t *testing.T, store es.EventStore, aggregateID string, num int) []es.EventRecord {
+	ctx := context.Background()
+	cmd := NewCommandRecord(aggregateID)
+	_, err := store.SaveCommandRecords(ctx, cmd)
+	require.NoError(t, err)
+	version, err := store.GetOrCreateVersion(ctx, aggregateID)
+	require.NoError(t, err)
+	events := make([]es.EventRecord, num)
+	for i := range events {
+		events[i] = NewEventRecord(aggregateID, version+i+1)
+	}
+	require.NoError(t, store.StoreCommandResults(ctx, cmd.ID, version, events...))
+	return events
+}
+
+func eventIDs(events []es.EventRecord) []string {
+	ans := make([]string, len(events))
+	for i := range events {
+		ans[i] = events[i].ID
+	}
+	return ans
+}
+
+func testSaveCommandRecords(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	first := NewCommandRecord("test-1")
+	second := NewCommandRecord("test-2")
+
+	ids, err := store.SaveCommandRecords(ctx, first, second)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{first.ID, second.ID}, ids)
+
+	// duplicates are silently ignored
+	third := NewCommandRecord("test-3")
+	ids, err = store.SaveCommandRecords(ctx, first, third)
+	require.NoError(t, err)
+	require.Equal(t, []string{third.ID}, ids)
+
+	ids, err = store.SaveCommandRecords(ctx, first)
+	require.NoError(t, err)
+	require.Empty(t, ids)
+}
+
+func testIdempotencyKeys(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	first := NewCommandRecord("test-1")
+	first.IdempotencyKey = "key-1"
+	ids, err := store.SaveCommandRecords(ctx, first)
+	require.NoError(t, err)
+	require.Equal(t, []string{first.ID}, ids)
+
+	saved, err := store.GetCommand(ctx, first.ID)
+	require.NoError(t, err)
+	require.Equal(t, "key-1", saved.IdempotencyKey)
+
+	// a repeated key returns the original command, in the order of the records
+	repeat := NewCommandRecord("test-2")
+	repeat.IdempotencyKey = "key-1"
+	unkeyed := NewCommandRecord("test-2")
+	ids, err = store.SaveCommandRecords(ctx, unkeyed, repeat)
+	require.NoError(t, err)
+	require.Equal(t, []string{unkeyed.ID, first.ID}, ids)
+	_, err = store.GetCommand(ctx, repeat.ID)
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	// keys are scoped per domain
+	other := NewCommandRecord("other-1")
+	other.IdempotencyKey = "key-1"
+	ids, err = store.SaveCommandRecords(ctx, other)
+	require.NoError(t, err)
+	require.Equal(t, []string{other.ID}, ids)
+}
+
+func testGetCommand(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	cmd := NewCommandRecord("test-1")
+	_, err := store.SaveCommandRecords(ctx, cmd)
+	require.NoError(t, err)
+
+	got, err := store.GetCommand(ctx, cmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, cmd.ID, got.ID)
+	require.Equal(t, cmd.AggregateID, got.AggregateID)
+	require.Equal(t, cmd.AggregateHash, got.AggregateHash)
+	require.Equal(t, cmd.EventType, got.EventType)
+	require.JSONEq(t, string(cmd.Data), string(got.Data))
+	require.True(t, cmd.CreatedAt.Equal(got.CreatedAt))
+	require.Equal(t, es.CommandStatusPending, got.Status)
+
+	_, err = store.GetCommand(ctx, lib.MustNewULID())
+	require.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func testCorrelation(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	cmd := NewCommandRecord("test-1")
+	cmd.SetCorrelation(es.Correlation{CorrelationID: "request-1", CausationID: "request-1"})
+	_, err := store.SaveCommandRecords(ctx, cmd)
+	require.NoError(t, err)
+	got, err := store.GetCommand(ctx, cmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, cmd.Correlation(), got.Correlation())
+	groups, err := store.SelectForProcessing(ctx, 1, 10)
+	require.NoError(t, err)
+	require.Len(t, groups[0], 1)
+	require.Equal(t, cmd.Correlation(), groups[0][0].Correlation())
+
+	version, err := store.GetOrCreateVersion(ctx, cmd.AggregateID)
+	require.NoError(t, err)
+	event := NewEventRecord(cmd.AggregateID, version+1)
+	event.SetCorrelation(es.CausedBy(cmd.ID, cmd.CorrelationID))
+	require.NoError(t, store.StoreCommandResults(ctx, cmd.ID, version, event))
+	want := es.Correlation{CorrelationID: "request-1", CausationID: cmd.ID}
+
+	events, err := store.LoadEvents(ctx, cmd.AggregateID)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, want, events[0].Correlation())
+	events, err = store.LoadCommandEvents(ctx, cmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, want, events[0].Correlation())
+	sub, err := store.InsertSubscription(ctx, "correlation")
+	require.NoError(t, err)
+	events, err = store.SelectEventsForSubscription(ctx, sub, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, want, events[0].Correlation())
+}
+
+func testMetadata(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	cmd := NewCommandRecord("test-1")
+	cmd.Metadata = es.Metadata{es.MetadataUserID: "user-1", es.MetadataSource: "test"}
+	plain := NewCommandRecord("test-2")
+	_, err := store.SaveCommandRecords(ctx, cmd, plain)
+	require.NoError(t, err)
+	got, err := store.GetCommand(ctx, cmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, cmd.Metadata, got.Metadata)
+	got, err = store.GetCommand(ctx, plain.ID)
+	require.NoError(t, err)
+	require.Empty(t, got.Metadata)
+	groups, err := store.SelectForProcessing(ctx, 1, 10)
+	require.NoError(t, err)
+	require.Len(t, groups[0], 2)
+	for _, rec := range groups[0] {
+		if rec.ID == cmd.ID {
+			require.Equal(t, cmd.Metadata, rec.Metadata)
+		}
+	}
+
+	version, err := store.GetOrCreateVersion(ctx, cmd.AggregateID)
+	require.NoError(t, err)
+	event := NewEventRecord(cmd.AggregateID, version+1)
+	event.Metadata = cmd.Metadata.Merge(es.Metadata{"reason": "test"})
+	require.NoError(t, store.StoreCommandResults(ctx, cmd.ID, version, event))
+
+	events, err := store.LoadEvents(ctx, cmd.AggregateID)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, event.Metadata, events[0].Metadata)
+	events, err = store.LoadCommandEvents(ctx, cmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, event.Metadata, events[0].Metadata)
+	sub, err := store.InsertSubscription(ctx, "metadata")
+	require.NoError(t, err)
+	events, err = store.SelectEventsForSubscription(ctx, sub, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, event.Metadata, events[0].Metadata)
+}
+
+func testCodecs(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	binary := []byte{0x82, 0xa2, 0x69, 0x64, 0x00, 0xff}
+	cmd := NewCommandRecord("test-1")
+	cmd.Codec, cmd.Data = "msgpack", binary
+	plain := NewCommandRecord("test-2")
+	plain.Codec = es.CodecJSON
+	_, err := store.SaveCommandRecords(ctx, cmd, plain)
+	require.NoError(t, err)
+	got, err := store.GetCommand(ctx, cmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, "msgpack", got.Codec)
+	require.Equal(t, binary, got.Data)
+	got, err = store.GetCommand(ctx, plain.ID)
+	require.NoError(t, err)
+	require.Equal(t, es.CodecJSON, got.Codec)
+	require.JSONEq(t, string(plain.Data), string(got.Data))
+	groups, err := store.SelectForProcessing(ctx, 1, 10)
+	require.NoError(t, err)
+	require.Len(t, groups[0], 2)
+	for _, rec := range groups[0] {
+		if rec.ID == cmd.ID {
+			require.Equal(t, "msgpack", rec.Codec)
+			require.Equal(t, binary, rec.Data)
+		}
+	}
+
+	version, err := store.GetOrCreateVersion(ctx, cmd.AggregateID)
+	require.NoError(t, err)
+	event := NewEventRecord(cmd.AggregateID, version+1)
+	event.Codec, event.Data = "msgpack", binary
+	require.NoError(t, store.StoreCommandResults(ctx, cmd.ID, version, event))
+
+	events, err := store.LoadEvents(ctx, cmd.AggregateID)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, "msgpack", events[0].Codec)
+	require.Equal(t, binary, events[0].Data)
+	events, err = store.LoadCommandEvents(ctx, cmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, binary, events[0].Data)
+	sub, err := store.InsertSubscription(ctx, "codecs")
+	require.NoError(t, err)
+	events, err = store.SelectEventsForSubscription(ctx, sub, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, "msgpack", events[0].Codec)
+	require.Equal(t, binary, events[0].Data)
+}
+
+func testTenants(t *testing.T, store es.EventStore) {
+	none := context.Background()
+	system := es.ContextWithSystemScope(none)
+	acme := es.ContextWithTenant(system, "acme")
+	globex := es.ContextWithTenant(system, "globex")
+
+	// the tenants use the same aggregate and the same idempotency key
+	save := func(ctx context.Context) es.CommandRecord {
+		cmd := NewCommandRecord("test-1")
+		cmd.IdempotencyKey = "key-1"
+		ids, err := store.SaveCommandRecords(ctx, cmd)
+		require.NoError(t, err)
+		require.Equal(t, []string{cmd.ID}, ids)
+		cmd.Tenant = es.TenantFromContext(ctx)
+		return cmd
+	}
+	acmeCmd := save(acme)
+	globexCmd := save(globex)
+
+	got, err := store.GetCommand(acme, acmeCmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, "acme", got.Tenant)
+	_, err = store.GetCommand(globex, acmeCmd.ID)
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	_, err = store.GetCommand(system, acmeCmd.ID)
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	require.ErrorIs(t, store.CancelCommand(globex, acmeCmd.ID), sql.ErrNoRows)
+
+	// a tenant cannot save the records of another
+	other := NewCommandRecord("test-2")
+	other.Tenant = "globex"
+	_, err = store.SaveCommandRecords(acme, other)
+	require.ErrorIs(t, err, es.ErrTenantMismatch)
+	_, err = store.SaveCommandRecords(none, other)
+	require.ErrorIs(t, err, es.ErrTenantMismatch)
+
+	// the system scope selects the commands of all the tenants
+	groups, err := store.SelectForProcessing(system, 1, 10)
+	require.NoError(t, err)
+	require.Len(t, groups[0], 2)
+	groups, err = store.SelectForProcessing(acme, 1, 10)
+	require.NoError(t, err)
+	require.Len(t, groups[0], 1)
+	require.Equal(t, acmeCmd.ID, groups[0][0].ID)
+	// a context without a tenant has the default tenant, not all of them
+	groups, err = store.SelectForProcessing(none, 1, 10)
+	require.NoError(t, err)
+	require.Empty(t, groups[0])
+
+	process := func(ctx context.Context, cmd es.CommandRecord, num int) []es.EventRecord {
+		version, err := store.GetOrCreateVersion(ctx, cmd.AggregateID)
+		require.NoError(t, err)
+		require.Equal(t, 0, version, "every tenant has its own aggregate")
+		events := make([]es.EventRecord, num)
+		for i := range events {
+			events[i] = NewEventRecord(cmd.AggregateID, version+i+1)
+		}
+		require.NoError(t, store.StoreCommandResults(ctx, cmd.ID, version, events...))
+		return events
+	}
+	require.Error(t, store.StoreCommandResults(globex, acmeCmd.ID, 0))
+	acmeEvents := process(acme, acmeCmd, 2)
+	globexEvents := process(globex, globexCmd, 1)
+
+	events, err := store.LoadEvents(acme, "test-1")
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(acmeEvents), eventIDs(events))
+	require.Equal(t, "acme", events[0].Tenant)
+	events, err = store.LoadEventsFromVersion(globex, "test-1", 0)
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(globexEvents), eventIDs(events))
+	events, err = store.LoadEvents(system, "test-1")
+	require.NoError(t, err)
+	require.Empty(t, events)
+	events, err = store.LoadCommandEvents(globex, acmeCmd.ID)
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	// the subscriptions of a tenant see its events, those of the system scope all the events
+	for _, ctx := range []context.Context{system, acme} {
+		_, err := store.InsertSubscription(ctx, "tenants")
+		require.NoError(t, err)
+	}
+	sub, err := store.GetSubscription(acme, "tenants")
+	require.NoError(t, err)
+	require.Equal(t, "acme", sub.Tenant)
+	events, err = store.SelectEventsForSubscription(acme, sub, 10)
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(acmeEvents), eventIDs(events))
+	sub, err = store.GetSubscription(system, "tenants")
+	require.NoError(t, err)
+	events, err = store.SelectEventsForSubscription(system, sub, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	_, err = store.GetSubscription(globex, "tenants")
+	require.ErrorIs(t, err, es.ErrSubscriptionNotFound)
+	_, err = store.GetEventPosition(acme, globexEvents[0].ID)
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	events, err = store.SelectEventsForSubscription(none, sub, 10)
+	require.NoError(t, err)
+	require.Empty(t, events)
+	_, err = store.GetEventPosition(none, globexEvents[0].ID)
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	position, err := store.GetPositionAt(none, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Zero(t, position)
+	require.Error(t, store.InsertDeadLetter(none, "tenants", globexEvents[0].ID, "boom"))
+
+	_, err = store.ResetSubscription(acme, "tenants", 100)
+	require.NoError(t, err)
+	infos, err := store.ListSubscriptions(system)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, int64(3), infos[0].Lag)
+	infos, err = store.ListSubscriptions(none)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Zero(t, infos[0].Lag)
+	infos, err = store.ListSubscriptions(acme)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, int64(100), infos[0].Position)
+
+	require.Error(t, store.InsertDeadLetter(acme, "tenants", globexEvents[0].ID, "boom"))
+	require.NoError(t, store.InsertDeadLetter(acme, "tenants", acmeEvents[0].ID, "boom"))
+	deadLetters, err := store.ListDeadLetters(system, "tenants", 0)
+	require.NoError(t, err)
+	require.Empty(t, deadLetters)
+	require.NoError(t, store.DeleteSubscription(acme, "tenants"))
+	_, err = store.GetSubscription(system, "tenants")
+	require.NoError(t, err)
+
+	instance := es.SagaInstance{Saga: "saga", ID: "1", Status: es.SagaStatusActive, Version: 1,
+		CreatedAt: time.Now().UTC(), UpdatedAt: time.Now().UTC()}
+	require.NoError(t, store.SaveSagaInstance(acme, instance))
+	require.NoError(t, store.SaveSagaInstance(globex, instance))
+	_, err = store.GetSagaInstance(system, "saga", "1")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	if snapshots, ok := store.(es.SnapshotStore); ok {
+		snapshot := es.Snapshot{AggregateID: "test-1", AggregateType: "test", Version: 2, SchemaVersion: 1,
+			Data: []byte(`{}`), CreatedAt: time.Now().UTC()}
+		require.NoError(t, snapshots.SaveSnapshot(acme, snapshot))
+		_, err := snapshots.LoadSnapshot(globex, "test-1")
+		require.ErrorIs(t, err, es.ErrSnapshotNotFound)
+		got, err := snapshots.LoadSnapshot(acme, "test-1")
+		require.NoError(t, err)
+		require.Equal(t, 2, got.Version)
+	}
+}
+
+func testSelectForProcessing(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	const workers = 3
+	var records []es.CommandRecord
+	for i := 0; i < 30; i++ {
+		records = append(records, NewCommandRecord(fmt.Sprintf("test-%d", i%7)))
+	}
+	_, err := store.SaveCommandRecords(ctx, records...)
+	require.NoError(t, err)
+
+	groups, err := store.SelectForProcessing(ctx, workers, 100)
+	require.NoError(t, err)
+	require.Len(t, groups, workers)
+	total := 0
+	for i := range groups {
+		total += len(groups[i])
+		for j := range groups[i] {
+			require.Equal(t, int32(i), groups[i][j].AggregateHash%workers,
+				"command %s is in the wrong group", groups[i][j].ID)
+			if j > 0 {
+				require.Less(t, groups[i][j-1].ID, groups[i][j].ID, "commands must be ordered by id")
+			}
+		}
+	}
+	require.Equal(t, len(records), total)
+
+	// only the given partitions are selected
+	filtered, err := store.SelectForProcessing(ctx, workers, 100, 0, 2)
+	require.NoError(t, err)
+	require.Len(t, filtered, workers)
+	require.Equal(t, groups[0], filtered[0])
+	require.Empty(t, filtered[1])
+	require.Equal(t, groups[2], filtered[2])
+
+	// limit applies per group
+	groups, err = store.SelectForProcessing(ctx, 1, 4)
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	require.Len(t, groups[0], 4)
+	for i := 0; i < 4; i++ {
+		require.Equal(t, records[i].ID, groups[0][i].ID)
+	}
+
+	// processed commands are not selected again
+	_, err = store.GetOrCreateVersion(ctx, records[0].AggregateID)
+	require.NoError(t, err)
+	require.NoError(t, store.StoreCommandResults(ctx, records[0].ID, 0))
+	groups, err = store.SelectForProcessing(ctx, 1, 4)
+	require.NoError(t, err)
+	require.Equal(t, records[1].ID, groups[0][0].ID)
+}
+
+func testScheduledCommands(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	past, future := now.Add(-time.Minute), now.Add(time.Hour)
+	due := NewCommandRecord("test-1")
+	due.NotBefore = &past
+	scheduled := NewCommandRecord("test-1")
+	scheduled.NotBefore = &future
+	next := NewCommandRecord("test-1")
+	_, err := store.SaveCommandRecords(ctx, due, scheduled, next)
+	require.NoError(t, err)
+
+	saved, err := store.GetCommand(ctx, scheduled.ID)
+	require.NoError(t, err)
+	require.NotNil(t, saved.NotBefore)
+	require.True(t, future.Equal(*saved.NotBefore))
+
+	// the scheduled command does not hold back the commands after it
+	groups, err := store.SelectForProcessing(ctx, 1, 100)
+	require.NoError(t, err)
+	require.Len(t, groups[0], 2)
+	require.Equal(t, due.ID, groups[0][0].ID)
+	require.Equal(t, next.ID, groups[0][1].ID)
+
+	require.NoError(t, store.CancelCommand(ctx, scheduled.ID))
+	saved, err = store.GetCommand(ctx, scheduled.ID)
+	require.NoError(t, err)
+	require.Equal(t, es.CommandStatusCancelled, saved.Status)
+	require.NotNil(t, saved.ProcessedAt)
+	_, err = store.MarkCommandRunning(ctx, scheduled.ID)
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	require.ErrorIs(t, store.CancelCommand(ctx, scheduled.ID), es.ErrCommandNotPending)
+
+	// only pending commands can be cancelled
+	_, err = store.MarkCommandRunning(ctx, due.ID)
+	require.NoError(t, err)
+	require.ErrorIs(t, store.CancelCommand(ctx, due.ID), es.ErrCommandNotPending)
+	require.ErrorIs(t, store.CancelCommand(ctx, "missing"), sql.ErrNoRows)
+}
+
+func testStoreCommandResults(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	cmd := NewCommandRecord("test-1")
+	_, err := store.SaveCommandRecords(ctx, cmd)
+	require.NoError(t, err)
+
+	version, err := store.GetOrCreateVersion(ctx, cmd.AggregateID)
+	require.NoError(t, err)
+	require.Equal(t, 0, version)
+
+	err = store.StoreCommandResults(ctx, cmd.ID, 1, NewEventRecord(cmd.AggregateID, 2))
+	require.ErrorIs(t, err, es.ErrWrongExpectedVersion)
+
+	got, err := store.GetCommand(ctx, cmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, es.CommandStatusPending, got.Status, "a failed store must not change the command")
+
+	events := []es.EventRecord{
+		NewEventRecord(cmd.AggregateID, 1),
+		NewEventRecord(cmd.AggregateID, 2),
+	}
+	require.NoError(t, store.StoreCommandResults(ctx, cmd.ID, 0, events...))
+
+	version, err = store.GetOrCreateVersion(ctx, cmd.AggregateID)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+
+	got, err = store.GetCommand(ctx, cmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, es.CommandStatusFinished, got.Status)
+	require.NotNil(t, got.ProcessedAt)
+
+	loaded, err := store.LoadEvents(ctx, cmd.AggregateID)
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(events), eventIDs(loaded))
+	for i := range loaded {
+		require.Equal(t, cmd.ID, loaded[i].CommandID)
+		require.Equal(t, events[i].Version, loaded[i].Version)
+		require.Equal(t, events[i].SchemaVersion, loaded[i].SchemaVersion)
+		require.Equal(t, events[i].EventType, loaded[i].EventType)
+		require.JSONEq(t, string(events[i].Data), string(loaded[i].Data))
+		require.False(t, loaded[i].CreatedAt.IsZero())
+	}
+
+	// a stale writer loses
+	other := NewCommandRecord("test-1")
+	_, err = store.SaveCommandRecords(ctx, other)
+	require.NoError(t, err)
+	err = store.StoreCommandResults(ctx, other.ID, 0, NewEventRecord(cmd.AggregateID, 1))
+	require.ErrorIs(t, err, es.ErrWrongExpectedVersion)
+
+	// a command without events only finishes the command
+	require.NoError(t, store.StoreCommandResults(ctx, other.ID, 2))
+	got, err = store.GetCommand(ctx, other.ID)
+	require.NoError(t, err)
+	require.Equal(t, es.CommandStatusFinished, got.Status)
+	version, err = store.GetOrCreateVersion(ctx, cmd.AggregateID)
+	require.NoError(t, err)
+	require.Equal(t, 2, version)
+}
+
+func testStoreCommandResultsDuplicateEvent(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	events := storeEvents(t, store, "test-1", 1)
+
+	cmd := NewCommandRecord("test-1")
+	_, err := store.SaveCommandRecords(ctx, cmd)
+	require.NoError(t, err)
+	duplicate := events[0]
+	duplicate.Version = 2
+	err = store.StoreCommandResults(ctx, cmd.ID, 1, NewEventRecord("test-1", 2), duplicate)
+	require.Error(t, err)
+
+	// the whole result is rolled back
+	version, err := store.GetOrCreateVersion(ctx, "test-1")
+	require.NoError(t, err)
+	require.Equal(t, 1, version)
+	loaded, err := store.LoadEvents(ctx, "test-1")
+	require.NoError(t, err)
+	require.Len(t, loaded, 1)
+	got, err := store.GetCommand(ctx, cmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, es.CommandStatusPending, got.Status)
+}
+
+func testCommandLifecycle(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	cmd := NewCommandRecord("test-1")
+	_, err := store.SaveCommandRecords(ctx, cmd)
+	require.NoError(t, err)
+
+	got, err := store.GetCommand(ctx, cmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, es.CommandStatusPending, got.Status)
+	require.Equal(t, 0, got.Attempts)
+	require.Equal(t, "", got.LastError)
+	require.Nil(t, got.ProcessedAt)
+
+	attempts, err := store.MarkCommandRunning(ctx, cmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, 1, attempts)
+	got, err = store.GetCommand(ctx, cmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, es.CommandStatusRunning, got.Status)
+
+	// running commands are selected again, a crashed processor must not lose them
+	groups, err := store.SelectForProcessing(ctx, 1, 10)
+	require.NoError(t, err)
+	require.Len(t, groups[0], 1)
+	require.Equal(t, 1, groups[0][0].Attempts)
+
+	require.NoError(t, store.MarkCommandFailed(ctx, cmd.ID, "temporary error", false, time.Time{}))
+	got, err = store.GetCommand(ctx, cmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, es.CommandStatusPending, got.Status)
+	require.Equal(t, "temporary error", got.LastError)
+	require.Nil(t, got.ProcessedAt)
+
+	attempts, err = store.MarkCommandRunning(ctx, cmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, 2, attempts)
+	require.NoError(t, store.MarkCommandFailed(ctx, cmd.ID, "permanent error", true, time.Time{}))
+	got, err = store.GetCommand(ctx, cmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, es.CommandStatusFailure, got.Status)
+	require.Equal(t, 2, got.Attempts)
+	require.Equal(t, "permanent error", got.LastError)
+	require.NotNil(t, got.ProcessedAt)
+
+	// failed commands are not selected again
+	groups, err = store.SelectForProcessing(ctx, 1, 10)
+	require.NoError(t, err)
+	require.Empty(t, groups[0])
+
+	_, err = store.MarkCommandRunning(ctx, lib.MustNewULID())
+	require.Error(t, err)
+	require.Error(t, store.MarkCommandFailed(ctx, lib.MustNewULID(), "error", true, time.Time{}))
+}
+
+func testCommandRetry(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	failing := NewCommandRecord("test-1")
+	next := NewCommandRecord("test-1")
+	other := NewCommandRecord("test-2")
+	_, err := store.SaveCommandRecords(ctx, failing, next, other)
+	require.NoError(t, err)
+	selected := func() []string {
+		groups, err := store.SelectForProcessing(ctx, 1, 10)
+		require.NoError(t, err)
+		ids := make([]string, len(groups[0]))
+		for i := range groups[0] {
+			ids[i] = groups[0][i].ID
+		}
+		return ids
+	}
+
+	_, err = store.MarkCommandRunning(ctx, failing.ID)
+	require.NoError(t, err)
+	retryAt := time.Now().UTC().Add(time.Hour).Truncate(time.Microsecond)
+	require.NoError(t, store.MarkCommandFailed(ctx, failing.ID, "temporary error", false, retryAt))
+	got, err := store.GetCommand(ctx, failing.ID)
+	require.NoError(t, err)
+	require.Equal(t, es.CommandStatusPending, got.Status)
+	require.NotNil(t, got.NotBefore)
+	require.True(t, retryAt.Equal(*got.NotBefore))
+	require.Equal(t, []string{other.ID}, selected(), "the later commands of the aggregate wait for the retry")
+
+	_, err = store.MarkCommandRunning(ctx, failing.ID)
+	require.NoError(t, err)
+	require.NoError(t, store.MarkCommandFailed(ctx, failing.ID, "temporary error", false, time.Now().UTC().Add(-time.Hour)))
+	require.Equal(t, []string{failing.ID, next.ID, other.ID}, selected())
+}
+
+func testLoadEventsUntil(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	events := storeEvents(t, store, "test-1", 2)
+	time.Sleep(10 * time.Millisecond)
+	events = append(events, storeEvents(t, store, "test-1", 1)...)
+	storeEvents(t, store, "test-2", 2)
+
+	cmd := NewCommandRecord("test-1")
+	_, err := store.SaveCommandRecords(ctx, cmd)
+	require.NoError(t, err)
+	errEvent := NewEventRecord("test-1", 4)
+	errEvent.EventType = "EventError"
+	require.NoError(t, store.StoreCommandResults(ctx, cmd.ID, 3, errEvent))
+
+	loaded, err := store.LoadEventsUntil(ctx, "test-1", 0, time.Time{})
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(events), eventIDs(loaded), "EventError must be excluded")
+	first, last := loaded[1].CreatedAt, loaded[2].CreatedAt
+	require.True(t, last.After(first))
+
+	loaded, err = store.LoadEventsUntil(ctx, "test-1", 2, time.Time{})
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(events[:2]), eventIDs(loaded))
+
+	loaded, err = store.LoadEventsUntil(ctx, "test-1", 0, first)
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(events[:2]), eventIDs(loaded), "the time bound is inclusive")
+	loaded, err = store.LoadEventsUntil(ctx, "test-1", 0, last)
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(events), eventIDs(loaded))
+	loaded, err = store.LoadEventsUntil(ctx, "test-1", 0, first.Add(-time.Millisecond))
+	require.NoError(t, err)
+	require.Empty(t, loaded)
+
+	loaded, err = store.LoadEventsUntil(ctx, "test-1", 1, last)
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(events[:1]), eventIDs(loaded), "both bounds apply")
+
+	loaded, err = store.LoadEventsUntil(ctx, "test-3", 0, time.Time{})
+	require.NoError(t, err)
+	require.Empty(t, loaded)
+}
+
+func testQueryEvents(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	events := storeEvents(t, store, "test-1", 3)
+	time.Sleep(10 * time.Millisecond)
+	events = append(events, storeEvents(t, store, "other-1", 2)...)
+
+	cmd := NewCommandRecord("test-1")
+	_, err := store.SaveCommandRecords(ctx, cmd)
+	require.NoError(t, err)
+	errEvent := NewEventRecord("test-1", 4)
+	errEvent.EventType = "EventError"
+	require.NoError(t, store.StoreCommandResults(ctx, cmd.ID, 3, errEvent))
+
+	query := func(q es.EventQuery) []es.EventRecord {
+		loaded, err := store.QueryEvents(ctx, q)
+		require.NoError(t, err)
+		return loaded
+	}
+	loaded := query(es.EventQuery{})
+	require.Equal(t, eventIDs(events), eventIDs(loaded), "EventError must be excluded")
+	for i := 1; i < len(loaded); i++ {
+		require.Greater(t, loaded[i].GlobalPosition, loaded[i-1].GlobalPosition)
+	}
+
+	// the pages of the cursor cover all the events
+	var paged []es.EventRecord
+	for q := (es.EventQuery{Limit: 2}); ; {
+		page := query(q)
+		if len(page) == 0 {
+			break
+		}
+		require.LessOrEqual(t, len(page), 2)
+		paged = append(paged, page...)
+		q.After = page[len(page)-1].GlobalPosition
+	}
+	require.Equal(t, eventIDs(events), eventIDs(paged))
+
+	require.Equal(t, eventIDs(events[:3]), eventIDs(query(es.EventQuery{AggregateID: "test-1"})))
+	require.Equal(t, eventIDs(events[3:]), eventIDs(query(es.EventQuery{Domain: "other"})))
+	require.Equal(t, eventIDs(events[:3]), eventIDs(query(es.EventQuery{CommandID: loaded[0].CommandID})))
+	require.Equal(t, []string{errEvent.ID}, eventIDs(query(es.EventQuery{EventTypes: []string{"EventError"}})))
+	require.Equal(t, eventIDs(events), eventIDs(query(es.EventQuery{EventTypes: []string{"TestEvent", "Missing"}})))
+	require.Empty(t, query(es.EventQuery{EventTypes: []string{"Missing"}}))
+
+	from := loaded[3].CreatedAt
+	require.True(t, from.After(loaded[2].CreatedAt))
+	require.Equal(t, eventIDs(events[3:]), eventIDs(query(es.EventQuery{From: from})))
+	require.Equal(t, eventIDs(events[:3]), eventIDs(query(es.EventQuery{To: from})), "the end of the range is exclusive")
+	require.Equal(t, eventIDs(events[1:3]), eventIDs(query(es.EventQuery{
+		AggregateID: "test-1",
+		To:          from,
+		After:       loaded[0].GlobalPosition,
+		Limit:       5,
+	})), "the filters apply together")
+
+	loaded, err = store.QueryEvents(es.ContextWithTenant(ctx, "acme"), es.EventQuery{})
+	require.NoError(t, err)
+	require.Empty(t, loaded)
+}
+
+func testLoadEvents(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	events := storeEvents(t, store, "test-1", 3)
+	storeEvents(t, store, "test-2", 2)
+
+	cmd := NewCommandRecord("test-1")
+	_, err := store.SaveCommandRecords(ctx, cmd)
+	require.NoError(t, err)
+	errEvent := NewEventRecord("test-1", 4)
+	errEvent.EventType = "EventError"
+	require.NoError(t, store.StoreCommandResults(ctx, cmd.ID, 3, errEvent))
+
+	loaded, err := store.LoadEvents(ctx, "test-1")
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(events), eventIDs(loaded), "EventError must be excluded")
+	commandID := loaded[0].CommandID
+
+	loaded, err = store.LoadEventsFromVersion(ctx, "test-1", 1)
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(events[1:]), eventIDs(loaded))
+
+	loaded, err = store.LoadEventsFromVersion(ctx, "test-1", 4)
+	require.NoError(t, err)
+	require.Empty(t, loaded)
+
+	loaded, err = store.LoadEvents(ctx, "test-3")
+	require.NoError(t, err)
+	require.Empty(t, loaded)
+
+	loaded, err = store.LoadCommandEvents(ctx, commandID)
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(events), eventIDs(loaded))
+	loaded, err = store.LoadCommandEvents(ctx, cmd.ID)
+	require.NoError(t, err)
+	require.Equal(t, []string{errEvent.ID}, eventIDs(loaded), "EventError must be included")
+	loaded, err = store.LoadCommandEvents(ctx, "missing")
+	require.NoError(t, err)
+	require.Empty(t, loaded)
+}
+
+func testSubscriptions(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	sub, err := store.InsertSubscription(ctx, "projection")
+	require.NoError(t, err)
+	require.Equal(t, "projection", sub.Group)
+	require.Equal(t, int64(0), sub.Position)
+
+	items, err := store.SelectEventsForSubscription(ctx, sub, 10)
+	require.NoError(t, err)
+	require.Empty(t, items)
+
+	events := storeEvents(t, store, "test-1", 3)
+
+	items, err = store.SelectEventsForSubscription(ctx, sub, 2)
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(events[:2]), eventIDs(items))
+
+	require.Less(t, items[0].GlobalPosition, items[1].GlobalPosition)
+	sub, err = store.UpdateSubscription(ctx, sub.Group, sub.Position, items[1].GlobalPosition)
+	require.NoError(t, err)
+	require.Equal(t, items[1].GlobalPosition, sub.Position)
+
+	// inserting an existing subscription returns it untouched
+	again, err := store.InsertSubscription(ctx, "projection")
+	require.NoError(t, err)
+	require.Equal(t, items[1].GlobalPosition, again.Position)
+
+	items, err = store.SelectEventsForSubscription(ctx, sub, 10)
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(events[2:]), eventIDs(items))
+
+	// subscriptions are independent
+	other, err := store.InsertSubscription(ctx, "other")
+	require.NoError(t, err)
+	items, err = store.SelectEventsForSubscription(ctx, other, 10)
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(events), eventIDs(items))
+
+	_, err = store.UpdateSubscription(ctx, "missing", 0, 1)
+	require.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func testSubscriptionOrdering(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	var expected []es.EventRecord
+	for i := 0; i < 5; i++ {
+		expected = append(expected, storeEvents(t, store, fmt.Sprintf("test-%d", i%2), 2)...)
+	}
+	cmd := NewCommandRecord("test-0")
+	_, err := store.SaveCommandRecords(ctx, cmd)
+	require.NoError(t, err)
+	version, err := store.GetOrCreateVersion(ctx, "test-0")
+	require.NoError(t, err)
+	errEvent := NewEventRecord("test-0", version+1)
+	errEvent.EventType = "EventError"
+	require.NoError(t, store.StoreCommandResults(ctx, cmd.ID, version, errEvent))
+	expected = append(expected, storeEvents(t, store, "test-1", 1)...)
+
+	sub, err := store.InsertSubscription(ctx, "projection")
+	require.NoError(t, err)
+	var seen []es.EventRecord
+	for {
+		items, err := store.SelectEventsForSubscription(ctx, sub, 3)
+		require.NoError(t, err)
+		if len(items) == 0 {
+			break
+		}
+		require.LessOrEqual(t, len(items), 3)
+		seen = append(seen, items...)
+		sub, err = store.UpdateSubscription(ctx, sub.Group, sub.Position, items[len(items)-1].GlobalPosition)
+		require.NoError(t, err)
+	}
+	require.Equal(t, eventIDs(expected), eventIDs(seen))
+}
+
+// testSubscriptionLateCommit stores an event whose id is lower than the id of
+// an event the subscription has already seen, like a transaction that
+// commits late. The subscription must still receive it.
+func testSubscriptionLateCommit(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	late := NewEventRecord("test-1", 1)
+	cmd := NewCommandRecord("test-1")
+	_, err := store.SaveCommandRecords(ctx, cmd)
+	require.NoError(t, err)
+	_, err = store.GetOrCreateVersion(ctx, "test-1")
+	require.NoError(t, err)
+	early := storeEvents(t, store, "test-2", 1)
+	require.Less(t, late.ID, early[0].ID)
+
+	sub, err := store.InsertSubscription(ctx, "projection")
+	require.NoError(t, err)
+	items, err := store.SelectEventsForSubscription(ctx, sub, 10)
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(early), eventIDs(items))
+	sub, err = store.UpdateSubscription(ctx, sub.Group, sub.Position, items[0].GlobalPosition)
+	require.NoError(t, err)
+
+	require.NoError(t, store.StoreCommandResults(ctx, cmd.ID, 0, late))
+	items, err = store.SelectEventsForSubscription(ctx, sub, 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{late.ID}, eventIDs(items))
+	require.Greater(t, items[0].GlobalPosition, sub.Position)
+}
+
+func testSubscriptionManagement(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	subs, err := store.ListSubscriptions(ctx)
+	require.NoError(t, err)
+	require.Empty(t, subs)
+
+	first := storeEvents(t, store, "test-1", 2)
+	time.Sleep(10 * time.Millisecond)
+	middle := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	second := storeEvents(t, store, "test-2", 2)
+
+	sub, err := store.InsertSubscription(ctx, "projection")
+	require.NoError(t, err)
+	_, err = store.InsertSubscription(ctx, "other")
+	require.NoError(t, err)
+	_, err = store.GetSubscription(ctx, "missing")
+	require.ErrorIs(t, err, es.ErrSubscriptionNotFound)
+
+	position, err := store.GetEventPosition(ctx, first[1].ID)
+	require.NoError(t, err)
+	_, err = store.GetEventPosition(ctx, "missing")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	// the position is not where the caller expects it
+	_, err = store.UpdateSubscription(ctx, sub.Group, sub.Position+1, position)
+	require.ErrorIs(t, err, es.ErrSubscriptionChanged)
+	sub, err = store.UpdateSubscription(ctx, sub.Group, sub.Position, position)
+	require.NoError(t, err)
+	require.Equal(t, position, sub.Position)
+
+	subs, err = store.ListSubscriptions(ctx)
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	require.Equal(t, "other", subs[0].Group)
+	require.Equal(t, int64(4), subs[0].Lag)
+	require.Equal(t, "projection", subs[1].Group)
+	require.Equal(t, int64(2), subs[1].Lag)
+
+	// pausing
+	sub, err = store.SetSubscriptionPaused(ctx, sub.Group, true)
+	require.NoError(t, err)
+	require.True(t, sub.Paused)
+	items, err := store.SelectEventsForSubscription(ctx, sub, 10)
+	require.NoError(t, err)
+	require.Empty(t, items)
+	sub, err = store.SetSubscriptionPaused(ctx, sub.Group, false)
+	require.NoError(t, err)
+	require.False(t, sub.Paused)
+	items, err = store.SelectEventsForSubscription(ctx, sub, 10)
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(second), eventIDs(items))
+	_, err = store.SetSubscriptionPaused(ctx, "missing", true)
+	require.ErrorIs(t, err, es.ErrSubscriptionNotFound)
+
+	// resetting
+	sub, err = store.ResetSubscription(ctx, sub.Group, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), sub.Position)
+	items, err = store.SelectEventsForSubscription(ctx, sub, 10)
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(append(first, second...)), eventIDs(items))
+	_, err = store.ResetSubscription(ctx, "missing", 0)
+	require.ErrorIs(t, err, es.ErrSubscriptionNotFound)
+
+	sub, err = es.ResetSubscriptionToEvent(ctx, store, sub.Group, first[1].ID)
+	require.NoError(t, err)
+	items, err = store.SelectEventsForSubscription(ctx, sub, 10)
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(append(first[1:], second...)), eventIDs(items))
+	_, err = es.ResetSubscriptionToEvent(ctx, store, sub.Group, "missing")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	sub, err = es.ResetSubscriptionToTime(ctx, store, sub.Group, middle)
+	require.NoError(t, err)
+	items, err = store.SelectEventsForSubscription(ctx, sub, 10)
+	require.NoError(t, err)
+	require.Equal(t, eventIDs(second), eventIDs(items))
+
+	// deleting removes the dead letters as well
+	require.NoError(t, store.InsertDeadLetter(ctx, sub.Group, first[0].ID, "error"))
+	require.NoError(t, store.DeleteSubscription(ctx, sub.Group))
+	require.ErrorIs(t, store.DeleteSubscription(ctx, sub.Group), es.ErrSubscriptionNotFound)
+	_, err = store.GetSubscription(ctx, sub.Group)
+	require.ErrorIs(t, err, es.ErrSubscriptionNotFound)
+	sub, err = store.InsertSubscription(ctx, sub.Group)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), sub.Position)
+	deadLetters, err := store.ListDeadLetters(ctx, sub.Group, 0)
+	require.NoError(t, err)
+	require.Empty(t, deadLetters)
+}
+
+func testDeadLetters(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	events := storeEvents(t, store, "test-1", 3)
+	_, err := store.InsertSubscription(ctx, "projection")
+	require.NoError(t, err)
+	_, err = store.InsertSubscription(ctx, "other")
+	require.NoError(t, err)
+
+	items, err := store.ListDeadLetters(ctx, "projection", 0)
+	require.NoError(t, err)
+	require.Empty(t, items)
+
+	require.NoError(t, store.InsertDeadLetter(ctx, "projection", events[2].ID, "first error"))
+	require.NoError(t, store.InsertDeadLetter(ctx, "projection", events[0].ID, "second error"))
+	require.NoError(t, store.InsertDeadLetter(ctx, "other", events[1].ID, "other error"))
+	// dead-lettering again updates the error
+	require.NoError(t, store.InsertDeadLetter(ctx, "projection", events[2].ID, "third error"))
+
+	items, err = store.ListDeadLetters(ctx, "projection", 0)
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	require.Equal(t, "projection", items[0].Group)
+	require.Equal(t, events[0].ID, items[0].Event.ID)
+	require.Equal(t, events[0].AggregateID, items[0].Event.AggregateID)
+	require.Equal(t, events[0].Version, items[0].Event.Version)
+	require.JSONEq(t, string(events[0].Data), string(items[0].Event.Data))
+	require.Equal(t, "second error", items[0].LastError)
+	require.False(t, items[0].CreatedAt.IsZero())
+	require.Equal(t, events[2].ID, items[1].Event.ID)
+	require.Equal(t, "third error", items[1].LastError)
+
+	items, err = store.ListDeadLetters(ctx, "projection", 1)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+
+	require.NoError(t, store.DeleteDeadLetter(ctx, "projection", events[0].ID))
+	require.ErrorIs(t, store.DeleteDeadLetter(ctx, "projection", events[0].ID), es.ErrDeadLetterNotFound)
+	items, err = store.ListDeadLetters(ctx, "projection", 0)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+
+	items, err = store.ListDeadLetters(ctx, "other", 0)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, events[1].ID, items[0].Event.ID)
+}
+
+func testLeases(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	ok, err := store.AcquireLease(ctx, "lease", "a", time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = store.AcquireLease(ctx, "lease", "b", time.Minute)
+	require.NoError(t, err)
+	require.False(t, ok, "the lease is held by another owner")
+	ok, err = store.AcquireLease(ctx, "other", "b", time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok, "leases are independent")
+	ok, err = store.AcquireLease(ctx, "lease", "a", time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok, "the owner renews the lease")
+
+	// only the owner releases the lease
+	require.NoError(t, store.ReleaseLease(ctx, "lease", "b"))
+	ok, err = store.AcquireLease(ctx, "lease", "b", time.Minute)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.NoError(t, store.ReleaseLease(ctx, "lease", "a"))
+	ok, err = store.AcquireLease(ctx, "lease", "b", 500*time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	leases, err := store.ListLeases(ctx, "le")
+	require.NoError(t, err)
+	require.Len(t, leases, 1)
+	require.Equal(t, "lease", leases[0].Name)
+	require.Equal(t, "b", leases[0].Owner)
+	require.True(t, leases[0].ExpiresAt.After(time.Now().Add(-time.Second)))
+	leases, err = store.ListLeases(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, leases, 2)
+
+	// an expired lease can be taken over
+	require.Eventually(t, func() bool {
+		ok, err := store.AcquireLease(ctx, "lease", "a", time.Minute)
+		require.NoError(t, err)
+		return ok
+	}, 3*time.Second, 20*time.Millisecond)
+}
+
+func testSagaInstances(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	_, err := store.GetSagaInstance(ctx, "saga", "1")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	instance := es.SagaInstance{
+		Saga:          "saga",
+		ID:            "1",
+		Status:        es.SagaStatusActive,
+		State:         []byte(`{"step":1}`),
+		Compensations: es.SagaCommands{NewCommandRecord("test-1")},
+		Position:      3,
+		Version:       1,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	cmd := NewCommandRecord("test-2")
+	require.NoError(t, store.SaveSagaInstance(ctx, instance, cmd))
+	_, err = store.GetCommand(ctx, cmd.ID)
+	require.NoError(t, err, "the commands are saved with the instance")
+
+	saved, err := store.GetSagaInstance(ctx, "saga", "1")
+	require.NoError(t, err)
+	require.Equal(t, es.SagaStatusActive, saved.Status)
+	require.JSONEq(t, `{"step":1}`, string(saved.State))
+	require.Len(t, saved.Compensations, 1)
+	require.Equal(t, instance.Compensations[0].ID, saved.Compensations[0].ID)
+	require.Equal(t, instance.Compensations[0].Data, saved.Compensations[0].Data)
+	require.Equal(t, int64(3), saved.Position)
+	require.Equal(t, 1, saved.Version)
+	require.True(t, now.Equal(saved.CreatedAt))
+
+	// the version must follow the stored one
+	other := NewCommandRecord("test-3")
+	require.ErrorIs(t, store.SaveSagaInstance(ctx, instance, other), es.ErrWrongExpectedVersion)
+	_, err = store.GetCommand(ctx, other.ID)
+	require.ErrorIs(t, err, sql.ErrNoRows, "the commands are not saved on conflict")
+
+	saved.Version = 2
+	saved.Status = es.SagaStatusCompleted
+	saved.State = nil
+	saved.Compensations = nil
+	require.NoError(t, store.SaveSagaInstance(ctx, saved))
+	require.ErrorIs(t, store.SaveSagaInstance(ctx, saved), es.ErrWrongExpectedVersion)
+	saved, err = store.GetSagaInstance(ctx, "saga", "1")
+	require.NoError(t, err)
+	require.Equal(t, es.SagaStatusCompleted, saved.Status)
+	require.Empty(t, saved.State)
+	require.Empty(t, saved.Compensations)
+	require.Equal(t, 2, saved.Version)
+
+	// instances are scoped per saga
+	_, err = store.GetSagaInstance(ctx, "other", "1")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func testConcurrentSaveCommandRecords(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	cmd := NewCommandRecord("test-1")
+	const num = 10
+	var wg sync.WaitGroup
+	results := make([][]string, num)
+	for i := 0; i < num; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids, err := store.SaveCommandRecords(ctx, cmd)
+			assert.NoError(t, err)
+			results[i] = ids
+		}(i)
+	}
+	wg.Wait()
+	saved := 0
+	for i := range results {
+		saved += len(results[i])
+	}
+	require.Equal(t, 1, saved, "a command must be saved exactly once")
+}
+
+// testConcurrentEventTimes checks that the times of the events follow their
+// global positions when they are stored concurrently, GetPositionAt relies on it.
+func testConcurrentEventTimes(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	const num = 10
+	records := make([]es.CommandRecord, num)
+	for i := range records {
+		records[i] = NewCommandRecord(fmt.Sprintf("test-%d", i))
+		_, err := store.GetOrCreateVersion(ctx, records[i].AggregateID)
+		require.NoError(t, err)
+	}
+	_, err := store.SaveCommandRecords(ctx, records...)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := range records {
+		wg.Add(1)
+		go func(rec es.CommandRecord) {
+			defer wg.Done()
+			assert.NoError(t, store.StoreCommandResults(ctx, rec.ID, 0,
+				NewEventRecord(rec.AggregateID, 1), NewEventRecord(rec.AggregateID, 2)))
+		}(records[i])
+	}
+	wg.Wait()
+
+	loaded, err := store.QueryEvents(ctx, es.EventQuery{})
+	require.NoError(t, err)
+	require.Len(t, loaded, 2*num)
+	for i := 1; i < len(loaded); i++ {
+		require.False(t, loaded[i].CreatedAt.Before(loaded[i-1].CreatedAt),
+			"event at position %d is older than the one before it", loaded[i].GlobalPosition)
+		position, err := store.GetPositionAt(ctx, loaded[i].CreatedAt.Add(time.Microsecond))
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, position, loaded[i].GlobalPosition)
+	}
+}
+
+func testConcurrentStoreCommandResults(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	const num = 10
+	records := make([]es.CommandRecord, num)
+	for i := range records {
+		records[i] = NewCommandRecord("test-1")
+	}
+	_, err := store.SaveCommandRecords(ctx, records...)
+	require.NoError(t, err)
+	_, err = store.GetOrCreateVersion(ctx, "test-1")
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := range records {
+		wg.Add(1)
+		go func(rec es.CommandRecord) {
+			defer wg.Done()
+			err := store.StoreCommandResults(ctx, rec.ID, 0, NewEventRecord(rec.AggregateID, 1))
+			if err != nil {
+				assert.ErrorIs(t, err, es.ErrWrongExpectedVersion)
+				return
+			}
+			mu.Lock()
+			succeeded++
+			mu.Unlock()
+		}(records[i])
+	}
+	wg.Wait()
+	require.Equal(t, 1, succeeded, "exactly one writer must win")
+
+	loaded, err := store.LoadEvents(ctx, "test-1")
+	require.NoError(t, err)
+	require.Len(t, loaded, 1)
+	version, err := store.GetOrCreateVersion(ctx, "test-1")
+	require.NoError(t, err)
+	require.Equal(t, 1, version)
+}
+
+func testConcurrentGetOrCreate(t *testing.T, store es.EventStore) {
+	ctx := context.Background()
+	const num = 10
+	var wg sync.WaitGroup
+	for i := 0; i < num; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			version, err := store.GetOrCreateVersion(ctx, "test-1")
+			assert.NoError(t, err)
+			assert.Equal(t, 0, version)
+		}()
+		go func() {
+			defer wg.Done()
+			sub, err := store.InsertSubscription(ctx, "projection")
+			assert.NoError(t, err)
+			assert.Equal(t, "projection", sub.Group)
+		}()
+	}
+	wg.Wait()
+}
+
+func testKeys(t *testing.T, store es.EventStore) {
+	keys, ok := store.(es.KeyStore)
+	if !ok {
+		t.Skip("event store does not implement es.KeyStore")
+	}
+	ctx := context.Background()
+	acme := es.ContextWithTenant(ctx, "acme")
+	_, err := keys.GetKey(ctx, "user-1")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	key, err := keys.GetOrCreateKey(ctx, "user-1")
+	require.NoError(t, err)
+	require.Len(t, key, es.DataKeySize)
+	again, err := keys.GetOrCreateKey(ctx, "user-1")
+	require.NoError(t, err)
+	require.Equal(t, key, again)
+	got, err := keys.GetKey(ctx, "user-1")
+	require.NoError(t, err)
+	require.Equal(t, key, got)
+
+	// the keys of the tenants are separate
+	_, err = keys.GetKey(acme, "user-1")
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	acmeKey, err := keys.GetOrCreateKey(acme, "user-1")
+	require.NoError(t, err)
+	require.NotEqual(t, key, acmeKey)
+
+	if snapshots, ok := store.(es.SnapshotStore); ok {
+		// the order has an event with the personal data of the subject
+		cmd := NewCommandRecord("order-1")
+		_, err := store.SaveCommandRecords(ctx, cmd)
+		require.NoError(t, err)
+		_, err = store.GetOrCreateVersion(ctx, "order-1")
+		require.NoError(t, err)
+		event := NewEventRecord("order-1", 1)
+		event.Metadata = es.Metadata{es.MetadataSubject: "user-1"}
+		require.NoError(t, store.StoreCommandResults(ctx, cmd.ID, 0, event))
+		for _, aggregateID := range []string{"user-1", "order-1", "order-2"} {
+			snapshot := es.Snapshot{AggregateID: aggregateID, AggregateType: "test", Version: 1, SchemaVersion: 1,
+				Data: []byte(`{"name":"alice"}`), CreatedAt: time.Now().UTC()}
+			require.NoError(t, snapshots.SaveSnapshot(ctx, snapshot))
+			require.NoError(t, snapshots.SaveSnapshot(acme, snapshot))
+		}
+		defer func() {
+			_, err := snapshots.LoadSnapshot(ctx, "user-1")
+			require.ErrorIs(t, err, es.ErrSnapshotNotFound, "the snapshot of the subject is deleted")
+			_, err = snapshots.LoadSnapshot(ctx, "order-1")
+			require.ErrorIs(t, err, es.ErrSnapshotNotFound, "the snapshots with events of the subject are deleted")
+			_, err = snapshots.LoadSnapshot(ctx, "order-2")
+			require.NoError(t, err)
+			_, err = snapshots.LoadSnapshot(acme, "order-1")
+			require.NoError(t, err)
+		}()
+	}
+	require.NoError(t, keys.ForgetSubject(ctx, "user-1"))
+	_, err = keys.GetKey(ctx, "user-1")
+	require.ErrorIs(t, err, es.ErrSubjectForgotten)
+	_, err = keys.GetOrCreateKey(ctx, "user-1")
+	require.ErrorIs(t, err, es.ErrSubjectForgotten)
+	got, err = keys.GetKey(acme, "user-1")
+	require.NoError(t, err)
+	require.Equal(t, acmeKey, got)
+
+	// a subject can be forgotten before it has a key
+	require.NoError(t, keys.ForgetSubject(ctx, "user-2"))
+	_, err = keys.GetOrCreateKey(ctx, "user-2")
+	require.ErrorIs(t, err, es.ErrSubjectForgotten)
+	require.NoError(t, keys.ForgetSubject(ctx, "user-2"))
+}
+
+func testSnapshots(t *testing.T, store es.EventStore) {
+	snapshots, ok := store.(es.SnapshotStore)
+	if !ok {
+		t.Skip("event store does not implement es.SnapshotStore")
+	}
+	ctx := context.Background()
+	_, err := snapshots.LoadSnapshot(ctx, "test-1")
+	require.ErrorIs(t, err, es.ErrSnapshotNotFound)
+
+	snapshot := es.Snapshot{
+		AggregateID:   "test-1",
+		AggregateType: "test",
+		Version:       10,
+		SchemaVersion: 1,
+		Data:          []byte(`{"value":10}`),
+		CreatedAt:     time.Now().UTC(),
+	}
+	require.NoError(t, snapshots.SaveSnapshot(ctx, snapshot))
+
+	// an older snapshot does not replace a newer one
+	older := snapshot
+	older.Version = 5
+	older.Data = []byte(`{"value":5}`)
+	require.NoError(t, snapshots.SaveSnapshot(ctx, older))
+
+	got, err := snapshots.LoadSnapshot(ctx, "test-1")
+	require.NoError(t, err)
+	require.Equal(t, 10, got.Version)
+	require.JSONEq(t, `{"value":10}`, string(got.Data))
+
+	// a new schema version always replaces the snapshot
+	changed := older
+	changed.SchemaVersion = 2
+	require.NoError(t, snapshots.SaveSnapshot(ctx, changed))
+	got, err = snapshots.LoadSnapshot(ctx, "test-1")
+	require.NoError(t, err)
+	require.Equal(t, 5, got.Version)
+	require.Equal(t, 2, got.SchemaVersion)
+}
+
+func testNotifications(t *testing.T, store es.EventStore) {
+	trigger, ok := store.(es.Trigger)
+	if !ok {
+		t.Skip("event store does not implement es.Trigger")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	commands, err := trigger.Subscribe(ctx, es.CommandsChannel)
+	require.NoError(t, err)
+	events, err := trigger.Subscribe(ctx, es.EventsChannel)
+	require.NoError(t, err)
+
+	received := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		case <-time.After(5 * time.Second):
+			return false
+		}
+	}
+	cmd := NewCommandRecord("test-1")
+	_, err = store.SaveCommandRecords(ctx, cmd)
+	require.NoError(t, err)
+	require.True(t, received(commands), "no notification for the new command")
+
+	_, err = store.GetOrCreateVersion(ctx, cmd.AggregateID)
+	require.NoError(t, err)
+	require.NoError(t, store.StoreCommandResults(ctx, cmd.ID, 0, NewEventRecord(cmd.AggregateID, 1)))
+	require.True(t, received(events), "no notification for the new event")
+}
@@ -0,0 +1,148 @@
+package estest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/gosom/kit/es"
+)
+
+// CommandFixture is a given/when/then harness for testing commands and the
+// events they produce without an event store.
+//
+//	estest.NewCommandFixture(t, registry, "todo").
+//		Given(&todo.TodoCreated{ID: id, Title: "title"}).
+//		When(&todo.UpdateTodoStatus{ID: id, Status: "completed"}).
+//		Then(&todo.TodoStatusUpdated{ID: id, Status: "completed"})
+type CommandFixture struct {
+	t        testing.TB
+	registry *es.Registry
+	domain   string
+	given    []es.IEvent
+}
+
+// NewCommandFixture creates a fixture for commands of the given domain.
+// All the commands and events used must be registered in the registry.
+func NewCommandFixture(t testing.TB, registry *es.Registry, domain string) *CommandFixture {
+	return &CommandFixture{
+		t:        t,
+		registry: registry,
+		domain:   domain,
+	}
+}
+
+// Given sets the events that happened before the command.
+// Events without an aggregate ID belong to the aggregate of the command.
+func (f *CommandFixture) Given(events ...es.IEvent) *CommandFixture {
+	ans := *f
+	ans.given = append(append([]es.IEvent{}, f.given...), events...)
+	return &ans
+}
+
+// When prepares the command the same way the command processor does and
+// handles it.
+func (f *CommandFixture) When(cmd es.ICommand) *CommandResult {
+	f.t.Helper()
+	ctx := context.Background()
+	rec, err := f.registry.EncodeCommand(f.domain, cmd)
+	if err != nil {
+		return &CommandResult{t: f.t, err: err}
+	}
+	_, ok := f.registry.GetCommand(rec.EventType)
+	require.True(f.t, ok, "command %s is not registered", rec.EventType)
+	prepared, err := es.CommandRecordToCommand(f.registry, rec)
+	require.NoError(f.t, err, "command %s cannot be decoded", rec.EventType)
+
+	loader := &fixtureLoader{events: make(map[string][]es.IEvent)}
+	for _, ev := range f.given {
+		aggregateID := ev.GetAggregateID()
+		if aggregateID == "" {
+			aggregateID = rec.AggregateID
+		}
+		loader.events[aggregateID] = append(loader.events[aggregateID], f.replay(aggregateID, len(loader.events[aggregateID])+1, ev))
+	}
+	events, err := prepared.Handle(ctx, loader)
+	return &CommandResult{t: f.t, events: events, err: err}
+}
+
+// replay passes the given event through the registry, like events loaded
+// from the event store.
+func (f *CommandFixture) replay(aggregateID string, version int, ev es.IEvent) es.IEvent {
+	f.t.Helper()
+	ev.SetID(fmt.Sprintf("given-%s-%d", aggregateID, version))
+	ev.SetAggregateID(aggregateID)
+	ev.SetEventType(eventType(ev))
+	ev.SetVersion(version)
+	rec, err := f.registry.EncodeEvent(ev)
+	require.NoError(f.t, err)
+	rec.SchemaVersion = f.registry.EventSchemaVersion(rec.EventType)
+	ans, err := es.EventRecordToEvent(f.registry, rec)
+	require.NoError(f.t, err, "given event %s cannot be decoded", rec.EventType)
+	return ans
+}
+
+// CommandResult holds the outcome of a command handled by a CommandFixture.
+type CommandResult struct {
+	t      testing.TB
+	events []es.IEvent
+	err    error
+}
+
+// Then asserts that the command succeeded and produced the expected events.
+// Events are compared by type and payload.
+func (r *CommandResult) Then(expected ...es.IEvent) {
+	r.t.Helper()
+	require.NoError(r.t, r.err, "command failed")
+	require.Equal(r.t, describeEvents(r.t, expected), describeEvents(r.t, r.events))
+}
+
+// ThenError asserts that the command failed with the expected error.
+// Errors match when errors.Is reports a match or when their messages are equal.
+func (r *CommandResult) ThenError(expected error) {
+	r.t.Helper()
+	require.Error(r.t, r.err, "command succeeded with events:\n%s", describeEvents(r.t, r.events))
+	if errors.Is(r.err, expected) {
+		return
+	}
+	require.EqualError(r.t, r.err, expected.Error())
+}
+
+// Events returns the produced events.
+func (r *CommandResult) Events() []es.IEvent {
+	return r.events
+}
+
+// Err returns the error of the command.
+func (r *CommandResult) Err() error {
+	return r.err
+}
+
+type fixtureLoader struct {
+	events map[string][]es.IEvent
+}
+
+func (l *fixtureLoader) Load(ctx context.Context, aggregateID string, agg es.AggregateRoot) error {
+	return es.Load(agg, l.events[aggregateID])
+}
+
+func eventType(ev es.IEvent) string {
+	return reflect.TypeOf(ev).Elem().Name()
+}
+
+// describeEvents renders the events in a form that produces readable diffs.
+func describeEvents(t testing.TB, events []es.IEvent) []string {
+	t.Helper()
+	ans := make([]string, len(events))
+	for i := range events {
+		data, err := json.MarshalIndent(events[i], "", "  ")
+		require.NoError(t, err)
+		ans[i] = eventType(events[i]) + " " + string(data)
+	}
+	return ans
+}
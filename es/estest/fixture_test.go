@@ -0,0 +1,110 @@
+package estest_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/gosom/kit/es"
+	"github.com/gosom/kit/es/estest"
+)
+
+var errClosed = errors.New("account is closed")
+
+type account struct {
+	*es.AggregateBase
+	Balance int
+	Closed  bool
+}
+
+type deposit struct {
+	es.CommandBase
+	ID     string `json:"id" aggregateID:"true" validate:"required"`
+	Amount int    `json:"amount" validate:"required,gt=0"`
+}
+
+func (c *deposit) Handle(ctx context.Context, h es.AggregateLoader) ([]es.IEvent, error) {
+	base, _ := es.NewAggregateBase()
+	agg := &account{AggregateBase: base}
+	if err := h.Load(ctx, c.GetAggregateID(), agg); err != nil {
+		return nil, err
+	}
+	if agg.Closed {
+		return nil, errClosed
+	}
+	return []es.IEvent{&deposited{Amount: c.Amount, Balance: agg.Balance + c.Amount}}, nil
+}
+
+type deposited struct {
+	es.EventBase
+	Amount  int `json:"amount"`
+	Balance int `json:"balance"`
+}
+
+func (e *deposited) Apply(agg es.AggregateRoot) error {
+	agg.(*account).Balance = e.Balance
+	return nil
+}
+
+type closed struct {
+	es.EventBase
+}
+
+func (e *closed) Apply(agg es.AggregateRoot) error {
+	agg.(*account).Closed = true
+	return nil
+}
+
+func newRegistry() *es.Registry {
+	reg := es.NewRegistry()
+	reg.RegisterCommand("deposit", func(data []byte) (es.ICommand, error) {
+		var item deposit
+		return &item, json.Unmarshal(data, &item)
+	})
+	reg.RegisterEvent("deposited", func(data []byte) (es.IEvent, error) {
+		var item deposited
+		return &item, json.Unmarshal(data, &item)
+	})
+	reg.RegisterEvent("closed", func(data []byte) (es.IEvent, error) {
+		var item closed
+		return &item, json.Unmarshal(data, &item)
+	})
+	return reg
+}
+
+func TestCommandFixture(t *testing.T) {
+	fixture := estest.NewCommandFixture(t, newRegistry(), "account")
+	t.Run("WithoutHistory", func(t *testing.T) {
+		fixture.
+			When(&deposit{ID: "1", Amount: 10}).
+			Then(&deposited{Amount: 10, Balance: 10})
+	})
+	t.Run("WithHistory", func(t *testing.T) {
+		fixture.
+			Given(&deposited{Amount: 10, Balance: 10}, &deposited{Amount: 5, Balance: 15}).
+			When(&deposit{ID: "1", Amount: 5}).
+			Then(&deposited{Amount: 5, Balance: 20})
+	})
+	t.Run("HistoryOfOtherAggregate", func(t *testing.T) {
+		other := &closed{}
+		other.SetAggregateID("account-2")
+		fixture.
+			Given(other).
+			When(&deposit{ID: "1", Amount: 5}).
+			Then(&deposited{Amount: 5, Balance: 5})
+	})
+	t.Run("DomainError", func(t *testing.T) {
+		fixture.
+			Given(&deposited{Amount: 10, Balance: 10}, &closed{}).
+			When(&deposit{ID: "1", Amount: 5}).
+			ThenError(errClosed)
+	})
+	t.Run("InvalidCommand", func(t *testing.T) {
+		result := fixture.When(&deposit{ID: "1"})
+		require.ErrorIs(t, result.Err(), es.ErrInvalidCommand)
+		require.Empty(t, result.Events())
+	})
+}
@@ -1,8 +1,10 @@
 package es
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"strings"
+	"time"
 )
 
 // EventBase is the base struct for all events.
@@ -40,17 +42,70 @@ func (e *EventBase) Apply(aggregate AggregateRoot) error {
 
 type EventRecord struct {
 	RecordBase
-	CommandID string
-	Version   int
+	CommandID     string
+	Version       int
+	SchemaVersion int
+	// GlobalPosition orders all the events of the store in commit order.
+	// It is assigned by the event store.
+	GlobalPosition int64
+	CorrelationID  string
+	CausationID    string
+	Metadata       Metadata
+	// Tenant is the tenant of the command that produced the event.
+	Tenant string
+	// Codec is the name of the codec of Data, see Registry.EncodeEvent.
+	Codec string
 }
 
 func (o *EventRecord) Bind() []any {
 	ans := o.RecordBase.Bind()
-	return append(ans, &o.CommandID, &o.Version)
+	return append(ans, &o.CommandID, &o.Version, &o.SchemaVersion, &o.GlobalPosition, &o.CorrelationID, &o.CausationID,
+		&o.Metadata, &o.Tenant, &o.Codec)
 }
 
+// Correlation returns the correlation of the event.
+func (o *EventRecord) Correlation() Correlation {
+	return Correlation{CorrelationID: o.CorrelationID, CausationID: o.CausationID}
+}
+
+// SetCorrelation sets the correlation of the event.
+func (o *EventRecord) SetCorrelation(c Correlation) {
+	o.CorrelationID, o.CausationID = c.CorrelationID, c.CausationID
+}
+
+// Domain returns the domain of the event, the prefix of its aggregate ID.
+func (o *EventRecord) Domain() string {
+	domain, _, _ := strings.Cut(o.AggregateID, "-")
+	return domain
+}
+
+// EventQuery selects the events of EventStore.QueryEvents, its zero fields
+// do not filter.
+type EventQuery struct {
+	AggregateID string
+	// Domain selects the events of the aggregates of the domain, see EventRecord.Domain.
+	Domain string
+	// EventTypes selects the events of any of the types. EventError is only
+	// selected when it is one of them.
+	EventTypes []string
+	CommandID  string
+	// From and To select the events stored at or after From and before To.
+	From time.Time
+	To   time.Time
+	// After is the cursor of the query, it selects the events with a greater
+	// global position.
+	After int64
+	// Limit is the maximum number of events, 0 selects all of them.
+	Limit int
+}
+
+// EventToEventRecord converts an event to a JSON encoded event record.
 func EventToEventRecord(ev IEvent) (EventRecord, error) {
-	data, err := json.Marshal(ev)
+	return eventToEventRecord(ev, JSON)
+}
+
+func eventToEventRecord(ev IEvent, codec Codec) (EventRecord, error) {
+	data, err := codec.Marshal(ev)
 	if err != nil {
 		return EventRecord{}, err
 	}
@@ -61,15 +116,20 @@ func EventToEventRecord(ev IEvent) (EventRecord, error) {
 			EventType:   ev.GetEventType(),
 			Data:        data,
 		},
-		Version: ev.GetVersion(),
+		Version:  ev.GetVersion(),
+		Metadata: ev.GetMetadata(),
+		Codec:    codec.Name(),
 	}, nil
 }
 
+// EventRecordsToEvents decodes the events of the records, see
+// EventRecordToEvent. The data key of every subject is read once.
 func EventRecordsToEvents(registry *Registry, records []EventRecord) ([]IEvent, error) {
 	var err error
 	ans := make([]IEvent, len(records))
+	cache := make(keyCache)
 	for i := range records {
-		ans[i], err = EventRecordToEvent(registry, records[i])
+		ans[i], err = eventRecordToEvent(registry, records[i], cache)
 		if err != nil {
 			return nil, err
 		}
@@ -77,19 +137,33 @@ func EventRecordsToEvents(registry *Registry, records []EventRecord) ([]IEvent,
 	return ans, nil
 }
 
+// EventRecordToEvent decodes the event of the record. Its personal data is
+// decrypted, the personal data of forgotten subjects is Redacted.
 func EventRecordToEvent(registry *Registry, record EventRecord) (IEvent, error) {
-	convFn, ok := registry.GetEvent(record.EventType)
-	if !ok {
+	return eventRecordToEvent(registry, record, make(keyCache))
+}
+
+func eventRecordToEvent(registry *Registry, record EventRecord, cache keyCache) (IEvent, error) {
+	if _, ok := registry.GetEvent(record.EventType); !ok {
 		return nil, fmt.Errorf("event type %s not found in registry", record.EventType)
 	}
-	ev, err := convFn(record.Data)
+	data, err := registry.Upcast(record.EventType, record.SchemaVersion, record.Data)
+	if err != nil {
+		return nil, err
+	}
+	ev, err := registry.DecodeEvent(record.Codec, record.EventType, data)
 	if err != nil {
 		return nil, err
 	}
-	ev.SetVersion(record.Version)
 	ev.SetID(record.ID)
 	ev.SetEventType(record.EventType)
 	ev.SetVersion(record.Version)
 	ev.SetAggregateID(record.AggregateID)
+	ev.SetMetadata(record.Metadata)
+	// the keys belong to the tenant of the event
+	ctx := ContextWithTenant(context.Background(), record.Tenant)
+	if err := registry.decryptEvent(ctx, ev, cache); err != nil {
+		return nil, err
+	}
 	return ev, nil
 }
@@ -0,0 +1,113 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// LoadAggregateUntil loads the aggregate as it was at the given version and
+// time, see EventStore.LoadEventsUntil. A zero version or time does not bound
+// the events. Snapshots are not used, they hold the latest state.
+func LoadAggregateUntil(ctx context.Context, store EventStore, registry *Registry, aggregateID string, version int, at time.Time, agg AggregateRoot) error {
+	records, err := store.LoadEventsUntil(ctx, aggregateID, version, at)
+	if err != nil {
+		return err
+	}
+	events, err := EventRecordsToEvents(registry, records)
+	if err != nil {
+		return err
+	}
+	return Load(agg, events)
+}
+
+// Change is a value that differs between two states. The path joins the
+// JSON field names and the array indexes with dots, it is empty for the
+// whole state. From is nil for added values and To for removed ones.
+type Change struct {
+	Path string `json:"path"`
+	From any    `json:"from"`
+	To   any    `json:"to"`
+}
+
+// Diff returns the changes from one state to the other, sorted by path.
+// The states are compared by their JSON encoding.
+func Diff(from, to any) ([]Change, error) {
+	a, err := toJSONValue(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := toJSONValue(to)
+	if err != nil {
+		return nil, err
+	}
+	ans := []Change{}
+	diff("", a, b, &ans)
+	sort.Slice(ans, func(i, j int) bool {
+		return ans[i].Path < ans[j].Path
+	})
+	return ans, nil
+}
+
+func toJSONValue(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var ans any
+	return ans, json.Unmarshal(data, &ans)
+}
+
+func diff(path string, from, to any, changes *[]Change) {
+	switch a := from.(type) {
+	case map[string]any:
+		b, ok := to.(map[string]any)
+		if !ok {
+			break
+		}
+		for k, v := range a {
+			w, ok := b[k]
+			if !ok {
+				*changes = append(*changes, Change{Path: join(path, k), From: v})
+				continue
+			}
+			diff(join(path, k), v, w, changes)
+		}
+		for k, w := range b {
+			if _, ok := a[k]; !ok {
+				*changes = append(*changes, Change{Path: join(path, k), To: w})
+			}
+		}
+		return
+	case []any:
+		b, ok := to.([]any)
+		if !ok {
+			break
+		}
+		for i := 0; i < len(a) || i < len(b); i++ {
+			p := join(path, strconv.Itoa(i))
+			switch {
+			case i >= len(b):
+				*changes = append(*changes, Change{Path: p, From: a[i]})
+			case i >= len(a):
+				*changes = append(*changes, Change{Path: p, To: b[i]})
+			default:
+				diff(p, a[i], b[i], changes)
+			}
+		}
+		return
+	}
+	if !reflect.DeepEqual(from, to) {
+		*changes = append(*changes, Change{Path: path, From: from, To: to})
+	}
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
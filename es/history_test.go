@@ -0,0 +1,113 @@
+package es_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gosom/kit/es"
+	"github.com/gosom/kit/es/mock"
+	"github.com/gosom/kit/lib"
+	"github.com/stretchr/testify/require"
+)
+
+type counterIncremented struct {
+	es.EventBase
+	By int `json:"by"`
+}
+
+func (e *counterIncremented) Apply(agg es.AggregateRoot) error {
+	agg.(*counterAggregate).Count += e.By
+	return nil
+}
+
+func TestLoadAggregateUntil(t *testing.T) {
+	ctx := context.Background()
+	store := mock.NewEventStore()
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	store.Now = func() time.Time {
+		return now
+	}
+	reg := es.NewRegistry()
+	require.NoError(t, es.RegisterEvent[counterIncremented](reg))
+
+	increment := func(version int, by int) {
+		cmd, err := es.CommandToCommandRecord("counter", &placeOrder{ID: "1", Quantity: 1})
+		require.NoError(t, err)
+		_, err = store.SaveCommandRecords(ctx, cmd)
+		require.NoError(t, err)
+		_, err = store.GetOrCreateVersion(ctx, "counter-1")
+		require.NoError(t, err)
+		ev := &counterIncremented{By: by}
+		ev.SetID(lib.MustNewULID())
+		ev.SetEventType("counterIncremented")
+		ev.SetAggregateID("counter-1")
+		ev.SetVersion(version)
+		rec, err := reg.EncodeEvent(ev)
+		require.NoError(t, err)
+		require.NoError(t, store.StoreCommandResults(ctx, cmd.ID, version-1, rec))
+	}
+	load := func(version int, at time.Time) *counterAggregate {
+		agg := newCounterAggregate(0)
+		require.NoError(t, es.LoadAggregateUntil(ctx, store, reg, "counter-1", version, at, agg))
+		return agg
+	}
+	increment(1, 1)
+	increment(2, 10)
+	now = now.Add(time.Hour)
+	increment(3, 100)
+
+	require.Equal(t, 111, load(0, time.Time{}).Count)
+	require.Equal(t, 1, load(1, time.Time{}).Count)
+	require.Equal(t, uint64(2), load(2, time.Time{}).GetVersion())
+	require.Equal(t, 11, load(0, start).Count)
+	require.Equal(t, 1, load(1, start).Count)
+	require.Equal(t, 111, load(0, now).Count)
+	require.Equal(t, uint64(0), load(0, start.Add(-time.Second)).GetVersion())
+
+	changes, err := es.Diff(load(1, time.Time{}), load(3, time.Time{}))
+	require.NoError(t, err)
+	require.Equal(t, []es.Change{
+		{Path: "Count", From: 1.0, To: 111.0},
+		{Path: "Version", From: 1.0, To: 3.0},
+	}, changes)
+}
+
+func TestDiff(t *testing.T) {
+	type item struct {
+		Title string `json:"title"`
+	}
+	type state struct {
+		Name  string            `json:"name"`
+		Items []item            `json:"items"`
+		Tags  map[string]string `json:"tags"`
+	}
+	from := state{
+		Name:  "todo",
+		Items: []item{{Title: "a"}, {Title: "b"}},
+		Tags:  map[string]string{"color": "red", "size": "s"},
+	}
+	to := state{
+		Name:  "todo",
+		Items: []item{{Title: "a"}, {Title: "c"}, {Title: "d"}},
+		Tags:  map[string]string{"color": "blue", "owner": "alice"},
+	}
+	changes, err := es.Diff(from, to)
+	require.NoError(t, err)
+	require.Equal(t, []es.Change{
+		{Path: "items.1.title", From: "b", To: "c"},
+		{Path: "items.2", To: map[string]any{"title": "d"}},
+		{Path: "tags.color", From: "red", To: "blue"},
+		{Path: "tags.owner", To: "alice"},
+		{Path: "tags.size", From: "s"},
+	}, changes)
+
+	changes, err = es.Diff(from, from)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+
+	changes, err = es.Diff(nil, from.Items[0])
+	require.NoError(t, err)
+	require.Equal(t, []es.Change{{Path: "", To: map[string]any{"title": "a"}}}, changes)
+}
@@ -92,6 +92,7 @@ func (o *Consumer) processMessage(ctx context.Context, msg *kafka.Message) (err
 	backoff := 20 * time.Millisecond
 	factor := 2
 	maxWait := 5 * time.Second
+	ctx = es.ContextWithHeaders(ctx, fromKafkaHeaders(msg.Headers))
 	for {
 		err = o.worker.Process(ctx, msg.Key, msg.Value, msg.Timestamp)
 		//err = fmt.Errorf("artificial error")
@@ -11,6 +11,22 @@ import (
 	"github.com/gosom/kit/logging"
 )
 
+func toKafkaHeaders(headers map[string]string) []kafka.Header {
+	ans := make([]kafka.Header, 0, len(headers))
+	for k, v := range headers {
+		ans = append(ans, kafka.Header{Key: k, Value: []byte(v)})
+	}
+	return ans
+}
+
+func fromKafkaHeaders(headers []kafka.Header) map[string]string {
+	ans := make(map[string]string, len(headers))
+	for _, h := range headers {
+		ans[h.Key] = string(h.Value)
+	}
+	return ans
+}
+
 type Dispatcher struct {
 	log      logging.Logger
 	domain   string
@@ -49,7 +65,16 @@ func (d *Dispatcher) DispatchCommandRequest(ctx context.Context, request es.Comm
 }
 
 func (d *Dispatcher) DispatchCommand(ctx context.Context, command es.ICommand) (string, error) {
-	cr, err := es.CommandToCommandRecord(d.domain, command)
+	cr, err := d.registry.EncodeCommand(d.domain, command)
+	if err != nil {
+		return "", err
+	}
+	cr.SetCorrelation(es.CorrelationFromContext(ctx))
+	cr.Metadata = es.MetadataFromContext(ctx).Merge(cr.Metadata)
+	if cr.Tenant == "" {
+		cr.Tenant = es.TenantFromContext(ctx)
+	}
+	cr, err = d.registry.EncryptCommandRecord(ctx, cr)
 	if err != nil {
 		return "", err
 	}
@@ -62,8 +87,9 @@ func (d *Dispatcher) DispatchCommand(ctx context.Context, command es.ICommand) (
 			Topic:     &d.topic,
 			Partition: kafka.PartitionAny,
 		},
-		Key:   []byte(cr.AggregateID),
-		Value: msg.Data,
+		Key:     []byte(cr.AggregateID),
+		Value:   msg.Data,
+		Headers: toKafkaHeaders(msg.Headers),
 	}
 	switch d.ack {
 	case true:
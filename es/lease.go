@@ -0,0 +1,88 @@
+package es
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gosom/kit/logging"
+)
+
+// DefaultLeaseTTL is how long a lease is held without being renewed.
+const DefaultLeaseTTL = 30 * time.Second
+
+var errLeaseLost = errors.New("lease lost")
+
+// Lease is a named lock of the event store held by an owner until it expires.
+type Lease struct {
+	Name      string
+	Owner     string
+	ExpiresAt time.Time
+}
+
+func (o *Lease) Bind() []any {
+	return []any{&o.Name, &o.Owner, &o.ExpiresAt}
+}
+
+// leaseHolder holds a lease of the event store so that only one instance
+// does the work guarded by it. The lease is renewed when a third of the
+// ttl has elapsed.
+type leaseHolder struct {
+	store     EventStore
+	name      string
+	owner     string
+	ttl       time.Duration
+	held      bool
+	renewAt   time.Time
+	expiresAt time.Time
+	log       logging.Logger
+}
+
+func newLeaseHolder(store EventStore, name string, owner string, ttl time.Duration, log logging.Logger) *leaseHolder {
+	return &leaseHolder{
+		store: store,
+		name:  name,
+		owner: owner,
+		ttl:   ttl,
+		log:   log.With("lease", name),
+	}
+}
+
+// hold acquires or renews the lease when needed and reports whether it is held.
+func (l *leaseHolder) hold(ctx context.Context) bool {
+	now := time.Now()
+	if l.held && now.Before(l.renewAt) {
+		return true
+	}
+	ok, err := l.store.AcquireLease(ctx, l.name, l.owner, l.ttl)
+	if err != nil {
+		l.log.Error("cannot acquire lease", "error", err)
+		// the lease is still ours until it expires
+		return l.held && now.Before(l.expiresAt)
+	}
+	switch {
+	case ok && !l.held:
+		l.log.Info("lease acquired", "owner", l.owner)
+	case !ok && l.held:
+		l.log.Warn("lease lost", "owner", l.owner)
+	}
+	l.held = ok
+	if ok {
+		l.expiresAt = now.Add(l.ttl)
+		l.renewAt = now.Add(l.ttl / 3)
+	}
+	return ok
+}
+
+// release releases the lease if it is held.
+func (l *leaseHolder) release() {
+	if !l.held {
+		return
+	}
+	l.held = false
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := l.store.ReleaseLease(ctx, l.name, l.owner); err != nil {
+		l.log.Error("cannot release lease", "error", err)
+	}
+}
@@ -1,27 +1,64 @@
 package es
 
 import (
+	"context"
 	"encoding/json"
+	"strings"
 	"time"
 )
 
+// The headers of a bus message. They carry the correlation, the tenant, the
+// codec and the metadata of the command so that consumers can read them
+// without decoding it.
+const (
+	CorrelationIDHeader = "correlation_id"
+	CausationIDHeader   = "causation_id"
+	TenantHeader        = "tenant"
+	CodecHeader         = "codec"
+	// MetadataHeaderPrefix is prepended to the metadata keys.
+	MetadataHeaderPrefix = "metadata."
+)
+
 type BusMessage struct {
 	Key       []byte
 	Data      []byte
 	Timestamp time.Time
+	Headers   map[string]string
 }
 
+// CommandRecordToBusMessage encodes the command record as JSON. The payload
+// keeps its codec, so binary payloads travel base64 encoded.
 func CommandRecordToBusMessage(cr CommandRecord) (BusMessage, error) {
 	data, err := json.Marshal(cr)
 	if err != nil {
 		return BusMessage{}, err
 	}
+	headers := make(map[string]string, len(cr.Metadata)+4)
+	if cr.CorrelationID != "" {
+		headers[CorrelationIDHeader] = cr.CorrelationID
+	}
+	if cr.CausationID != "" {
+		headers[CausationIDHeader] = cr.CausationID
+	}
+	if cr.Tenant != "" {
+		headers[TenantHeader] = cr.Tenant
+	}
+	if cr.Codec != "" {
+		headers[CodecHeader] = cr.Codec
+	}
+	for k, v := range cr.Metadata {
+		headers[MetadataHeaderPrefix+k] = v
+	}
 	return BusMessage{
-		Key:  []byte(cr.AggregateID),
-		Data: data,
+		Key:     []byte(cr.AggregateID),
+		Data:    data,
+		Headers: headers,
 	}, nil
 }
 
+// BusMessageToCommandRecord decodes the command of the message. The headers
+// fill the correlation, the tenant, the codec and the metadata that the
+// command does not have.
 func BusMessageToCommandRecord(msg BusMessage, cr *CommandRecord) error {
 	err := json.Unmarshal(msg.Data, cr)
 	if err != nil {
@@ -33,6 +70,23 @@ func BusMessageToCommandRecord(msg BusMessage, cr *CommandRecord) error {
 	default:
 		cr.CreatedAt = msg.Timestamp
 	}
+	if cr.CorrelationID == "" {
+		cr.CorrelationID = msg.Headers[CorrelationIDHeader]
+		cr.CausationID = msg.Headers[CausationIDHeader]
+	}
+	if cr.Tenant == "" {
+		cr.Tenant = msg.Headers[TenantHeader]
+	}
+	if cr.Codec == "" {
+		cr.Codec = msg.Headers[CodecHeader]
+	}
+	var md Metadata
+	for k, v := range msg.Headers {
+		if key := strings.TrimPrefix(k, MetadataHeaderPrefix); key != k {
+			md = md.Merge(Metadata{key: v})
+		}
+	}
+	cr.Metadata = md.Merge(cr.Metadata)
 	return nil
 }
 
@@ -46,3 +100,17 @@ func BusMessagesToCommandRecords(msgs []BusMessage) ([]CommandRecord, error) {
 	}
 	return crs, nil
 }
+
+type headersKey struct{}
+
+// ContextWithHeaders returns a context that carries the headers of the bus
+// message that is being processed.
+func ContextWithHeaders(ctx context.Context, headers map[string]string) context.Context {
+	return context.WithValue(ctx, headersKey{}, headers)
+}
+
+// HeadersFromContext returns the headers of the bus message of ctx.
+func HeadersFromContext(ctx context.Context) map[string]string {
+	headers, _ := ctx.Value(headersKey{}).(map[string]string)
+	return headers
+}
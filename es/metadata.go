@@ -0,0 +1,96 @@
+package es
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gosom/kit/lib"
+)
+
+// The well known metadata keys.
+const (
+	MetadataUserID   = "user_id"
+	MetadataClientIP = "client_ip"
+	MetadataTenant   = "tenant"
+	MetadataSource   = "source"
+	// MetadataSubject is the subject of the personal data of an event, see
+	// Registry.EncryptEvent.
+	MetadataSubject = "pii_subject"
+)
+
+// Metadata is free form information about a command or an event, e.g. the
+// acting user or the source service. The events of a command inherit its
+// metadata.
+type Metadata map[string]string
+
+// Merge returns the union of the metadata, other wins on conflicts.
+func (o Metadata) Merge(other Metadata) Metadata {
+	if len(o) == 0 && len(other) == 0 {
+		return nil
+	}
+	ans := make(Metadata, len(o)+len(other))
+	for k, v := range o {
+		ans[k] = v
+	}
+	for k, v := range other {
+		ans[k] = v
+	}
+	return ans
+}
+
+func (o Metadata) Value() (driver.Value, error) {
+	if o == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(map[string]string(o))
+}
+
+func (o *Metadata) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	case nil:
+		*o = nil
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into metadata", src)
+	}
+	var ans map[string]string
+	if err := json.Unmarshal(data, &ans); err != nil {
+		return err
+	}
+	if len(ans) == 0 {
+		ans = nil
+	}
+	*o = ans
+	return nil
+}
+
+type metadataKey struct{}
+
+// ContextWithMetadata returns a context that carries the metadata merged
+// with the metadata that ctx already carries.
+// The commands that are saved or dispatched with the context inherit it.
+func ContextWithMetadata(ctx context.Context, md Metadata) context.Context {
+	current, _ := ctx.Value(metadataKey{}).(Metadata)
+	return context.WithValue(ctx, metadataKey{}, current.Merge(md))
+}
+
+// MetadataFromContext returns the metadata of ctx. The user and the client IP
+// that the web middlewares store in the context are included.
+func MetadataFromContext(ctx context.Context) Metadata {
+	var ans Metadata
+	if user := lib.UserFromContext(ctx); user != nil {
+		ans = ans.Merge(Metadata{MetadataUserID: user.GetID()})
+	}
+	if ip := lib.IPFromContext(ctx); ip != "" {
+		ans = ans.Merge(Metadata{MetadataClientIP: ip})
+	}
+	md, _ := ctx.Value(metadataKey{}).(Metadata)
+	return ans.Merge(md)
+}
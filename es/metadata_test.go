@@ -0,0 +1,126 @@
+package es_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gosom/kit/es"
+	"github.com/gosom/kit/es/mock"
+	"github.com/gosom/kit/lib"
+	"github.com/stretchr/testify/require"
+)
+
+type metadataUser struct{}
+
+func (metadataUser) GetID() string               { return "user-1" }
+func (metadataUser) GetExtra() map[string]string { return nil }
+
+func TestMetadataFromContext(t *testing.T) {
+	ctx := context.Background()
+	require.Empty(t, es.MetadataFromContext(ctx))
+
+	ctx = lib.NewContextWithUser(ctx, metadataUser{})
+	ctx = lib.NewContextWithClientIP(ctx, "127.0.0.1")
+	ctx = es.ContextWithMetadata(ctx, es.Metadata{es.MetadataSource: "api"})
+	ctx = es.ContextWithMetadata(ctx, es.Metadata{es.MetadataTenant: "acme"})
+	want := es.Metadata{
+		es.MetadataUserID:   "user-1",
+		es.MetadataClientIP: "127.0.0.1",
+		es.MetadataSource:   "api",
+		es.MetadataTenant:   "acme",
+	}
+	require.Equal(t, want, es.MetadataFromContext(ctx))
+}
+
+func TestBusMessageHeaders(t *testing.T) {
+	rec, err := es.CommandToCommandRecord("order", &placeOrder{ID: "1", Quantity: 1})
+	require.NoError(t, err)
+	rec.SetCorrelation(es.Correlation{CorrelationID: "request-1", CausationID: "request-1"})
+	rec.Metadata = es.Metadata{es.MetadataUserID: "user-1"}
+	msg, err := es.CommandRecordToBusMessage(rec)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		es.CorrelationIDHeader:                      "request-1",
+		es.CausationIDHeader:                        "request-1",
+		es.CodecHeader:                              es.CodecJSON,
+		es.MetadataHeaderPrefix + es.MetadataUserID: "user-1",
+	}, msg.Headers)
+
+	// the headers fill what the body lacks
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(msg.Data, &body))
+	delete(body, "Metadata")
+	delete(body, "CorrelationID")
+	delete(body, "CausationID")
+	msg.Data, err = json.Marshal(body)
+	require.NoError(t, err)
+	var got es.CommandRecord
+	require.NoError(t, es.BusMessageToCommandRecord(msg, &got))
+	require.Equal(t, rec.Correlation(), got.Correlation())
+	require.Equal(t, rec.Metadata, got.Metadata)
+}
+
+type auditedCommand struct {
+	es.CommandBase
+	ID string `json:"id" aggregateID:"true" validate:"required"`
+}
+
+func (c *auditedCommand) Handle(ctx context.Context, h es.AggregateLoader) ([]es.IEvent, error) {
+	ev := &audited{
+		CommandUser: c.GetMetadata()[es.MetadataUserID],
+		ContextUser: es.MetadataFromContext(ctx)[es.MetadataUserID],
+	}
+	ev.SetMetadata(es.Metadata{"reason": "test"})
+	return []es.IEvent{ev}, nil
+}
+
+type audited struct {
+	es.EventBase
+	CommandUser string `json:"command_user"`
+	ContextUser string `json:"context_user"`
+}
+
+func TestCommandProcessorMetadata(t *testing.T) {
+	store := mock.NewEventStore()
+	registry := es.NewRegistry()
+	registry.RegisterCommand("auditedCommand", func(data []byte) (es.ICommand, error) {
+		var cmd auditedCommand
+		return &cmd, json.Unmarshal(data, &cmd)
+	})
+	registry.RegisterEvent("audited", func(data []byte) (es.IEvent, error) {
+		var ev audited
+		return &ev, json.Unmarshal(data, &ev)
+	})
+	processor, err := es.NewCommandProcessor(1, store, registry, "audit")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- processor.Start(ctx)
+	}()
+	defer func() {
+		cancel()
+		require.NoError(t, <-done)
+	}()
+
+	rec, err := es.CommandToCommandRecord("audit", &auditedCommand{ID: "1"})
+	require.NoError(t, err)
+	rec.Metadata = es.Metadata{es.MetadataUserID: "user-1"}
+	_, err = store.SaveCommandRecords(ctx, rec)
+	require.NoError(t, err)
+
+	var events []es.EventRecord
+	require.Eventually(t, func() bool {
+		events, err = store.LoadCommandEvents(ctx, rec.ID)
+		return err == nil && len(events) == 1
+	}, 4*time.Second, 10*time.Millisecond)
+	require.Equal(t, es.Metadata{es.MetadataUserID: "user-1", "reason": "test"}, events[0].Metadata)
+	ev, err := es.EventRecordToEvent(registry, events[0])
+	require.NoError(t, err)
+	require.Equal(t, "user-1", ev.(*audited).CommandUser)
+	require.Equal(t, "user-1", ev.(*audited).ContextUser)
+	require.Equal(t, events[0].Metadata, ev.GetMetadata())
+}
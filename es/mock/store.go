@@ -2,21 +2,69 @@ package mock
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gosom/kit/es"
 )
 
 var _ es.EventStore = (*EventStore)(nil)
+var _ es.SnapshotStore = (*EventStore)(nil)
+var _ es.KeyStore = (*EventStore)(nil)
+var _ es.Trigger = (*EventStore)(nil)
 
+// EventStore is an in-memory implementation of es.EventStore.
+// It is safe for concurrent use and is meant for tests and local development.
+// It notifies its subscribers when commands and events are stored.
+// Like the other stores it scopes the records to the tenant of the context.
 type EventStore struct {
+	es.Broadcaster
+
+	mu            sync.Mutex
+	commands      map[string]es.CommandRecord
+	versions      map[string]int
+	events        []es.EventRecord // in commit order
+	eventIDs      map[string]struct{}
+	subscriptions map[string]es.Subscription
+	deadLetters   map[string]map[string]es.DeadLetter
+	snapshots     map[string]es.Snapshot
+	leases        map[string]lease
+	keys          map[string]idempotencyKey
+	sagas         map[string]es.SagaInstance
+	// dataKeys are the keys of the subjects, a forgotten subject has a nil key.
+	dataKeys map[string][]byte
+
+	Now func() time.Time
+	// IdempotencyTTL is how long the idempotency keys of the commands are valid.
+	IdempotencyTTL time.Duration
 }
 
-func NewEventStore() *EventStore {
-	return &EventStore{}
+type idempotencyKey struct {
+	commandID string
+	expiresAt time.Time
 }
 
-func (e *EventStore) GetCommand(ctx context.Context, commandID string) (es.CommandRecord, error) {
-	panic("not implemented") // TODO: Implement
+func NewEventStore() *EventStore {
+	return &EventStore{
+		commands:      make(map[string]es.CommandRecord),
+		versions:      make(map[string]int),
+		eventIDs:      make(map[string]struct{}),
+		subscriptions: make(map[string]es.Subscription),
+		deadLetters:   make(map[string]map[string]es.DeadLetter),
+		snapshots:     make(map[string]es.Snapshot),
+		leases:        make(map[string]lease),
+		keys:          make(map[string]idempotencyKey),
+		sagas:         make(map[string]es.SagaInstance),
+		dataKeys:      make(map[string][]byte),
+		Now: func() time.Time {
+			return time.Now().UTC()
+		},
+		IdempotencyTTL: es.DefaultIdempotencyTTL,
+	}
 }
 
 func (s *EventStore) Migrate(ctx context.Context) error {
@@ -24,34 +72,704 @@ func (s *EventStore) Migrate(ctx context.Context) error {
 }
 
 func (s *EventStore) SaveCommandRecords(ctx context.Context, records ...es.CommandRecord) ([]string, error) {
-	return nil, nil
+	records, err := resolveTenants(ctx, records)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saveCommands(records), nil
+}
+
+// resolveTenants returns a copy of the records with their tenant resolved.
+func resolveTenants(ctx context.Context, records []es.CommandRecord) ([]es.CommandRecord, error) {
+	ans := make([]es.CommandRecord, len(records))
+	for i := range records {
+		tenant, err := es.ResolveTenant(ctx, records[i].Tenant)
+		if err != nil {
+			return nil, err
+		}
+		ans[i] = records[i]
+		ans[i].Tenant = tenant
+	}
+	return ans, nil
+}
+
+// saveCommands saves the records, s.mu must be held.
+func (s *EventStore) saveCommands(records []es.CommandRecord) []string {
+	var ids []string
+	saved := false
+	now := s.Now()
+	for i := range records {
+		if _, ok := s.commands[records[i].ID]; ok {
+			continue
+		}
+		if key := records[i].IdempotencyKey; key != "" {
+			name := scoped(records[i].Tenant, records[i].Domain(), key)
+			if existing, ok := s.keys[name]; ok && !existing.expiresAt.Before(now) {
+				ids = append(ids, existing.commandID)
+				continue
+			}
+			s.keys[name] = idempotencyKey{commandID: records[i].ID, expiresAt: now.Add(s.IdempotencyTTL)}
+		}
+		rec := records[i]
+		rec.Status = es.CommandStatusPending
+		rec.Attempts = 0
+		rec.LastError = ""
+		rec.ProcessedAt = nil
+		s.commands[rec.ID] = rec
+		ids = append(ids, rec.ID)
+		saved = true
+	}
+	if saved {
+		s.Notify(es.CommandsChannel)
+	}
+	return ids
+}
+
+func (s *EventStore) GetCommand(ctx context.Context, commandID string) (es.CommandRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.command(ctx, commandID)
+	if !ok {
+		return es.CommandRecord{}, sql.ErrNoRows
+	}
+	return rec, nil
+}
+
+// command returns the command if it belongs to the tenant of ctx.
+// The caller must hold the lock.
+func (s *EventStore) command(ctx context.Context, commandID string) (es.CommandRecord, bool) {
+	rec, ok := s.commands[commandID]
+	if !ok || rec.Tenant != es.TenantFromContext(ctx) {
+		return es.CommandRecord{}, false
+	}
+	return rec, true
 }
 
-func (s *EventStore) SelectForProcessing(ctx context.Context, batchSize, max int) ([][]es.CommandRecord, error) {
-	return nil, nil
+func (s *EventStore) SelectForProcessing(ctx context.Context, workers, limit int, partitions ...int) ([][]es.CommandRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ans := make([][]es.CommandRecord, workers)
+	for i := 0; i < workers; i++ {
+		ans[i] = make([]es.CommandRecord, 0, limit)
+	}
+	ids := make([]string, 0, len(s.commands))
+	for id := range s.commands {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	now := s.Now()
+	// the aggregates with a command that waits to be retried
+	retrying := make(map[string]struct{})
+	for _, id := range ids {
+		rec := s.commands[id]
+		if !visible(ctx, rec.Tenant) {
+			continue
+		}
+		if rec.Status != es.CommandStatusPending && rec.Status != es.CommandStatusRunning {
+			continue
+		}
+		key := scoped(rec.Tenant, rec.AggregateID)
+		if _, ok := retrying[key]; ok {
+			continue
+		}
+		if !rec.Due(now) {
+			if rec.Attempts > 0 {
+				retrying[key] = struct{}{}
+			}
+			continue
+		}
+		partition := int(rec.AggregateHash) % workers
+		if partition < 0 {
+			partition += workers
+		}
+		if len(partitions) > 0 && !containsInt(partitions, partition) {
+			continue
+		}
+		if len(ans[partition]) < limit {
+			ans[partition] = append(ans[partition], rec)
+		}
+	}
+	return ans, nil
 }
 
 func (s *EventStore) StoreCommandResults(ctx context.Context, commandID string,
 	expectedVersion int, records ...es.EventRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd, ok := s.command(ctx, commandID)
+	if !ok {
+		return fmt.Errorf("command %s not found: %w", commandID, sql.ErrNoRows)
+	}
+	if len(records) > 0 {
+		version, ok := s.versions[scoped(cmd.Tenant, records[0].AggregateID)]
+		if !ok || version != expectedVersion {
+			return es.ErrWrongExpectedVersion
+		}
+	}
+	for i := range records {
+		if _, ok := s.eventIDs[records[i].ID]; ok {
+			return fmt.Errorf("Error saving event %s: duplicate id", records[i].ID)
+		}
+	}
+	now := s.Now()
+	for i := range records {
+		rec := records[i]
+		rec.CommandID = commandID
+		rec.Tenant = cmd.Tenant
+		rec.CreatedAt = now
+		if rec.SchemaVersion == 0 {
+			rec.SchemaVersion = 1
+		}
+		rec.GlobalPosition = int64(len(s.events) + 1)
+		s.events = append(s.events, rec)
+		s.eventIDs[rec.ID] = struct{}{}
+	}
+	if len(records) > 0 {
+		s.versions[scoped(cmd.Tenant, records[0].AggregateID)] += len(records)
+		s.Notify(es.EventsChannel)
+	}
+	cmd.Status = es.CommandStatusFinished
+	cmd.ProcessedAt = &now
+	s.commands[commandID] = cmd
+	s.Notify(es.CommandResultsChannel)
+	return nil
+}
+
+func (s *EventStore) MarkCommandRunning(ctx context.Context, commandID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd, ok := s.command(ctx, commandID)
+	if !ok || (cmd.Status != es.CommandStatusPending && cmd.Status != es.CommandStatusRunning) {
+		return 0, sql.ErrNoRows
+	}
+	cmd.Status = es.CommandStatusRunning
+	cmd.Attempts++
+	s.commands[commandID] = cmd
+	return cmd.Attempts, nil
+}
+
+func (s *EventStore) CancelCommand(ctx context.Context, commandID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd, ok := s.command(ctx, commandID)
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if cmd.Status != es.CommandStatusPending {
+		return es.ErrCommandNotPending
+	}
+	now := s.Now()
+	cmd.Status = es.CommandStatusCancelled
+	cmd.ProcessedAt = &now
+	s.commands[commandID] = cmd
+	s.Notify(es.CommandResultsChannel)
+	return nil
+}
+
+func (s *EventStore) MarkCommandFailed(ctx context.Context, commandID string, lastError string, final bool, retryAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd, ok := s.command(ctx, commandID)
+	if !ok {
+		return sql.ErrNoRows
+	}
+	cmd.LastError = lastError
+	cmd.Status = es.CommandStatusPending
+	cmd.ProcessedAt = nil
+	if !retryAt.IsZero() {
+		cmd.NotBefore = &retryAt
+	}
+	if final {
+		now := s.Now()
+		cmd.Status = es.CommandStatusFailure
+		cmd.ProcessedAt = &now
+		s.Notify(es.CommandResultsChannel)
+	}
+	s.commands[commandID] = cmd
 	return nil
 }
 
 func (s *EventStore) GetOrCreateVersion(ctx context.Context, aggregateID string) (int, error) {
-	return 0, nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := scoped(es.TenantFromContext(ctx), aggregateID)
+	version, ok := s.versions[key]
+	if !ok {
+		s.versions[key] = 0
+	}
+	return version, nil
 }
 
 func (s *EventStore) InsertSubscription(ctx context.Context, subscription string) (es.Subscription, error) {
-	return es.Subscription{}, nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tenant := es.TenantFromContext(ctx)
+	sub, ok := s.subscriptions[scoped(tenant, subscription)]
+	if !ok {
+		sub = es.Subscription{
+			Group:         subscription,
+			LastUpdatedAt: s.Now(),
+			Tenant:        tenant,
+		}
+		s.subscriptions[scoped(tenant, subscription)] = sub
+	}
+	return sub, nil
 }
 
 func (s *EventStore) SelectEventsForSubscription(ctx context.Context, subscription es.Subscription, limit int) ([]es.EventRecord, error) {
-	return nil, nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subscriptions[scoped(es.TenantFromContext(ctx), subscription.Group)]
+	if !ok || sub.Paused {
+		return nil, nil
+	}
+	var ans []es.EventRecord
+	for _, ev := range s.events {
+		if len(ans) >= limit {
+			break
+		}
+		if ev.GlobalPosition <= sub.Position || ev.EventType == "EventError" || !visible(ctx, ev.Tenant) {
+			continue
+		}
+		ans = append(ans, ev)
+	}
+	return ans, nil
 }
 
-func (s *EventStore) UpdateSubscription(ctx context.Context, group string, lastSeen string) (es.Subscription, error) {
-	return es.Subscription{}, nil
+func (s *EventStore) UpdateSubscription(ctx context.Context, group string, from, to int64) (es.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := scoped(es.TenantFromContext(ctx), group)
+	sub, ok := s.subscriptions[key]
+	if !ok {
+		return es.Subscription{}, sql.ErrNoRows
+	}
+	if sub.Position != from {
+		return es.Subscription{}, es.ErrSubscriptionChanged
+	}
+	sub.Position = to
+	sub.LastUpdatedAt = s.Now()
+	s.subscriptions[key] = sub
+	return sub, nil
+}
+
+func (s *EventStore) GetSubscription(ctx context.Context, group string) (es.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subscriptions[scoped(es.TenantFromContext(ctx), group)]
+	if !ok {
+		return es.Subscription{}, es.ErrSubscriptionNotFound
+	}
+	return sub, nil
+}
+
+func (s *EventStore) ListSubscriptions(ctx context.Context) ([]es.SubscriptionInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ans := make([]es.SubscriptionInfo, 0, len(s.subscriptions))
+	tenant := es.TenantFromContext(ctx)
+	for _, sub := range s.subscriptions {
+		if sub.Tenant != tenant {
+			continue
+		}
+		info := es.SubscriptionInfo{Subscription: sub}
+		for i := range s.events {
+			if s.events[i].GlobalPosition > sub.Position && s.events[i].EventType != "EventError" &&
+				visible(ctx, s.events[i].Tenant) {
+				info.Lag++
+			}
+		}
+		ans = append(ans, info)
+	}
+	sort.Slice(ans, func(i, j int) bool {
+		return ans[i].Group < ans[j].Group
+	})
+	return ans, nil
+}
+
+func (s *EventStore) ResetSubscription(ctx context.Context, group string, position int64) (es.Subscription, error) {
+	return s.modifySubscription(ctx, group, func(sub *es.Subscription) {
+		sub.Position = position
+	})
+}
+
+func (s *EventStore) SetSubscriptionPaused(ctx context.Context, group string, paused bool) (es.Subscription, error) {
+	return s.modifySubscription(ctx, group, func(sub *es.Subscription) {
+		sub.Paused = paused
+	})
+}
+
+func (s *EventStore) DeleteSubscription(ctx context.Context, group string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := scoped(es.TenantFromContext(ctx), group)
+	if _, ok := s.subscriptions[key]; !ok {
+		return es.ErrSubscriptionNotFound
+	}
+	delete(s.subscriptions, key)
+	delete(s.deadLetters, key)
+	return nil
+}
+
+func (s *EventStore) GetEventPosition(ctx context.Context, eventID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.events {
+		if s.events[i].ID == eventID && visible(ctx, s.events[i].Tenant) {
+			return s.events[i].GlobalPosition, nil
+		}
+	}
+	return 0, sql.ErrNoRows
+}
+
+func (s *EventStore) GetPositionAt(ctx context.Context, at time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ans int64
+	for i := range s.events {
+		if s.events[i].CreatedAt.Before(at) && visible(ctx, s.events[i].Tenant) {
+			ans = s.events[i].GlobalPosition
+		}
+	}
+	return ans, nil
+}
+
+func (s *EventStore) modifySubscription(ctx context.Context, group string, fn func(sub *es.Subscription)) (es.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := scoped(es.TenantFromContext(ctx), group)
+	sub, ok := s.subscriptions[key]
+	if !ok {
+		return es.Subscription{}, es.ErrSubscriptionNotFound
+	}
+	fn(&sub)
+	sub.LastUpdatedAt = s.Now()
+	s.subscriptions[key] = sub
+	return sub, nil
+}
+
+type lease struct {
+	owner     string
+	expiresAt time.Time
+}
+
+func (s *EventStore) AcquireLease(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.Now()
+	current, ok := s.leases[name]
+	if ok && current.owner != owner && current.expiresAt.After(now) {
+		return false, nil
+	}
+	s.leases[name] = lease{owner: owner, expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (s *EventStore) ReleaseLease(ctx context.Context, name string, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current, ok := s.leases[name]; ok && current.owner == owner {
+		delete(s.leases, name)
+	}
+	return nil
+}
+
+func (s *EventStore) ListLeases(ctx context.Context, prefix string) ([]es.Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.Now()
+	var ans []es.Lease
+	for name, current := range s.leases {
+		if strings.HasPrefix(name, prefix) && current.expiresAt.After(now) {
+			ans = append(ans, es.Lease{Name: name, Owner: current.owner, ExpiresAt: current.expiresAt})
+		}
+	}
+	sort.Slice(ans, func(i, j int) bool {
+		return ans[i].Name < ans[j].Name
+	})
+	return ans, nil
+}
+
+func (s *EventStore) InsertDeadLetter(ctx context.Context, group string, eventID string, lastError string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := scoped(es.TenantFromContext(ctx), group)
+	_, ok := s.subscriptions[key]
+	if !ok {
+		return fmt.Errorf("subscription %s not found: %w", group, sql.ErrNoRows)
+	}
+	var event *es.EventRecord
+	for i := range s.events {
+		if s.events[i].ID == eventID && visible(ctx, s.events[i].Tenant) {
+			event = &s.events[i]
+			break
+		}
+	}
+	if event == nil {
+		return fmt.Errorf("event %s not found: %w", eventID, sql.ErrNoRows)
+	}
+	if _, ok := s.deadLetters[key]; !ok {
+		s.deadLetters[key] = make(map[string]es.DeadLetter)
+	}
+	item, ok := s.deadLetters[key][eventID]
+	if !ok {
+		item = es.DeadLetter{Group: group, Event: *event, CreatedAt: s.Now()}
+	}
+	item.LastError = lastError
+	s.deadLetters[key][eventID] = item
+	return nil
+}
+
+func (s *EventStore) ListDeadLetters(ctx context.Context, group string, limit int) ([]es.DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := scoped(es.TenantFromContext(ctx), group)
+	ans := make([]es.DeadLetter, 0, len(s.deadLetters[key]))
+	for _, item := range s.deadLetters[key] {
+		ans = append(ans, item)
+	}
+	sort.Slice(ans, func(i, j int) bool {
+		return ans[i].Event.GlobalPosition < ans[j].Event.GlobalPosition
+	})
+	if limit > 0 && len(ans) > limit {
+		ans = ans[:limit]
+	}
+	return ans, nil
+}
+
+func (s *EventStore) GetSagaInstance(ctx context.Context, saga string, id string) (es.SagaInstance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	instance, ok := s.sagas[scoped(es.TenantFromContext(ctx), saga, id)]
+	if !ok {
+		return es.SagaInstance{}, sql.ErrNoRows
+	}
+	return instance, nil
+}
+
+func (s *EventStore) SaveSagaInstance(ctx context.Context, instance es.SagaInstance, commands ...es.CommandRecord) error {
+	commands, err := resolveTenants(ctx, commands)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := scoped(es.TenantFromContext(ctx), instance.Saga, instance.ID)
+	if s.sagas[key].Version != instance.Version-1 {
+		return es.ErrWrongExpectedVersion
+	}
+	// the instance is a value but its slices are shared with the caller
+	stored := es.SagaInstance{
+		Saga:          instance.Saga,
+		ID:            instance.ID,
+		Status:        instance.Status,
+		State:         append([]byte(nil), instance.State...),
+		Compensations: append(es.SagaCommands(nil), instance.Compensations...),
+		Position:      instance.Position,
+		Version:       instance.Version,
+		CreatedAt:     instance.CreatedAt,
+		UpdatedAt:     instance.UpdatedAt,
+	}
+	s.sagas[key] = stored
+	s.saveCommands(commands)
+	return nil
+}
+
+func (s *EventStore) DeleteDeadLetter(ctx context.Context, group string, eventID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := scoped(es.TenantFromContext(ctx), group)
+	if _, ok := s.deadLetters[key][eventID]; !ok {
+		return es.ErrDeadLetterNotFound
+	}
+	delete(s.deadLetters[key], eventID)
+	return nil
+}
+
+func (s *EventStore) LoadCommandEvents(ctx context.Context, commandID string) ([]es.EventRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ans []es.EventRecord
+	tenant := es.TenantFromContext(ctx)
+	for _, ev := range s.events {
+		if ev.CommandID == commandID && ev.Tenant == tenant {
+			ans = append(ans, ev)
+		}
+	}
+	return ans, nil
 }
 
 func (s *EventStore) LoadEvents(ctx context.Context, aggregateID string) ([]es.EventRecord, error) {
-	return nil, nil
+	return s.LoadEventsFromVersion(ctx, aggregateID, 0)
+}
+
+func (s *EventStore) LoadEventsFromVersion(ctx context.Context, aggregateID string, version int) ([]es.EventRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ans []es.EventRecord
+	tenant := es.TenantFromContext(ctx)
+	for _, ev := range s.sortedEvents() {
+		if ev.Tenant != tenant || ev.AggregateID != aggregateID || ev.Version <= version || ev.EventType == "EventError" {
+			continue
+		}
+		ans = append(ans, ev)
+	}
+	return ans, nil
+}
+
+func (s *EventStore) LoadEventsUntil(ctx context.Context, aggregateID string, version int, at time.Time) ([]es.EventRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ans []es.EventRecord
+	tenant := es.TenantFromContext(ctx)
+	for _, ev := range s.sortedEvents() {
+		if ev.Tenant != tenant || ev.AggregateID != aggregateID || ev.EventType == "EventError" {
+			continue
+		}
+		if (version > 0 && ev.Version > version) || (!at.IsZero() && ev.CreatedAt.After(at)) {
+			continue
+		}
+		ans = append(ans, ev)
+	}
+	return ans, nil
+}
+
+func (s *EventStore) QueryEvents(ctx context.Context, query es.EventQuery) ([]es.EventRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ans []es.EventRecord
+	tenant := es.TenantFromContext(ctx)
+	for _, ev := range s.events {
+		if query.Limit > 0 && len(ans) == query.Limit {
+			break
+		}
+		if ev.Tenant != tenant || ev.GlobalPosition <= query.After || !matchesEventQuery(ev, query) {
+			continue
+		}
+		ans = append(ans, ev)
+	}
+	return ans, nil
+}
+
+func matchesEventQuery(ev es.EventRecord, query es.EventQuery) bool {
+	switch {
+	case query.AggregateID != "" && ev.AggregateID != query.AggregateID,
+		query.Domain != "" && ev.Domain() != query.Domain,
+		query.CommandID != "" && ev.CommandID != query.CommandID,
+		!query.From.IsZero() && ev.CreatedAt.Before(query.From),
+		!query.To.IsZero() && !ev.CreatedAt.Before(query.To):
+		return false
+	case len(query.EventTypes) == 0:
+		return ev.EventType != "EventError"
+	}
+	for _, eventType := range query.EventTypes {
+		if ev.EventType == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *EventStore) SaveSnapshot(ctx context.Context, snapshot es.Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := scoped(es.TenantFromContext(ctx), snapshot.AggregateID)
+	current, ok := s.snapshots[key]
+	if ok && current.Version >= snapshot.Version && current.SchemaVersion == snapshot.SchemaVersion {
+		return nil
+	}
+	s.snapshots[key] = snapshot
+	return nil
+}
+
+func (s *EventStore) LoadSnapshot(ctx context.Context, aggregateID string) (es.Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot, ok := s.snapshots[scoped(es.TenantFromContext(ctx), aggregateID)]
+	if !ok {
+		return es.Snapshot{}, es.ErrSnapshotNotFound
+	}
+	return snapshot, nil
+}
+
+func (s *EventStore) GetOrCreateKey(ctx context.Context, subject string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := scoped(es.TenantFromContext(ctx), subject)
+	key, ok := s.dataKeys[name]
+	switch {
+	case ok && key == nil:
+		return nil, es.ErrSubjectForgotten
+	case ok:
+		return key, nil
+	}
+	key, err := es.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+	s.dataKeys[name] = key
+	return key, nil
+}
+
+func (s *EventStore) GetKey(ctx context.Context, subject string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.dataKeys[scoped(es.TenantFromContext(ctx), subject)]
+	switch {
+	case !ok:
+		return nil, sql.ErrNoRows
+	case key == nil:
+		return nil, es.ErrSubjectForgotten
+	}
+	return key, nil
+}
+
+func (s *EventStore) ForgetSubject(ctx context.Context, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tenant := es.TenantFromContext(ctx)
+	s.dataKeys[scoped(tenant, subject)] = nil
+	delete(s.snapshots, scoped(tenant, subject))
+	for _, ev := range s.events {
+		if ev.Tenant == tenant && ev.Metadata[es.MetadataSubject] == subject {
+			delete(s.snapshots, scoped(tenant, ev.AggregateID))
+		}
+	}
+	return nil
+}
+
+// sortedEvents returns the events ordered by id.
+// The caller must hold the lock.
+func (s *EventStore) sortedEvents() []es.EventRecord {
+	ans := make([]es.EventRecord, len(s.events))
+	copy(ans, s.events)
+	sort.SliceStable(ans, func(i, j int) bool {
+		if ans[i].ID == ans[j].ID {
+			return ans[i].Version < ans[j].Version
+		}
+		return ans[i].ID < ans[j].ID
+	})
+	return ans
+}
+
+// scoped returns the key of a record of the tenant.
+func scoped(tenant string, parts ...string) string {
+	return tenant + "/" + strings.Join(parts, "/")
+}
+
+// visible reports whether a record of the tenant is visible in ctx.
+// The system scope sees the records of all the tenants.
+func visible(ctx context.Context, tenant string) bool {
+	return es.SystemScopeFromContext(ctx) || es.TenantFromContext(ctx) == tenant
+}
+
+func containsInt(items []int, item int) bool {
+	for i := range items {
+		if items[i] == item {
+			return true
+		}
+	}
+	return false
 }
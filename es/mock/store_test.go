@@ -0,0 +1,401 @@
+package mock_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gosom/kit/es"
+	"github.com/gosom/kit/es/estest"
+	"github.com/gosom/kit/es/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type counter struct {
+	*es.AggregateBase
+	Value int
+}
+
+func newCounter() (es.AggregateRoot, error) {
+	base, err := es.NewAggregateBase()
+	if err != nil {
+		return nil, err
+	}
+	return &counter{AggregateBase: base}, nil
+}
+
+type increment struct {
+	es.CommandBase
+	ID string `json:"id" aggregateID:"true" validate:"required"`
+	By int    `json:"by" validate:"required"`
+}
+
+func (c *increment) Handle(ctx context.Context, h es.AggregateLoader) ([]es.IEvent, error) {
+	agg, err := newCounter()
+	if err != nil {
+		return nil, err
+	}
+	if err := h.Load(ctx, c.GetAggregateID(), agg); err != nil {
+		return nil, err
+	}
+	if agg.(*counter).Value+c.By > 10 {
+		return nil, fmt.Errorf("counter overflow")
+	}
+	return []es.IEvent{&incremented{By: c.By}}, nil
+}
+
+type incremented struct {
+	es.EventBase
+	By int `json:"by"`
+}
+
+func (e *incremented) Apply(agg es.AggregateRoot) error {
+	agg.(*counter).Value += e.By
+	return nil
+}
+
+type explode struct {
+	es.CommandBase
+	ID string `json:"id" aggregateID:"true" validate:"required"`
+}
+
+func (c *explode) Handle(ctx context.Context, h es.AggregateLoader) ([]es.IEvent, error) {
+	panic("boom")
+}
+
+func newRegistry() *es.Registry {
+	reg := es.NewRegistry()
+	reg.RegisterCommand("increment", func(data []byte) (es.ICommand, error) {
+		var item increment
+		return &item, json.Unmarshal(data, &item)
+	})
+	reg.RegisterCommand("explode", func(data []byte) (es.ICommand, error) {
+		var item explode
+		return &item, json.Unmarshal(data, &item)
+	})
+	reg.RegisterEvent("incremented", func(data []byte) (es.IEvent, error) {
+		var item incremented
+		return &item, json.Unmarshal(data, &item)
+	})
+	return reg
+}
+
+func newCommandRecord(t *testing.T, id string, by int) es.CommandRecord {
+	rec, err := es.CommandToCommandRecord("counter", &increment{ID: id, By: by})
+	require.NoError(t, err)
+	return rec
+}
+
+func TestEventStore(t *testing.T) {
+	estest.RunEventStoreSuite(t, func(t *testing.T) es.EventStore {
+		return mock.NewEventStore()
+	})
+}
+
+func TestIdempotencyKeyExpiry(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	store := mock.NewEventStore()
+	store.IdempotencyTTL = time.Minute
+	store.Now = func() time.Time {
+		return now
+	}
+
+	save := func() (es.CommandRecord, string) {
+		rec := newCommandRecord(t, "1", 1)
+		rec.IdempotencyKey = "key"
+		ids, err := store.SaveCommandRecords(ctx, rec)
+		require.NoError(t, err)
+		require.Len(t, ids, 1)
+		return rec, ids[0]
+	}
+	first, id := save()
+	require.Equal(t, first.ID, id)
+
+	now = now.Add(time.Minute)
+	_, id = save()
+	require.Equal(t, first.ID, id)
+
+	now = now.Add(time.Second)
+	second, id := save()
+	require.Equal(t, second.ID, id)
+}
+
+func TestCommandProcessorWithEventStore(t *testing.T) {
+	store := mock.NewEventStore()
+	registry := newRegistry()
+	processor, err := es.NewCommandProcessor(2, store, registry, "counter")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- processor.Start(ctx)
+	}()
+
+	records := []es.CommandRecord{
+		newCommandRecord(t, "1", 4),
+		newCommandRecord(t, "1", 5),
+		newCommandRecord(t, "1", 3),
+	}
+	_, err = store.SaveCommandRecords(ctx, records...)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		cmd, err := store.GetCommand(ctx, records[2].ID)
+		return err == nil && cmd.Status == es.CommandStatusFinished
+	}, 4*time.Second, 50*time.Millisecond)
+
+	agg, err := newCounter()
+	require.NoError(t, err)
+	require.NoError(t, processor.Load(ctx, "counter-1", agg))
+	require.Equal(t, 9, agg.(*counter).Value)
+	require.Equal(t, uint64(2), agg.GetVersion())
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestCommandProcessorWakeup(t *testing.T) {
+	store := mock.NewEventStore()
+	// polling is effectively disabled, only notifications wake up the processor
+	wakeup := es.Wakeup{Trigger: store, MinInterval: time.Hour, MaxInterval: time.Hour}
+	processor, err := es.NewCommandProcessor(1, store, newRegistry(), "counter", es.WithProcessorWakeup(wakeup))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- processor.Start(ctx)
+	}()
+
+	for i := 1; i <= 2; i++ {
+		rec := newCommandRecord(t, "1", i)
+		_, err = store.SaveCommandRecords(ctx, rec)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			cmd, err := store.GetCommand(ctx, rec.ID)
+			return err == nil && cmd.Status == es.CommandStatusFinished
+		}, 2*time.Second, 10*time.Millisecond)
+	}
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestCommandProcessorInstances(t *testing.T) {
+	store := mock.NewEventStore()
+	registry := newRegistry()
+	const workers = 4
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var stopped []chan error
+	for i := 0; i < 2; i++ {
+		processor, err := es.NewCommandProcessor(workers, store, registry, "counter",
+			es.WithProcessorLease(300*time.Millisecond))
+		require.NoError(t, err)
+		done := make(chan error)
+		go func() {
+			done <- processor.Start(ctx)
+		}()
+		stopped = append(stopped, done)
+	}
+
+	// the partitions are spread over both instances
+	require.Eventually(t, func() bool {
+		leases, err := store.ListLeases(ctx, "commands:counter:partition:")
+		require.NoError(t, err)
+		owners := make(map[string]int)
+		for i := range leases {
+			owners[leases[i].Owner]++
+		}
+		return len(leases) == workers && len(owners) == 2
+	}, 3*time.Second, 20*time.Millisecond)
+
+	var records []es.CommandRecord
+	for i := 0; i < 40; i++ {
+		records = append(records, newCommandRecord(t, strconv.Itoa(i%10), 1))
+	}
+	_, err := store.SaveCommandRecords(ctx, records...)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		for i := range records {
+			cmd, err := store.GetCommand(ctx, records[i].ID)
+			if err != nil || cmd.Status != es.CommandStatusFinished {
+				return false
+			}
+		}
+		return true
+	}, 4*time.Second, 20*time.Millisecond)
+	for i := range records {
+		cmd, err := store.GetCommand(ctx, records[i].ID)
+		require.NoError(t, err)
+		require.Equal(t, 1, cmd.Attempts, "command %s was processed twice", cmd.ID)
+	}
+
+	cancel()
+	for i := range stopped {
+		require.NoError(t, <-stopped[i])
+	}
+	leases, err := store.ListLeases(context.Background(), "commands:counter:")
+	require.NoError(t, err)
+	require.Empty(t, leases, "the leases are released on stop")
+}
+
+func TestWaitForCommand(t *testing.T) {
+	store := mock.NewEventStore()
+	processor, err := es.NewCommandProcessor(1, store, newRegistry(), "counter", es.WithMaxAttempts(1))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	save := func(rec es.CommandRecord) string {
+		ids, err := store.SaveCommandRecords(ctx, rec)
+		require.NoError(t, err)
+		return ids[0]
+	}
+	first := save(newCommandRecord(t, "1", 4))
+
+	// the command is not processed in time
+	waitCtx, waitCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	result, err := es.WaitForCommand(waitCtx, store, first)
+	waitCancel()
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.False(t, result.Done())
+	require.Equal(t, es.CommandStatusPending, result.Command.Status)
+
+	done := make(chan error)
+	go func() {
+		done <- processor.Start(ctx)
+	}()
+
+	result, err = es.WaitForCommand(ctx, store, first)
+	require.NoError(t, err)
+	require.True(t, result.Done())
+	require.NoError(t, result.Err())
+	require.Len(t, result.Events, 1)
+	require.Equal(t, "incremented", result.Events[0].EventType)
+	require.Equal(t, first, result.Events[0].CommandID)
+
+	rejected := save(newCommandRecord(t, "1", 7))
+	result, err = es.WaitForCommand(ctx, store, rejected)
+	require.NoError(t, err)
+	require.ErrorIs(t, result.Err(), es.ErrCommandRejected)
+	require.Contains(t, result.Err().Error(), "counter overflow")
+
+	poison, err := es.CommandToCommandRecord("counter", &explode{ID: "1"})
+	require.NoError(t, err)
+	result, err = es.WaitForCommand(ctx, store, save(poison))
+	require.NoError(t, err)
+	require.Equal(t, es.CommandStatusFailure, result.Command.Status)
+	require.ErrorIs(t, result.Err(), es.ErrCommandFailed)
+	require.Empty(t, result.Events)
+
+	_, err = es.WaitForCommand(ctx, store, "missing")
+	require.Error(t, err)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestScheduledCommands(t *testing.T) {
+	store := mock.NewEventStore()
+	processor, err := es.NewCommandProcessor(1, store, newRegistry(), "counter")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- processor.Start(ctx)
+	}()
+
+	save := func(by int, notBefore time.Time) string {
+		rec := newCommandRecord(t, "1", by)
+		if !notBefore.IsZero() {
+			rec.NotBefore = &notBefore
+		}
+		ids, err := store.SaveCommandRecords(ctx, rec)
+		require.NoError(t, err)
+		return ids[0]
+	}
+	start := time.Now()
+	scheduled := save(2, start.Add(300*time.Millisecond))
+	cancelled := save(3, start.Add(time.Hour))
+	next := save(1, time.Time{})
+
+	// the command after the scheduled ones is not held back
+	result, err := es.WaitForCommand(ctx, store, next)
+	require.NoError(t, err)
+	require.NoError(t, result.Err())
+	require.Equal(t, 1, result.Events[0].Version)
+
+	result, err = es.WaitForCommand(ctx, store, scheduled)
+	require.NoError(t, err)
+	require.NoError(t, result.Err())
+	require.Equal(t, 2, result.Events[0].Version)
+	require.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+
+	require.NoError(t, store.CancelCommand(ctx, cancelled))
+	result, err = es.WaitForCommand(ctx, store, cancelled)
+	require.NoError(t, err)
+	require.ErrorIs(t, result.Err(), es.ErrCommandCancelled)
+	require.Empty(t, result.Events)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestCommandProcessorFailures(t *testing.T) {
+	store := mock.NewEventStore()
+	registry := newRegistry()
+	processor, err := es.NewCommandProcessor(1, store, registry, "counter", es.WithMaxAttempts(2),
+		es.WithRetryBackoff(200*time.Millisecond, time.Second))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- processor.Start(ctx)
+	}()
+
+	poison, err := es.CommandToCommandRecord("counter", &explode{ID: "1"})
+	require.NoError(t, err)
+	unknown := newCommandRecord(t, "1", 1)
+	unknown.EventType = "unknown"
+	next := newCommandRecord(t, "1", 1)
+	_, err = store.SaveCommandRecords(ctx, poison, unknown, next)
+	require.NoError(t, err)
+	start := time.Now()
+
+	require.Eventually(t, func() bool {
+		cmd, err := store.GetCommand(ctx, next.ID)
+		return err == nil && cmd.Status == es.CommandStatusFinished
+	}, 4*time.Second, 50*time.Millisecond)
+
+	cmd, err := store.GetCommand(ctx, poison.ID)
+	require.NoError(t, err)
+	require.Equal(t, es.CommandStatusFailure, cmd.Status)
+	require.Equal(t, 2, cmd.Attempts)
+	require.Contains(t, cmd.LastError, "boom")
+	require.NotNil(t, cmd.ProcessedAt)
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond, "the retry waits for the backoff")
+	finished, err := store.GetCommand(ctx, next.ID)
+	require.NoError(t, err)
+	require.False(t, finished.ProcessedAt.Before(*cmd.ProcessedAt), "the next command of the aggregate waits for the retries")
+
+	// commands that can never succeed are not retried
+	cmd, err = store.GetCommand(ctx, unknown.ID)
+	require.NoError(t, err)
+	require.Equal(t, es.CommandStatusFailure, cmd.Status)
+	require.Equal(t, 1, cmd.Attempts)
+	require.Contains(t, cmd.LastError, "no converter")
+
+	cancel()
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,44 @@
+// Package msgpack encodes the payloads of the commands and the events with
+// MessagePack.
+package msgpack
+
+import (
+	"bytes"
+
+	"github.com/gosom/kit/es"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Name is the name of the codec.
+const Name = "msgpack"
+
+var _ es.Codec = (*Codec)(nil)
+
+// Codec is the MessagePack codec. The fields are named after their json
+// tags, so the commands and the events need no msgpack tags.
+type Codec struct{}
+
+// NewCodec returns the MessagePack codec.
+func NewCodec() *Codec {
+	return &Codec{}
+}
+
+func (c *Codec) Name() string {
+	return Name
+}
+
+func (c *Codec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Codec) Unmarshal(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
@@ -0,0 +1,118 @@
+package es
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gosom/kit/lib"
+	"github.com/gosom/kit/logging"
+)
+
+// partitionLeases spreads the partitions of the command processor over the
+// running instances. Every instance holds a node lease, the partitions are
+// assigned round robin to the live nodes ordered by owner, and an instance
+// processes a partition only while it holds its lease.
+// When nodes come and go the partitions are released and taken over by
+// their new owner.
+type partitionLeases struct {
+	store      EventStore
+	prefix     string
+	partitions int
+	ttl        time.Duration
+	node       *leaseHolder
+	holders    map[int]*leaseHolder
+	assigned   map[int]bool
+	refreshAt  time.Time
+	log        logging.Logger
+}
+
+func newPartitionLeases(store EventStore, domain string, partitions int, ttl time.Duration, log logging.Logger) *partitionLeases {
+	prefix := fmt.Sprintf("commands:%s:", domain)
+	owner := lib.MustNewULID()
+	return &partitionLeases{
+		store:      store,
+		prefix:     prefix,
+		partitions: partitions,
+		ttl:        ttl,
+		node:       newLeaseHolder(store, prefix+"node:"+owner, owner, ttl, log),
+		holders:    make(map[int]*leaseHolder),
+		log:        log,
+	}
+}
+
+// hold renews the leases and returns the partitions that this instance owns.
+func (p *partitionLeases) hold(ctx context.Context) []int {
+	if !p.node.hold(ctx) {
+		p.releasePartitions()
+		p.refreshAt = time.Time{}
+		return nil
+	}
+	if now := time.Now(); now.After(p.refreshAt) {
+		if err := p.assign(ctx); err != nil {
+			p.log.Error("cannot assign partitions", "error", err)
+		} else {
+			p.refreshAt = now.Add(p.ttl / 3)
+		}
+	}
+	var ans []int
+	for partition, holder := range p.holders {
+		if !p.assigned[partition] {
+			holder.release()
+		}
+	}
+	for partition := 0; partition < p.partitions; partition++ {
+		if !p.assigned[partition] {
+			continue
+		}
+		holder, ok := p.holders[partition]
+		if !ok {
+			holder = newLeaseHolder(p.store, fmt.Sprintf("%spartition:%d", p.prefix, partition), p.node.owner, p.ttl, p.log)
+			p.holders[partition] = holder
+		}
+		if holder.hold(ctx) {
+			ans = append(ans, partition)
+		}
+	}
+	return ans
+}
+
+// assign computes the partitions of this instance from the live nodes.
+func (p *partitionLeases) assign(ctx context.Context) error {
+	leases, err := p.store.ListLeases(ctx, p.prefix+"node:")
+	if err != nil {
+		return err
+	}
+	owners := make([]string, 0, len(leases))
+	for i := range leases {
+		owners = append(owners, leases[i].Owner)
+	}
+	sort.Strings(owners)
+	index := sort.SearchStrings(owners, p.node.owner)
+	if index == len(owners) || owners[index] != p.node.owner {
+		// the node lease is not visible, it expired meanwhile
+		return fmt.Errorf("node %s is not live", p.node.owner)
+	}
+	assigned := make(map[int]bool)
+	for partition := index; partition < p.partitions; partition += len(owners) {
+		assigned[partition] = true
+	}
+	if len(assigned) != len(p.assigned) {
+		p.log.Info("partitions assigned", "nodes", len(owners), "partitions", len(assigned))
+	}
+	p.assigned = assigned
+	return nil
+}
+
+func (p *partitionLeases) releasePartitions() {
+	for _, holder := range p.holders {
+		holder.release()
+	}
+}
+
+// release releases all the leases.
+func (p *partitionLeases) release() {
+	p.releasePartitions()
+	p.node.release()
+}
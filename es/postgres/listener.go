@@ -0,0 +1,101 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/gosom/kit/es"
+	"github.com/gosom/kit/logging"
+)
+
+var _ es.Trigger = (*Listener)(nil)
+
+// Listener is an es.Trigger that uses LISTEN/NOTIFY.
+// The event store tables notify the es.CommandsChannel and es.EventsChannel
+// channels on insert. It uses a dedicated connection that is opened on the
+// first subscription.
+type Listener struct {
+	es.Broadcaster
+
+	dsn      string
+	mu       sync.Mutex
+	listener *pq.Listener
+	log      logging.Logger
+}
+
+func NewListener(dsn string) *Listener {
+	return &Listener{dsn: dsn, log: logging.Get().With("component", "listener")}
+}
+
+// Subscribe listens to the channel. It waits a few seconds for the connection,
+// after that the subscription is returned anyway and receives notifications
+// once the connection is established.
+func (l *Listener) Subscribe(ctx context.Context, channel string) (<-chan struct{}, error) {
+	listener, err := l.connect()
+	if err != nil {
+		return nil, err
+	}
+	ans, err := l.Broadcaster.Subscribe(ctx, channel)
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- listener.Listen(channel)
+	}()
+	select {
+	case err := <-done:
+		if err != nil && !errors.Is(err, pq.ErrChannelAlreadyOpen) {
+			return nil, err
+		}
+	case <-time.After(5 * time.Second):
+		l.log.Warn("listener is not connected yet", "channel", channel)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return ans, nil
+}
+
+// Close closes the connection of the listener.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.listener == nil {
+		return nil
+	}
+	err := l.listener.Close()
+	l.listener = nil
+	return err
+}
+
+func (l *Listener) connect() (*pq.Listener, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.dsn == "" {
+		return nil, errors.New("listener needs a dsn")
+	}
+	if l.listener == nil {
+		l.listener = pq.NewListener(l.dsn, 100*time.Millisecond, 10*time.Second, func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				l.log.Error("listener connection error", "error", err)
+			}
+		})
+		go l.run(l.listener)
+	}
+	return l.listener, nil
+}
+
+func (l *Listener) run(listener *pq.Listener) {
+	for n := range listener.Notify {
+		if n == nil {
+			// the connection was re-established, notifications may have been lost
+			l.NotifyAll()
+			continue
+		}
+		l.Notify(n.Channel)
+	}
+}
@@ -3,106 +3,367 @@ package postgres
 const (
 	saveCommandsStmt = `
 	INSERT INTO "commands" 
-		(id, aggregate_id, event_type, data, created_at, aggregate_hash)
+		(id, aggregate_id, event_type, data, created_at, aggregate_hash, idempotency_key, not_before, correlation_id, causation_id, metadata,
+		tenant, codec)
 	VALUES
 		%s
 	ON CONFLICT DO NOTHING
 	RETURNING id`
 
+	claimIdempotencyKeyStmt = `
+	INSERT INTO "idempotency_keys"
+		(domain, key, command_id, expires_at, tenant)
+	VALUES
+		($1, $2, $3, clock_timestamp() + $4 * interval '1 millisecond', $5)
+	ON CONFLICT (tenant, domain, key) DO UPDATE
+	SET command_id = EXCLUDED.command_id, expires_at = EXCLUDED.expires_at
+	WHERE "idempotency_keys".expires_at < clock_timestamp()
+	RETURNING command_id`
+
+	getIdempotencyKeyStmt = `
+	SELECT command_id
+	FROM "idempotency_keys"
+	WHERE domain = $1 AND key = $2 AND tenant = $3`
+
 	getCommandStmt = `
 	SELECT
-		id, aggregate_id, event_type, data, created_at, aggregate_hash, status
+		id, aggregate_id, event_type, data, created_at, aggregate_hash, status::text,
+		attempts, last_error, processed_at, idempotency_key, not_before,
+		correlation_id, causation_id, metadata, tenant, codec
 	FROM
 		"commands"
 	WHERE
-		id = $1`
+		id = $1 AND tenant = $2`
 
 	selectCommandsToProcess = `
 	WITH cte AS (
 		SELECT 
 		id, aggregate_id, event_type, data, created_at, aggregate_hash, 
-		status, ROW_NUMBER() 
+		status, attempts, last_error, processed_at, idempotency_key, not_before,
+		correlation_id, causation_id, metadata, tenant, codec,
+		MOD(aggregate_hash, $1) AS partition, ROW_NUMBER() 
 		OVER (PARTITION BY MOD(aggregate_hash, $1) ORDER BY id ASC) AS rn
-		FROM "commands"
-		WHERE status IS NULL
+		FROM "commands" c
+		WHERE status IN ('pending', 'running')
+		AND (not_before IS NULL OR not_before <= NOW())
+		-- the later commands of an aggregate wait for its retried command
+		AND NOT EXISTS (
+			SELECT 1 FROM "commands" r
+			WHERE r.tenant = c.tenant AND r.aggregate_id = c.aggregate_id AND r.id < c.id
+			AND r.status = 'pending' AND r.attempts > 0 AND r.not_before > NOW()
+		)
+		AND (cardinality($3::int[]) = 0 OR MOD(aggregate_hash, $1) = ANY($3::int[]))
+		AND ($5 OR tenant = $4)
 	)
 	SELECT 
 	id, aggregate_id, event_type, data, created_at, 
-	aggregate_hash, COALESCE(status::text, ''), rn
+	aggregate_hash, status::text, attempts, last_error, processed_at, idempotency_key, not_before,
+	correlation_id, causation_id, metadata, tenant, codec, partition
 	FROM cte
 	WHERE rn <= $2
+	ORDER BY partition, id ASC
 	`
 
 	checkVersionStmt = `
 	UPDATE "aggregate_versions"
 	SET version = version + $1
-	WHERE aggregate_id = $2 AND version = $3
+	WHERE aggregate_id = $2 AND version = $3 AND tenant = $4
 	`
 
+	// lockEventsStmt serializes the transactions that store events until they commit,
+	// so global positions are assigned in commit order and a subscription
+	// never skips an event that commits late. The lock is global: only one
+	// transaction of the database stores events at a time, whatever its
+	// aggregate or tenant, which caps the write throughput. It is taken last,
+	// right before the events are inserted.
+	lockEventsStmt = `SELECT pg_advisory_xact_lock(hashtext('es_events'))`
+
+	// saveEventsStmt runs under lockEventsStmt. The events take the time of the
+	// insert instead of the start of the transaction, so their times follow
+	// their global positions, see getPositionAtStmt.
 	saveEventsStmt = `
 	INSERT INTO "events"
-		(id, command_id, aggregate_id, version, event_type, data)
+		(id, command_id, aggregate_id, version, event_type, data, schema_version, correlation_id, causation_id, metadata,
+		tenant, codec, created_at)
 	VALUES
-		($1, $2, $3, $4, $5, $6)
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, clock_timestamp())
 	`
 	updateCommandStatusStmt = `
 	UPDATE "commands"
-		SET status = $1
-	WHERE id = $2`
+		SET status = $1, processed_at = (NOW() at time zone 'utc')
+	WHERE id = $2 AND tenant = $3`
+
+	markCommandRunningStmt = `
+	UPDATE "commands"
+		SET status = 'running', attempts = attempts + 1
+	WHERE id = $1 AND tenant = $2 AND status IN ('pending', 'running')
+	RETURNING attempts`
+
+	cancelCommandStmt = `
+	UPDATE "commands"
+		SET status = 'cancelled', processed_at = (NOW() at time zone 'utc')
+	WHERE id = $1 AND tenant = $2 AND status = 'pending'`
+
+	markCommandFailedStmt = `
+	UPDATE "commands"
+		SET status = $2, last_error = $3,
+		processed_at = CASE WHEN $2 = 'failure' THEN (NOW() at time zone 'utc') ELSE NULL END,
+		not_before = COALESCE($5, not_before)
+	WHERE id = $1 AND tenant = $4`
 
 	getOrCreateAggregateVersionStmt = `
 	WITH cte AS (
 		INSERT INTO "aggregate_versions"
-			(aggregate_id, version)
+			(aggregate_id, version, tenant)
 		VALUES
-			($1, 0)
-		ON CONFLICT (aggregate_id) DO NOTHING
+			($1, 0, $2)
+		ON CONFLICT (tenant, aggregate_id) DO NOTHING
 		RETURNING aggregate_id, version
 	)
 	SELECT aggregate_id, version FROM cte
 	UNION
-	SELECT aggregate_id, version FROM "aggregate_versions" WHERE aggregate_id = $1`
+	SELECT aggregate_id, version FROM "aggregate_versions" WHERE aggregate_id = $1 AND tenant = $2`
 
 	insertSubStmt = `
 	WITH cte AS (
 		INSERT INTO "subscriptions"
-		(subscription_group)
+		(subscription_group, tenant)
 		VALUES
-		($1)
+		($1, $2)
 		ON CONFLICT DO NOTHING
-		RETURNING subscription_group, last_event_id, updated_at
+		RETURNING subscription_group, position, paused, updated_at, tenant
 	)
-	SELECT subscription_group, COALESCE(last_event_id, ''), updated_at FROM cte
+	SELECT subscription_group, position, paused, updated_at, tenant FROM cte
 	UNION
-	SELECT subscription_group, COALESCE(last_event_id, ''), updated_at FROM "subscriptions" WHERE subscription_group = $1`
+	SELECT subscription_group, position, paused, updated_at, tenant FROM "subscriptions"
+	WHERE subscription_group = $1 AND tenant = $2`
 
 	selectEventsForSubStmt = `
-	WITH cte AS (
-	SELECT 
-		COALESCE(last_event_id, '') AS last_event_id
-	FROM "subscriptions"
-	WHERE subscription_group = $1
-	)
-	SELECT id, aggregate_id, event_type, data, created_at, command_id, version
+	SELECT id, aggregate_id, event_type, data, created_at, command_id, version, schema_version, global_position,
+	correlation_id, causation_id, metadata, tenant, codec
 	FROM events
 	WHERE 
-	id > (SELECT last_event_id FROM cte)
+	global_position > (SELECT position FROM "subscriptions" WHERE subscription_group = $1 AND tenant = $3 AND NOT paused)
 	AND event_type != 'EventError'
-	ORDER BY id, version ASC
+	AND ($4 OR tenant = $3)
+	ORDER BY global_position ASC
 	LIMIT $2`
 
 	updateSubStmt = `
 	UPDATE "subscriptions"
-	SET last_event_id = $2, updated_at = (NOW() at time zone 'utc')
-	WHERE subscription_group = $1
-	RETURNING subscription_group, last_event_id, updated_at`
+	SET position = $3, updated_at = (NOW() at time zone 'utc')
+	WHERE subscription_group = $1 AND position = $2 AND tenant = $4
+	RETURNING subscription_group, position, paused, updated_at, tenant`
+
+	getSubStmt = `
+	SELECT subscription_group, position, paused, updated_at, tenant
+	FROM "subscriptions"
+	WHERE subscription_group = $1 AND tenant = $2`
+
+	listSubsStmt = `
+	SELECT s.subscription_group, s.position, s.paused, s.updated_at, s.tenant,
+		(SELECT COUNT(*) FROM "events" e
+		WHERE e.global_position > s.position AND e.event_type != 'EventError'
+		AND (($2 AND s.tenant = '') OR e.tenant = s.tenant)) AS lag
+	FROM "subscriptions" s
+	WHERE s.tenant = $1
+	ORDER BY s.subscription_group`
+
+	resetSubStmt = `
+	UPDATE "subscriptions"
+	SET position = $2, updated_at = (NOW() at time zone 'utc')
+	WHERE subscription_group = $1 AND tenant = $3
+	RETURNING subscription_group, position, paused, updated_at, tenant`
+
+	pauseSubStmt = `
+	UPDATE "subscriptions"
+	SET paused = $2, updated_at = (NOW() at time zone 'utc')
+	WHERE subscription_group = $1 AND tenant = $3
+	RETURNING subscription_group, position, paused, updated_at, tenant`
+
+	deleteSubStmt = `
+	DELETE FROM "subscriptions"
+	WHERE subscription_group = $1 AND tenant = $2`
+
+	getEventPositionStmt = `
+	SELECT global_position FROM "events" WHERE id = $1 AND ($3 OR tenant = $2)`
+
+	getPositionAtStmt = `
+	SELECT COALESCE(MAX(global_position), 0) FROM "events" WHERE created_at < $1 AND ($3 OR tenant = $2)`
+
+	loadCommandEventsStmt = `
+	SELECT id, aggregate_id, event_type, data, created_at, command_id, version, schema_version, global_position,
+	correlation_id, causation_id, metadata, tenant, codec
+	FROM events
+	WHERE command_id = $1 AND tenant = $2
+	ORDER BY version ASC
+	`
 
 	loadEventsStmt = `
-	SELECT id, aggregate_id, event_type, data, created_at, command_id, version
+	SELECT id, aggregate_id, event_type, data, created_at, command_id, version, schema_version, global_position,
+	correlation_id, causation_id, metadata, tenant, codec
 	FROM events
 	WHERE 
 	aggregate_id = $1
+	AND tenant = $2
 	AND event_type != 'EventError'
 	ORDER BY id, version ASC
 	`
+
+	loadEventsFromVersionStmt = `
+	SELECT id, aggregate_id, event_type, data, created_at, command_id, version, schema_version, global_position,
+	correlation_id, causation_id, metadata, tenant, codec
+	FROM events
+	WHERE 
+	aggregate_id = $1
+	AND version > $2
+	AND tenant = $3
+	AND event_type != 'EventError'
+	ORDER BY version ASC
+	`
+
+	loadEventsUntilStmt = `
+	SELECT id, aggregate_id, event_type, data, created_at, command_id, version, schema_version, global_position,
+	correlation_id, causation_id, metadata, tenant, codec
+	FROM events
+	WHERE 
+	aggregate_id = $1
+	AND ($2 = 0 OR version <= $2)
+	AND ($3::timestamptz IS NULL OR created_at <= $3)
+	AND tenant = $4
+	AND event_type != 'EventError'
+	ORDER BY version ASC
+	`
+
+	queryEventsStmt = `
+	SELECT id, aggregate_id, event_type, data, created_at, command_id, version, schema_version, global_position,
+	correlation_id, causation_id, metadata, tenant, codec
+	FROM events
+	WHERE 
+	tenant = $1
+	AND global_position > $2
+	AND ($3 = '' OR aggregate_id = $3)
+	AND ($4 = '' OR split_part(aggregate_id, '-', 1) = $4)
+	AND (cardinality($5::text[]) = 0 AND event_type != 'EventError' OR event_type = ANY($5::text[]))
+	AND ($6 = '' OR command_id = $6)
+	AND ($7::timestamptz IS NULL OR created_at >= $7)
+	AND ($8::timestamptz IS NULL OR created_at < $8)
+	ORDER BY global_position ASC
+	LIMIT NULLIF($9, 0)
+	`
+
+	saveSnapshotStmt = `
+	INSERT INTO "snapshots"
+		(aggregate_id, aggregate_type, version, schema_version, data, created_at, tenant)
+	VALUES
+		($1, $2, $3, $4, $5, $6, $7)
+	ON CONFLICT (tenant, aggregate_id) DO UPDATE
+	SET aggregate_type = EXCLUDED.aggregate_type,
+		version = EXCLUDED.version,
+		schema_version = EXCLUDED.schema_version,
+		data = EXCLUDED.data,
+		created_at = EXCLUDED.created_at
+	WHERE "snapshots".version < EXCLUDED.version
+		OR "snapshots".schema_version != EXCLUDED.schema_version`
+
+	loadSnapshotStmt = `
+	SELECT aggregate_id, aggregate_type, version, schema_version, data, created_at
+	FROM "snapshots"
+	WHERE aggregate_id = $1 AND tenant = $2`
+
+	getOrCreateKeyStmt = `
+	WITH cte AS (
+		INSERT INTO "encryption_keys"
+			(subject, key, tenant)
+		VALUES
+			($1, $2, $3)
+		ON CONFLICT (tenant, subject) DO NOTHING
+		RETURNING subject, key
+	)
+	SELECT subject, key FROM cte
+	UNION ALL
+	SELECT subject, key FROM "encryption_keys" WHERE subject = $1 AND tenant = $3`
+
+	getKeyStmt = `
+	SELECT subject, key FROM "encryption_keys" WHERE subject = $1 AND tenant = $2`
+
+	forgetSubjectStmt = `
+	INSERT INTO "encryption_keys"
+		(subject, key, forgotten_at, tenant)
+	VALUES
+		($1, NULL, (NOW() at time zone 'utc'), $2)
+	ON CONFLICT (tenant, subject) DO UPDATE
+	SET key = NULL, forgotten_at = EXCLUDED.forgotten_at`
+
+	deleteSubjectSnapshotsStmt = `
+	DELETE FROM "snapshots"
+	WHERE tenant = $2 AND (aggregate_id = $1 OR aggregate_id IN (
+		SELECT aggregate_id FROM "events" WHERE tenant = $2 AND metadata->>'pii_subject' = $1
+	))`
+
+	// setTenantStmt scopes the transaction to the tenant, or to all the
+	// tenants with the system scope, for the row level security policies.
+	setTenantStmt = `SELECT set_config('es.tenant', $1, true), set_config('es.scope', $2, true)`
+
+	acquireLeaseStmt = `
+	INSERT INTO "leases"
+		(name, owner, expires_at)
+	VALUES
+		($1, $2, clock_timestamp() + $3 * interval '1 millisecond')
+	ON CONFLICT (name) DO UPDATE
+	SET owner = EXCLUDED.owner, expires_at = EXCLUDED.expires_at
+	WHERE "leases".owner = EXCLUDED.owner OR "leases".expires_at < clock_timestamp()
+	RETURNING owner`
+
+	releaseLeaseStmt = `
+	DELETE FROM "leases"
+	WHERE name = $1 AND owner = $2`
+
+	listLeasesStmt = `
+	SELECT name, owner, expires_at
+	FROM "leases"
+	WHERE left(name, length($1)) = $1 AND expires_at > clock_timestamp()
+	ORDER BY name`
+
+	insertDeadLetterStmt = `
+	INSERT INTO "dead_letter_events"
+		(subscription_group, event_id, last_error, tenant)
+	SELECT $1, id, $3, $4
+	FROM "events"
+	WHERE id = $2 AND ($5 OR tenant = $4)
+	ON CONFLICT (tenant, subscription_group, event_id) DO UPDATE
+	SET last_error = EXCLUDED.last_error`
+
+	listDeadLettersStmt = `
+	SELECT
+		d.subscription_group,
+		e.id, e.aggregate_id, e.event_type, e.data, e.created_at, e.command_id, e.version, e.schema_version,
+		e.global_position, e.correlation_id, e.causation_id, e.metadata, e.tenant, e.codec,
+		d.last_error, d.created_at
+	FROM "dead_letter_events" d
+	JOIN "events" e ON e.id = d.event_id
+	WHERE d.subscription_group = $1 AND d.tenant = $3
+	ORDER BY e.global_position ASC
+	LIMIT NULLIF($2, 0)`
+
+	deleteDeadLetterStmt = `
+	DELETE FROM "dead_letter_events"
+	WHERE subscription_group = $1 AND event_id = $2 AND tenant = $3`
+
+	getSagaInstanceStmt = `
+	SELECT saga, id, status, state, compensations, position, version, created_at, updated_at
+	FROM "saga_instances"
+	WHERE saga = $1 AND id = $2 AND tenant = $3`
+
+	insertSagaInstanceStmt = `
+	INSERT INTO "saga_instances"
+		(saga, id, status, state, compensations, position, version, created_at, updated_at, tenant)
+	VALUES
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	ON CONFLICT DO NOTHING`
+
+	updateSagaInstanceStmt = `
+	UPDATE "saga_instances"
+		SET status = $3, state = $4, compensations = $5, position = $6, version = $7, updated_at = $8
+	WHERE saga = $1 AND id = $2 AND version = $7 - 1 AND tenant = $9`
 )
@@ -2,8 +2,13 @@ package postgres
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
+
+	"github.com/lib/pq"
 
 	"github.com/gosom/kit/es"
 	"github.com/gosom/kit/es/assets"
@@ -20,44 +25,241 @@ func (o *aggregateVersion) Bind() []any {
 	return []any{&o.AggregateID, &o.Version}
 }
 
+type dataKey struct {
+	Subject string
+	Key     []byte
+}
+
+func (o *dataKey) Bind() []any {
+	return []any{&o.Subject, &o.Key}
+}
+
 type commandRecord struct {
 	es.CommandRecord
-	Rn int
+	Partition int
 }
 
 func (o *commandRecord) Bind() []any {
 	ans := o.CommandRecord.Bind()
-	ans = append(ans, &o.Rn)
+	ans = append(ans, &o.Partition)
 	return ans
 }
 
 var _ es.EventStore = (*EventStore)(nil)
+var _ es.SnapshotStore = (*EventStore)(nil)
+var _ es.KeyStore = (*EventStore)(nil)
+var _ es.Trigger = (*EventStore)(nil)
 
+// EventStore is the Postgres implementation of es.EventStore.
+// It scopes every query to the tenant of the context, see es.ContextWithTenant.
+//
+// The transactions that store events are serialized by a database wide lock
+// that is held until they commit, so the global positions of the events
+// follow their commit order. Only one command result is written at a time,
+// across all the aggregates and tenants, and the write throughput of the
+// events is bounded by the latency of a single commit.
 type EventStore struct {
-	db  *sqldb.DB
-	log logging.Logger
+	db               *sqldb.DB
+	listener         *Listener
+	idempotencyTTL   time.Duration
+	rowLevelSecurity bool
+	log              logging.Logger
+}
+
+// StoreOption configures the EventStore.
+type StoreOption func(*EventStore)
+
+// WithIdempotencyTTL sets how long the idempotency keys of the commands are valid.
+// The default is es.DefaultIdempotencyTTL.
+func WithIdempotencyTTL(ttl time.Duration) StoreOption {
+	return func(e *EventStore) {
+		e.idempotencyTTL = ttl
+	}
+}
+
+// WithRowLevelSecurity makes the store run the queries of a tenant in
+// transactions that set es.tenant and es.scope. The row level security
+// policies of the tables then hide the rows of the other tenants, even from
+// a query that does not filter them. Only a context with the system scope,
+// see es.ContextWithSystemScope, sees the rows of all the tenants. The
+// policies apply to the owner of the tables too.
+func WithRowLevelSecurity() StoreOption {
+	return func(e *EventStore) {
+		e.rowLevelSecurity = true
+	}
+}
+
+func NewEventStore(db *sqldb.DB, options ...StoreOption) *EventStore {
+	ans := EventStore{
+		db:             db,
+		listener:       NewListener(db.DSN),
+		idempotencyTTL: es.DefaultIdempotencyTTL,
+		log:            logging.Get().With("component", "store"),
+	}
+	for _, o := range options {
+		o(&ans)
+	}
+	return &ans
 }
 
-func NewEventStore(db *sqldb.DB) *EventStore {
-	return &EventStore{db: db, log: logging.Get().With("component", "store")}
+// Subscribe listens for notifications of the channel using LISTEN/NOTIFY.
+func (e *EventStore) Subscribe(ctx context.Context, channel string) (<-chan struct{}, error) {
+	return e.listener.Subscribe(ctx, channel)
+}
+
+// Close closes the connection used for notifications.
+// It does not close the database.
+func (e *EventStore) Close() error {
+	return e.listener.Close()
+}
+
+// conn is implemented by *sql.DB and *sql.Tx.
+type conn interface {
+	sqldb.DBTX
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// begin begins a transaction in the scope of the tenant of ctx, or of all
+// the tenants when ctx has the system scope.
+func (e *EventStore) begin(ctx context.Context) (*sql.Tx, error) {
+	tx, err := e.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if e.rowLevelSecurity {
+		scope := "tenant"
+		if es.SystemScopeFromContext(ctx) {
+			scope = "system"
+		}
+		if _, err := tx.ExecContext(ctx, setTenantStmt, es.TenantFromContext(ctx), scope); err != nil {
+			_ = tx.Rollback()
+			return nil, fmt.Errorf("error setting tenant: %w", err)
+		}
+	}
+	return tx, nil
+}
+
+// scoped runs fn in the scope of the tenant of ctx. With row level security
+// fn runs in a transaction, otherwise on the database.
+func (e *EventStore) scoped(ctx context.Context, fn func(conn conn) error) error {
+	if !e.rowLevelSecurity {
+		return fn(e.db.Conn())
+	}
+	tx, err := e.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (e *EventStore) SaveCommandRecords(ctx context.Context, records ...es.CommandRecord) ([]string, error) {
+	records, err := resolveTenants(ctx, records)
+	if err != nil {
+		return nil, err
+	}
+	keyed := false
+	for i := range records {
+		if records[i].IdempotencyKey != "" {
+			keyed = true
+			break
+		}
+	}
+	if !keyed {
+		var ids []string
+		err := e.scoped(ctx, func(conn conn) (err error) {
+			ids, err = saveCommands(ctx, conn, records...)
+			return err
+		})
+		return ids, err
+	}
+	tx, err := e.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	var ids []string
+	for i := range records {
+		if records[i].IdempotencyKey == "" {
+			saved, err := saveCommands(ctx, tx, records[i])
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, saved...)
+			continue
+		}
+		domain := records[i].Domain()
+		var commandID string
+		err := tx.QueryRowContext(ctx, claimIdempotencyKeyStmt, domain, records[i].IdempotencyKey, records[i].ID, e.idempotencyTTL.Milliseconds(),
+			records[i].Tenant).Scan(&commandID)
+		switch {
+		case err == nil:
+			saved, err := saveCommands(ctx, tx, records[i])
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, saved...)
+		case errors.Is(err, sql.ErrNoRows):
+			// the key is in use, return the original command
+			if err := tx.QueryRowContext(ctx, getIdempotencyKeyStmt, domain, records[i].IdempotencyKey, records[i].Tenant).Scan(&commandID); err != nil {
+				return nil, fmt.Errorf("error getting idempotency key: %w", err)
+			}
+			ids = append(ids, commandID)
+		default:
+			return nil, fmt.Errorf("error claiming idempotency key: %w", err)
+		}
+	}
+	return ids, tx.Commit()
+}
+
+// resolveTenants returns a copy of the records with their tenant resolved.
+func resolveTenants(ctx context.Context, records []es.CommandRecord) ([]es.CommandRecord, error) {
+	ans := make([]es.CommandRecord, len(records))
+	for i := range records {
+		tenant, err := es.ResolveTenant(ctx, records[i].Tenant)
+		if err != nil {
+			return nil, err
+		}
+		ans[i] = records[i]
+		ans[i].Tenant = tenant
+	}
+	return ans, nil
+}
+
+func saveCommands(ctx context.Context, conn sqldb.DBTX, records ...es.CommandRecord) ([]string, error) {
+	const columns = 13
 	valueStrings := make([]string, 0, len(records))
-	valueArgs := make([]interface{}, 0, len(records)*6)
+	valueArgs := make([]interface{}, 0, len(records)*columns)
 	for i := range records {
-		valueStrings = append(valueStrings, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d)",
-			i*6+1, i*6+2, i*6+3, i*6+4, i*6+5, i*6+6))
+		placeholders := make([]string, columns)
+		for j := range placeholders {
+			placeholders[j] = fmt.Sprintf("$%d", i*columns+j+1)
+		}
+		valueStrings = append(valueStrings, "("+strings.Join(placeholders, ", ")+")")
 		valueArgs = append(valueArgs,
 			records[i].ID,
 			records[i].AggregateID,
 			records[i].EventType,
 			records[i].Data,
 			records[i].CreatedAt,
-			records[i].AggregateHash)
+			records[i].AggregateHash,
+			records[i].IdempotencyKey,
+			records[i].NotBefore,
+			records[i].CorrelationID,
+			records[i].CausationID,
+			records[i].Metadata,
+			records[i].Tenant,
+			records[i].Codec)
 	}
 	stmt := fmt.Sprintf(saveCommandsStmt, strings.Join(valueStrings, ","))
-	rows, err := e.db.Conn().QueryContext(ctx, stmt, valueArgs...)
+	rows, err := conn.QueryContext(ctx, stmt, valueArgs...)
 	if err != nil {
 		return nil, err
 	}
@@ -73,6 +275,13 @@ func (e *EventStore) SaveCommandRecords(ctx context.Context, records ...es.Comma
 	return ids, rows.Err()
 }
 
+// SaveCommand saves the command as a JSON encoded record.
+//
+// Deprecated: the command is saved without the codec of the registry, the
+// correlation and the metadata of ctx, and its personal data is not
+// encrypted. Encode the command with Registry.EncodeCommand, set its
+// correlation and metadata, encrypt it with Registry.EncryptCommandRecord and
+// save it with SaveCommandRecords.
 func (e *EventStore) SaveCommand(ctx context.Context, domain string, cmd es.ICommand) (string, error) {
 	rec, err := es.CommandToCommandRecord(domain, cmd)
 	if err != nil {
@@ -88,8 +297,11 @@ func (e *EventStore) SaveCommand(ctx context.Context, domain string, cmd es.ICom
 	return ids[0], nil
 }
 
-func (e *EventStore) GetCommand(ctx context.Context, commandID string) (es.CommandRecord, error) {
-	record, err := sqldb.QueryRow[es.CommandRecord](ctx, e.db.Conn(), getCommandStmt, commandID)
+func (e *EventStore) GetCommand(ctx context.Context, commandID string) (record es.CommandRecord, err error) {
+	err = e.scoped(ctx, func(conn conn) error {
+		record, err = sqldb.QueryRow[es.CommandRecord](ctx, conn, getCommandStmt, commandID, es.TenantFromContext(ctx))
+		return err
+	})
 	return record, err
 }
 
@@ -97,31 +309,33 @@ func (e *EventStore) Migrate(ctx context.Context) error {
 	return sqldb.Migrate(ctx, e.db, "es_schema_migrations", assets.Migrations)
 }
 
-func (e *EventStore) SelectForProcessing(ctx context.Context, workers int, limit int) ([][]es.CommandRecord, error) {
+func (e *EventStore) SelectForProcessing(ctx context.Context, workers int, limit int, partitions ...int) ([][]es.CommandRecord, error) {
 	ans := make([][]es.CommandRecord, workers)
 	for i := 0; i < workers; i++ {
 		ans[i] = make([]es.CommandRecord, 0, limit)
 	}
-	records, err := sqldb.Query[commandRecord](ctx, e.db.Conn(), selectCommandsToProcess, workers, limit)
+	// an empty array selects all the partitions, nil would select none
+	filter := make(pq.Int64Array, len(partitions))
+	for i := range partitions {
+		filter[i] = int64(partitions[i])
+	}
+	var records []commandRecord
+	err := e.scoped(ctx, func(conn conn) (err error) {
+		records, err = sqldb.Query[commandRecord](ctx, conn, selectCommandsToProcess, workers, limit, filter, es.TenantFromContext(ctx), es.SystemScopeFromContext(ctx))
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	if len(records) == 0 {
-		return ans, nil
-	}
-	current := 0
-	ans[0] = append(ans[0], records[0].CommandRecord)
-	for i := 1; i < len(records); i++ {
-		if records[i].Rn <= current {
-			current++
-		}
-		ans[current] = append(ans[current], records[i].CommandRecord)
+	for i := range records {
+		ans[records[i].Partition] = append(ans[records[i].Partition], records[i].CommandRecord)
 	}
 	return ans, nil
 }
 
 func (e *EventStore) StoreCommandResults(ctx context.Context, commandID string, expectedVersion int, events ...es.EventRecord) error {
-	tx, err := e.db.BeginTx(ctx, nil)
+	tenant := es.TenantFromContext(ctx)
+	tx, err := e.begin(ctx)
 	if err != nil {
 		return err
 	}
@@ -129,7 +343,7 @@ func (e *EventStore) StoreCommandResults(ctx context.Context, commandID string,
 		_ = tx.Rollback()
 	}()
 	if len(events) > 0 {
-		rs, err := tx.ExecContext(ctx, checkVersionStmt, len(events), events[0].AggregateID, expectedVersion)
+		rs, err := tx.ExecContext(ctx, checkVersionStmt, len(events), events[0].AggregateID, expectedVersion, tenant)
 		if err != nil {
 			return fmt.Errorf("error updating version: %w", err)
 		}
@@ -141,41 +355,429 @@ func (e *EventStore) StoreCommandResults(ctx context.Context, commandID string,
 			return es.ErrWrongExpectedVersion
 		}
 	}
+	rs, err := tx.ExecContext(ctx, updateCommandStatusStmt, es.CommandStatusFinished, commandID, tenant)
+	if err != nil {
+		return fmt.Errorf("error updating commandStatus: %w", err)
+	}
+	affected, err := rs.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("command %s not found: %w", commandID, sql.ErrNoRows)
+	}
+	// the global lock is held until the commit, it is taken after the other
+	// statements to keep the serialized part short
+	if len(events) > 0 {
+		if _, err := tx.ExecContext(ctx, lockEventsStmt); err != nil {
+			return fmt.Errorf("error locking events: %w", err)
+		}
+	}
 	for i := range events {
-		if _, err := tx.ExecContext(ctx, saveEventsStmt, events[i].ID, commandID, events[i].AggregateID, events[i].Version, events[i].EventType, events[i].Data); err != nil {
+		if _, err := tx.ExecContext(ctx, saveEventsStmt, events[i].ID, commandID, events[i].AggregateID, events[i].Version, events[i].EventType, events[i].Data, events[i].SchemaVersion,
+			events[i].CorrelationID, events[i].CausationID, events[i].Metadata, tenant, events[i].Codec); err != nil {
 			return fmt.Errorf("Error saving event %s: %w", events[i].ID, err)
 		}
 	}
-	if _, err := tx.ExecContext(ctx, updateCommandStatusStmt, "finished", commandID); err != nil {
-		return fmt.Errorf("error updating commandStatus: %w", err)
-	}
 	return tx.Commit()
 }
 
+func (e *EventStore) MarkCommandRunning(ctx context.Context, commandID string) (int, error) {
+	var attempts int
+	err := e.scoped(ctx, func(conn conn) error {
+		return conn.QueryRowContext(ctx, markCommandRunningStmt, commandID, es.TenantFromContext(ctx)).Scan(&attempts)
+	})
+	return attempts, err
+}
+
+func (e *EventStore) CancelCommand(ctx context.Context, commandID string) error {
+	affected, err := e.exec(ctx, cancelCommandStmt, commandID, es.TenantFromContext(ctx))
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		if _, err := e.GetCommand(ctx, commandID); err != nil {
+			return err
+		}
+		return es.ErrCommandNotPending
+	}
+	return nil
+}
+
+func (e *EventStore) MarkCommandFailed(ctx context.Context, commandID string, lastError string, final bool, retryAt time.Time) error {
+	status := es.CommandStatusPending
+	if final {
+		status = es.CommandStatusFailure
+	}
+	affected, err := e.exec(ctx, markCommandFailedStmt, commandID, status, lastError, es.TenantFromContext(ctx),
+		optionalTime(retryAt))
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// exec executes the statement in the scope of the tenant of ctx and returns
+// the number of affected rows.
+func (e *EventStore) exec(ctx context.Context, query string, args ...any) (int64, error) {
+	var affected int64
+	err := e.scoped(ctx, func(conn conn) error {
+		rs, err := conn.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		affected, err = rs.RowsAffected()
+		return err
+	})
+	return affected, err
+}
+
 func (e *EventStore) GetOrCreateVersion(ctx context.Context, aggregateID string) (int, error) {
-	rec, err := sqldb.QueryRow[aggregateVersion](ctx, e.db.Conn(), getOrCreateAggregateVersionStmt, aggregateID)
+	tenant := es.TenantFromContext(ctx)
+	var rec aggregateVersion
+	err := e.scoped(ctx, func(conn conn) (err error) {
+		rec, err = sqldb.QueryRow[aggregateVersion](ctx, conn, getOrCreateAggregateVersionStmt, aggregateID, tenant)
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		// a concurrent transaction inserted the row after our snapshot was taken
+		err = e.scoped(ctx, func(conn conn) (err error) {
+			rec, err = sqldb.QueryRow[aggregateVersion](ctx, conn, getOrCreateAggregateVersionStmt, aggregateID, tenant)
+			return err
+		})
+	}
 	if err != nil {
 		return 0, err
 	}
 	return rec.Version, nil
 }
 
+// subscription runs the query that returns a subscription in the scope of
+// the tenant of ctx.
+func (e *EventStore) subscription(ctx context.Context, query string, args ...any) (sub es.Subscription, err error) {
+	err = e.scoped(ctx, func(conn conn) error {
+		sub, err = sqldb.QueryRow[es.Subscription](ctx, conn, query, args...)
+		return err
+	})
+	return sub, err
+}
+
 func (e *EventStore) InsertSubscription(ctx context.Context, subscription string) (es.Subscription, error) {
-	sub, err := sqldb.QueryRow[es.Subscription](ctx, e.db.Conn(), insertSubStmt, subscription)
+	tenant := es.TenantFromContext(ctx)
+	sub, err := e.subscription(ctx, insertSubStmt, subscription, tenant)
+	if errors.Is(err, sql.ErrNoRows) {
+		// a concurrent transaction inserted the row after our snapshot was taken
+		sub, err = e.subscription(ctx, insertSubStmt, subscription, tenant)
+	}
 	return sub, err
 }
 
 func (e *EventStore) SelectEventsForSubscription(ctx context.Context, subscription es.Subscription, limit int) ([]es.EventRecord, error) {
-	records, err := sqldb.Query[es.EventRecord](ctx, e.db.Conn(), selectEventsForSubStmt, subscription.Group, limit)
+	return e.events(ctx, selectEventsForSubStmt, subscription.Group, limit, es.TenantFromContext(ctx), es.SystemScopeFromContext(ctx))
+}
+
+// events runs the query that returns events in the scope of the tenant of ctx.
+func (e *EventStore) events(ctx context.Context, query string, args ...any) (records []es.EventRecord, err error) {
+	err = e.scoped(ctx, func(conn conn) error {
+		records, err = sqldb.Query[es.EventRecord](ctx, conn, query, args...)
+		return err
+	})
 	return records, err
 }
 
-func (e *EventStore) UpdateSubscription(ctx context.Context, group string, lastSeen string) (es.Subscription, error) {
-	sub, err := sqldb.QueryRow[es.Subscription](ctx, e.db.Conn(), updateSubStmt, group, lastSeen)
+func (e *EventStore) UpdateSubscription(ctx context.Context, group string, from, to int64) (es.Subscription, error) {
+	sub, err := e.subscription(ctx, updateSubStmt, group, from, to, es.TenantFromContext(ctx))
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, gerr := e.GetSubscription(ctx, group); gerr == nil {
+			return sub, es.ErrSubscriptionChanged
+		}
+	}
 	return sub, err
 }
 
+func (e *EventStore) GetSubscription(ctx context.Context, group string) (es.Subscription, error) {
+	sub, err := e.subscription(ctx, getSubStmt, group, es.TenantFromContext(ctx))
+	if errors.Is(err, sql.ErrNoRows) {
+		return sub, es.ErrSubscriptionNotFound
+	}
+	return sub, err
+}
+
+func (e *EventStore) ListSubscriptions(ctx context.Context) (items []es.SubscriptionInfo, err error) {
+	err = e.scoped(ctx, func(conn conn) error {
+		items, err = sqldb.Query[es.SubscriptionInfo](ctx, conn, listSubsStmt, es.TenantFromContext(ctx), es.SystemScopeFromContext(ctx))
+		return err
+	})
+	return items, err
+}
+
+func (e *EventStore) ResetSubscription(ctx context.Context, group string, position int64) (es.Subscription, error) {
+	sub, err := e.subscription(ctx, resetSubStmt, group, position, es.TenantFromContext(ctx))
+	if errors.Is(err, sql.ErrNoRows) {
+		return sub, es.ErrSubscriptionNotFound
+	}
+	return sub, err
+}
+
+func (e *EventStore) SetSubscriptionPaused(ctx context.Context, group string, paused bool) (es.Subscription, error) {
+	sub, err := e.subscription(ctx, pauseSubStmt, group, paused, es.TenantFromContext(ctx))
+	if errors.Is(err, sql.ErrNoRows) {
+		return sub, es.ErrSubscriptionNotFound
+	}
+	return sub, err
+}
+
+func (e *EventStore) DeleteSubscription(ctx context.Context, group string) error {
+	affected, err := e.exec(ctx, deleteSubStmt, group, es.TenantFromContext(ctx))
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return es.ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+func (e *EventStore) GetEventPosition(ctx context.Context, eventID string) (int64, error) {
+	var position int64
+	err := e.scoped(ctx, func(conn conn) error {
+		return conn.QueryRowContext(ctx, getEventPositionStmt, eventID, es.TenantFromContext(ctx), es.SystemScopeFromContext(ctx)).Scan(&position)
+	})
+	return position, err
+}
+
+func (e *EventStore) GetPositionAt(ctx context.Context, at time.Time) (int64, error) {
+	var position int64
+	err := e.scoped(ctx, func(conn conn) error {
+		return conn.QueryRowContext(ctx, getPositionAtStmt, at, es.TenantFromContext(ctx), es.SystemScopeFromContext(ctx)).Scan(&position)
+	})
+	return position, err
+}
+
+func (e *EventStore) AcquireLease(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	var holder string
+	err := e.db.Conn().QueryRowContext(ctx, acquireLeaseStmt, name, owner, ttl.Milliseconds()).Scan(&holder)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (e *EventStore) ReleaseLease(ctx context.Context, name string, owner string) error {
+	_, err := e.db.Conn().ExecContext(ctx, releaseLeaseStmt, name, owner)
+	return err
+}
+
+func (e *EventStore) ListLeases(ctx context.Context, prefix string) ([]es.Lease, error) {
+	return sqldb.Query[es.Lease](ctx, e.db.Conn(), listLeasesStmt, prefix)
+}
+
+func (e *EventStore) InsertDeadLetter(ctx context.Context, group string, eventID string, lastError string) error {
+	affected, err := e.exec(ctx, insertDeadLetterStmt, group, eventID, lastError, es.TenantFromContext(ctx), es.SystemScopeFromContext(ctx))
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("event %s not found: %w", eventID, sql.ErrNoRows)
+	}
+	return nil
+}
+
+func (e *EventStore) ListDeadLetters(ctx context.Context, group string, limit int) (items []es.DeadLetter, err error) {
+	err = e.scoped(ctx, func(conn conn) error {
+		items, err = sqldb.Query[es.DeadLetter](ctx, conn, listDeadLettersStmt, group, limit, es.TenantFromContext(ctx))
+		return err
+	})
+	return items, err
+}
+
+func (e *EventStore) DeleteDeadLetter(ctx context.Context, group string, eventID string) error {
+	affected, err := e.exec(ctx, deleteDeadLetterStmt, group, eventID, es.TenantFromContext(ctx))
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return es.ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+func (e *EventStore) GetSagaInstance(ctx context.Context, saga string, id string) (instance es.SagaInstance, err error) {
+	err = e.scoped(ctx, func(conn conn) error {
+		instance, err = sqldb.QueryRow[es.SagaInstance](ctx, conn, getSagaInstanceStmt, saga, id, es.TenantFromContext(ctx))
+		return err
+	})
+	return instance, err
+}
+
+func (e *EventStore) SaveSagaInstance(ctx context.Context, instance es.SagaInstance, commands ...es.CommandRecord) error {
+	commands, err := resolveTenants(ctx, commands)
+	if err != nil {
+		return err
+	}
+	tx, err := e.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	var state any
+	if len(instance.State) > 0 {
+		state = []byte(instance.State)
+	}
+	args := []any{instance.Saga, instance.ID, instance.Status, state, instance.Compensations, instance.Position, instance.Version}
+	stmt := updateSagaInstanceStmt
+	if instance.Version == 1 {
+		stmt = insertSagaInstanceStmt
+		args = append(args, instance.CreatedAt)
+	}
+	args = append(args, instance.UpdatedAt, es.TenantFromContext(ctx))
+	rs, err := tx.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+	affected, err := rs.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return es.ErrWrongExpectedVersion
+	}
+	if len(commands) > 0 {
+		if _, err := saveCommands(ctx, tx, commands...); err != nil {
+			return fmt.Errorf("error saving commands: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (e *EventStore) LoadCommandEvents(ctx context.Context, commandID string) ([]es.EventRecord, error) {
+	return e.events(ctx, loadCommandEventsStmt, commandID, es.TenantFromContext(ctx))
+}
+
 func (e *EventStore) LoadEvents(ctx context.Context, aggregateID string) ([]es.EventRecord, error) {
-	records, err := sqldb.Query[es.EventRecord](ctx, e.db.Conn(), loadEventsStmt, aggregateID)
-	return records, err
+	return e.events(ctx, loadEventsStmt, aggregateID, es.TenantFromContext(ctx))
+}
+
+func (e *EventStore) LoadEventsFromVersion(ctx context.Context, aggregateID string, version int) ([]es.EventRecord, error) {
+	return e.events(ctx, loadEventsFromVersionStmt, aggregateID, version, es.TenantFromContext(ctx))
+}
+
+func (e *EventStore) LoadEventsUntil(ctx context.Context, aggregateID string, version int, at time.Time) ([]es.EventRecord, error) {
+	return e.events(ctx, loadEventsUntilStmt, aggregateID, version, optionalTime(at), es.TenantFromContext(ctx))
+}
+
+func (e *EventStore) QueryEvents(ctx context.Context, query es.EventQuery) ([]es.EventRecord, error) {
+	// an empty array selects all the event types, nil would select none
+	eventTypes := append(pq.StringArray{}, query.EventTypes...)
+	return e.events(ctx, queryEventsStmt,
+		es.TenantFromContext(ctx),
+		query.After,
+		query.AggregateID,
+		query.Domain,
+		eventTypes,
+		query.CommandID,
+		optionalTime(query.From),
+		optionalTime(query.To),
+		query.Limit,
+	)
+}
+
+// optionalTime returns nil for the zero time, so it is NULL in the queries.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (e *EventStore) SaveSnapshot(ctx context.Context, snapshot es.Snapshot) error {
+	_, err := e.exec(ctx, saveSnapshotStmt,
+		snapshot.AggregateID,
+		snapshot.AggregateType,
+		snapshot.Version,
+		snapshot.SchemaVersion,
+		snapshot.Data,
+		snapshot.CreatedAt,
+		es.TenantFromContext(ctx),
+	)
+	return err
+}
+
+func (e *EventStore) LoadSnapshot(ctx context.Context, aggregateID string) (snapshot es.Snapshot, err error) {
+	err = e.scoped(ctx, func(conn conn) error {
+		snapshot, err = sqldb.QueryRow[es.Snapshot](ctx, conn, loadSnapshotStmt, aggregateID, es.TenantFromContext(ctx))
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return snapshot, es.ErrSnapshotNotFound
+	}
+	return snapshot, err
+}
+
+func (e *EventStore) GetOrCreateKey(ctx context.Context, subject string) ([]byte, error) {
+	tenant := es.TenantFromContext(ctx)
+	key, err := es.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+	var rec dataKey
+	err = e.scoped(ctx, func(conn conn) (err error) {
+		rec, err = sqldb.QueryRow[dataKey](ctx, conn, getOrCreateKeyStmt, subject, key, tenant)
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		// a concurrent transaction inserted the row after our snapshot was taken
+		err = e.scoped(ctx, func(conn conn) (err error) {
+			rec, err = sqldb.QueryRow[dataKey](ctx, conn, getKeyStmt, subject, tenant)
+			return err
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rec.Key == nil {
+		return nil, es.ErrSubjectForgotten
+	}
+	return rec.Key, nil
+}
+
+func (e *EventStore) GetKey(ctx context.Context, subject string) ([]byte, error) {
+	var rec dataKey
+	err := e.scoped(ctx, func(conn conn) (err error) {
+		rec, err = sqldb.QueryRow[dataKey](ctx, conn, getKeyStmt, subject, es.TenantFromContext(ctx))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rec.Key == nil {
+		return nil, es.ErrSubjectForgotten
+	}
+	return rec.Key, nil
+}
+
+func (e *EventStore) ForgetSubject(ctx context.Context, subject string) error {
+	tenant := es.TenantFromContext(ctx)
+	tx, err := e.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if _, err := tx.ExecContext(ctx, forgetSubjectStmt, subject, tenant); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, deleteSubjectSnapshotsStmt, subject, tenant); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
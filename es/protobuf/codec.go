@@ -0,0 +1,60 @@
+// Package protobuf encodes the payloads of the commands and the events with
+// protocol buffers.
+//
+// The commands and the events hold a pointer to the generated message next
+// to the es base struct and implement proto.Message by delegating to it. The
+// generated messages must not be embedded by value, they cannot be copied:
+//
+//	type PlaceOrder struct {
+//		es.CommandBase
+//		*pb.PlaceOrder
+//	}
+//
+//	func (c *PlaceOrder) ProtoReflect() protoreflect.Message {
+//		// the registry decodes into a new command without the message
+//		if c.PlaceOrder == nil {
+//			c.PlaceOrder = new(pb.PlaceOrder)
+//		}
+//		return c.PlaceOrder.ProtoReflect()
+//	}
+package protobuf
+
+import (
+	"fmt"
+
+	"github.com/gosom/kit/es"
+	"google.golang.org/protobuf/proto"
+)
+
+// Name is the name of the codec.
+const Name = "protobuf"
+
+var _ es.Codec = (*Codec)(nil)
+
+// Codec is the protocol buffers codec.
+type Codec struct{}
+
+// NewCodec returns the protocol buffers codec.
+func NewCodec() *Codec {
+	return &Codec{}
+}
+
+func (c *Codec) Name() string {
+	return Name
+}
+
+func (c *Codec) Marshal(v any) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto.Message", v)
+	}
+	return proto.Marshal(msg)
+}
+
+func (c *Codec) Unmarshal(data []byte, v any) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, msg)
+}
@@ -0,0 +1,47 @@
+package protobuf_test
+
+import (
+	"fmt"
+
+	"github.com/gosom/kit/es"
+	"github.com/gosom/kit/es/protobuf"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// RenameTodo uses a well known message in place of a generated one.
+type RenameTodo struct {
+	es.CommandBase
+	*wrapperspb.StringValue
+}
+
+func (c *RenameTodo) ProtoReflect() protoreflect.Message {
+	if c.StringValue == nil {
+		c.StringValue = new(wrapperspb.StringValue)
+	}
+	return c.StringValue.ProtoReflect()
+}
+
+func Example() {
+	registry := es.NewRegistry()
+	registry.RegisterCodec(protobuf.NewCodec())
+	if err := registry.SetCodec(protobuf.Name); err != nil {
+		panic(err)
+	}
+	if err := es.RegisterCommand[RenameTodo](registry); err != nil {
+		panic(err)
+	}
+	cmd := &RenameTodo{StringValue: wrapperspb.String("buy milk")}
+	cmd.SetAggregateID("todo-1")
+	cmd.SetAggregateHash()
+	rec, err := registry.EncodeCommand("todo", cmd)
+	if err != nil {
+		panic(err)
+	}
+	decoded, err := es.CommandRecordToCommand(registry, rec)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(rec.Codec, decoded.(*RenameTodo).GetValue())
+	// Output: protobuf buy milk
+}
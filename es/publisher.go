@@ -2,7 +2,8 @@ package es
 
 import "context"
 
-// Publisher is an interface for publishing events.
+// Publisher is an interface for publishing events. The subscribers can
+// publish an event more than once, see ErrorPolicy.
 type Publisher interface {
 	Name() string
 	Publish(ctx context.Context, events ...EventRecord) error
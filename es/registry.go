@@ -1,28 +1,69 @@
 package es
 
-import "sync"
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
 
 type ConverterFn func([]byte) (ICommand, error)
 type ConverterEventFn func([]byte) (IEvent, error)
 
+// UpcasterFn transforms the payload of an event from one schema version
+// to the next one.
+type UpcasterFn func([]byte) ([]byte, error)
+
 type Registry struct {
-	mutex    *sync.RWMutex
-	commands map[string]ConverterFn
-	events   map[string]ConverterEventFn
+	mutex        *sync.RWMutex
+	commands     map[string]ConverterFn
+	events       map[string]ConverterEventFn
+	commandTypes map[string]func() ICommand
+	eventTypes   map[string]func() IEvent
+	upcasters    map[string]map[int]UpcasterFn
+	codecs       map[string]Codec
+	codec        Codec
+	keys         KeyStore
 }
 
 func NewRegistry() *Registry {
 	return &Registry{
-		mutex:    &sync.RWMutex{},
-		commands: make(map[string]ConverterFn),
-		events:   make(map[string]ConverterEventFn),
+		mutex:        &sync.RWMutex{},
+		commands:     make(map[string]ConverterFn),
+		events:       make(map[string]ConverterEventFn),
+		commandTypes: make(map[string]func() ICommand),
+		eventTypes:   make(map[string]func() IEvent),
+		upcasters:    make(map[string]map[int]UpcasterFn),
+		codecs:       map[string]Codec{CodecJSON: JSON},
+		codec:        JSON,
 	}
 }
 
+// RegisterCommand registers the converter of the command.
+// A converter decodes JSON, use RegisterCommandType for commands that are
+// encoded with other codecs.
 func (r *Registry) RegisterCommand(name string, f ConverterFn) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	r.commands[name] = f
+	delete(r.commandTypes, name)
+}
+
+// RegisterCommandType registers the command by a function that returns a new
+// command, so it can be decoded with any codec.
+func (r *Registry) RegisterCommandType(name string, f func() ICommand) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.registerCommandType(name, f)
+}
+
+func (r *Registry) registerCommandType(name string, f func() ICommand) {
+	r.commandTypes[name] = f
+	r.commands[name] = func(data []byte) (ICommand, error) {
+		item := f()
+		return item, json.Unmarshal(data, item)
+	}
 }
 
 func (r *Registry) GetCommand(name string) (ConverterFn, bool) {
@@ -32,10 +73,30 @@ func (r *Registry) GetCommand(name string) (ConverterFn, bool) {
 	return f, ok
 }
 
+// RegisterEvent registers the converter of the event.
+// A converter decodes JSON, use RegisterEventType for events that are
+// encoded with other codecs.
 func (r *Registry) RegisterEvent(name string, f ConverterEventFn) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	r.events[name] = f
+	delete(r.eventTypes, name)
+}
+
+// RegisterEventType registers the event by a function that returns a new
+// event, so it can be decoded with any codec.
+func (r *Registry) RegisterEventType(name string, f func() IEvent) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.registerEventType(name, f)
+}
+
+func (r *Registry) registerEventType(name string, f func() IEvent) {
+	r.eventTypes[name] = f
+	r.events[name] = func(data []byte) (IEvent, error) {
+		item := f()
+		return item, json.Unmarshal(data, item)
+	}
 }
 
 func (r *Registry) GetEvent(name string) (ConverterEventFn, bool) {
@@ -44,3 +105,127 @@ func (r *Registry) GetEvent(name string) (ConverterEventFn, bool) {
 	f, ok := r.events[name]
 	return f, ok
 }
+
+// Commands returns the names of the registered commands in order.
+func (r *Registry) Commands() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return sortedKeys(r.commands)
+}
+
+// Events returns the names of the registered events in order.
+func (r *Registry) Events() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return sortedKeys(r.events)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	ans := make([]string, 0, len(m))
+	for k := range m {
+		ans = append(ans, k)
+	}
+	sort.Strings(ans)
+	return ans
+}
+
+// RegisterCommand registers the command type T under its type name, the
+// event type that CommandToCommandRecord gives to its commands.
+// The commands can be decoded with any codec.
+// It returns ErrAlreadyRegistered when a command with the name is registered.
+func RegisterCommand[T any, PT interface {
+	*T
+	ICommand
+}](r *Registry) error {
+	name := typeName[T]()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.commands[name]; ok {
+		return fmt.Errorf("command %s: %w", name, ErrAlreadyRegistered)
+	}
+	r.registerCommandType(name, func() ICommand {
+		return PT(new(T))
+	})
+	return nil
+}
+
+// RegisterEvent registers the event type T under its type name, the event
+// type that the command processor gives to its events.
+// The events can be decoded with any codec.
+// It returns ErrAlreadyRegistered when an event with the name is registered.
+func RegisterEvent[T any, PT interface {
+	*T
+	IEvent
+}](r *Registry) error {
+	name := typeName[T]()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.events[name]; ok {
+		return fmt.Errorf("event %s: %w", name, ErrAlreadyRegistered)
+	}
+	r.registerEventType(name, func() IEvent {
+		return PT(new(T))
+	})
+	return nil
+}
+
+func typeName[T any]() string {
+	return reflect.TypeOf((*T)(nil)).Elem().Name()
+}
+
+// RegisterUpcaster registers an upcaster that transforms the payload of the
+// event from schema version `from` to `from+1`.
+// The payload is encoded with the codec of the record.
+// The current schema version of an event is one more than the highest
+// registered upcaster (1 when there are no upcasters).
+func (r *Registry) RegisterUpcaster(name string, from int, f UpcasterFn) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.upcasters[name]; !ok {
+		r.upcasters[name] = make(map[int]UpcasterFn)
+	}
+	r.upcasters[name][from] = f
+}
+
+// EventSchemaVersion returns the current schema version of the event.
+func (r *Registry) EventSchemaVersion(name string) int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.eventSchemaVersion(name)
+}
+
+func (r *Registry) eventSchemaVersion(name string) int {
+	version := 1
+	for from := range r.upcasters[name] {
+		if from+1 > version {
+			version = from + 1
+		}
+	}
+	return version
+}
+
+// Upcast transforms the payload of the event from the given schema version
+// to the current one.
+func (r *Registry) Upcast(name string, schemaVersion int, data []byte) ([]byte, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if schemaVersion <= 0 {
+		schemaVersion = 1
+	}
+	current := r.eventSchemaVersion(name)
+	if schemaVersion > current {
+		return nil, fmt.Errorf("event %s schema version %d is newer than %d: %w", name, schemaVersion, current, ErrUnknownSchemaVersion)
+	}
+	var err error
+	for v := schemaVersion; v < current; v++ {
+		f, ok := r.upcasters[name][v]
+		if !ok {
+			return nil, fmt.Errorf("event %s has no upcaster from version %d: %w", name, v, ErrUnknownSchemaVersion)
+		}
+		data, err = f(data)
+		if err != nil {
+			return nil, fmt.Errorf("upcasting event %s from version %d: %w", name, v, err)
+		}
+	}
+	return data, nil
+}
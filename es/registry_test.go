@@ -0,0 +1,123 @@
+package es_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/gosom/kit/es"
+	"github.com/stretchr/testify/require"
+)
+
+type titleChanged struct {
+	es.EventBase
+	Title    string `json:"title"`
+	Priority int    `json:"priority"`
+}
+
+func TestRegistryUpcasting(t *testing.T) {
+	newRegistry := func() *es.Registry {
+		reg := es.NewRegistry()
+		reg.RegisterEvent("titleChanged", func(data []byte) (es.IEvent, error) {
+			var item titleChanged
+			return &item, json.Unmarshal(data, &item)
+		})
+		return reg
+	}
+	t.Run("DefaultSchemaVersion", func(t *testing.T) {
+		reg := newRegistry()
+		require.Equal(t, 1, reg.EventSchemaVersion("titleChanged"))
+		data, err := reg.Upcast("titleChanged", 0, []byte(`{"title":"a"}`))
+		require.NoError(t, err)
+		require.JSONEq(t, `{"title":"a"}`, string(data))
+	})
+	t.Run("UpcasterChain", func(t *testing.T) {
+		reg := newRegistry()
+		// v1 used the key "name" instead of "title"
+		reg.RegisterUpcaster("titleChanged", 1, func(data []byte) ([]byte, error) {
+			return bytes.Replace(data, []byte(`"name"`), []byte(`"title"`), 1), nil
+		})
+		// v2 had no priority
+		reg.RegisterUpcaster("titleChanged", 2, func(data []byte) ([]byte, error) {
+			m := map[string]any{}
+			if err := json.Unmarshal(data, &m); err != nil {
+				return nil, err
+			}
+			m["priority"] = 1
+			return json.Marshal(m)
+		})
+		require.Equal(t, 3, reg.EventSchemaVersion("titleChanged"))
+
+		rec := es.EventRecord{
+			RecordBase: es.RecordBase{
+				ID:          "01GP8X6PC3J6YKE87MA1YZ0TK7",
+				AggregateID: "test-1",
+				EventType:   "titleChanged",
+				Data:        []byte(`{"name":"old"}`),
+			},
+			Version:       2,
+			SchemaVersion: 1,
+		}
+		ev, err := es.EventRecordToEvent(reg, rec)
+		require.NoError(t, err)
+		require.IsType(t, &titleChanged{}, ev)
+		require.Equal(t, "old", ev.(*titleChanged).Title)
+		require.Equal(t, 1, ev.(*titleChanged).Priority)
+		require.Equal(t, 2, ev.GetVersion())
+		require.Equal(t, "test-1", ev.GetAggregateID())
+
+		rec.SchemaVersion = 3
+		rec.Data = []byte(`{"title":"new","priority":5}`)
+		ev, err = es.EventRecordToEvent(reg, rec)
+		require.NoError(t, err)
+		require.Equal(t, "new", ev.(*titleChanged).Title)
+		require.Equal(t, 5, ev.(*titleChanged).Priority)
+	})
+	t.Run("UpcastErrors", func(t *testing.T) {
+		reg := newRegistry()
+		reg.RegisterUpcaster("titleChanged", 2, func(data []byte) ([]byte, error) {
+			return nil, errors.New("boom")
+		})
+		_, err := reg.Upcast("titleChanged", 1, []byte(`{}`))
+		require.ErrorIs(t, err, es.ErrUnknownSchemaVersion)
+
+		_, err = reg.Upcast("titleChanged", 4, []byte(`{}`))
+		require.ErrorIs(t, err, es.ErrUnknownSchemaVersion)
+
+		_, err = reg.Upcast("titleChanged", 2, []byte(`{}`))
+		require.ErrorContains(t, err, "boom")
+	})
+}
+
+func TestRegisterGeneric(t *testing.T) {
+	reg := es.NewRegistry()
+	require.NoError(t, es.RegisterCommand[placeOrder](reg))
+	require.NoError(t, es.RegisterEvent[orderPlaced](reg))
+	reg.RegisterEvent("titleChanged", func(data []byte) (es.IEvent, error) {
+		var item titleChanged
+		return &item, json.Unmarshal(data, &item)
+	})
+	require.ErrorIs(t, es.RegisterCommand[placeOrder](reg), es.ErrAlreadyRegistered)
+	require.ErrorIs(t, es.RegisterEvent[titleChanged](reg), es.ErrAlreadyRegistered)
+
+	require.Equal(t, []string{"placeOrder"}, reg.Commands())
+	require.Equal(t, []string{"orderPlaced", "titleChanged"}, reg.Events())
+
+	// the names are the event types of the records
+	rec, err := es.CommandToCommandRecord("order", &placeOrder{ID: "1", Quantity: 2})
+	require.NoError(t, err)
+	convFn, ok := reg.GetCommand(rec.EventType)
+	require.True(t, ok)
+	cmd, err := convFn(rec.Data)
+	require.NoError(t, err)
+	require.Equal(t, 2, cmd.(*placeOrder).Quantity)
+
+	eventFn, ok := reg.GetEvent("orderPlaced")
+	require.True(t, ok)
+	ev, err := eventFn([]byte(`{"quantity":3}`))
+	require.NoError(t, err)
+	require.Equal(t, 3, ev.(*orderPlaced).Quantity)
+	_, err = eventFn([]byte(`{`))
+	require.Error(t, err)
+}
@@ -0,0 +1,344 @@
+package es
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gosom/kit/lib"
+	"github.com/gosom/kit/logging"
+)
+
+// The statuses of a saga instance.
+// An instance is active until the saga completes it or compensates it,
+// after that it ignores any further events.
+const (
+	SagaStatusActive      = "active"
+	SagaStatusCompleted   = "completed"
+	SagaStatusCompensated = "compensated"
+)
+
+// Saga is a process manager. It reacts to events, possibly of several domains,
+// by sending commands to other aggregates. The events are routed to saga
+// instances by their correlation ID and every instance keeps its own state.
+// A saga runs on top of a subscription, see NewSagaPublisher.
+type Saga interface {
+	// Name identifies the saga. It is also the name of its subscription group.
+	Name() string
+	// Correlate returns the ID of the saga instance that handles the event.
+	// Events with an empty ID are ignored.
+	Correlate(event IEvent) string
+	// Handle reacts to an event of the instance. Its changes, including the
+	// commands it sends, are saved only when it returns no error.
+	Handle(ctx context.Context, instance *SagaInstance, event IEvent) error
+}
+
+// SagaInstance is the persisted state of a saga for a correlation ID.
+type SagaInstance struct {
+	Saga   string
+	ID     string
+	Status string
+	// State is the JSON encoded state of the saga, see Load and Save.
+	State json.RawMessage
+	// Compensations are the commands that undo the steps of the instance,
+	// in the order they were added.
+	Compensations SagaCommands
+	// Position is the global position of the last handled event.
+	Position  int64
+	Version   int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	commands []CommandRecord
+	cancels  []string
+	registry *Registry
+}
+
+func (o *SagaInstance) Bind() []any {
+	return []any{&o.Saga, &o.ID, &o.Status, &o.State, &o.Compensations, &o.Position, &o.Version, &o.CreatedAt, &o.UpdatedAt}
+}
+
+// Load decodes the state of the instance into v. A new instance has no state
+// and leaves v untouched.
+func (o *SagaInstance) Load(v any) error {
+	if len(o.State) == 0 {
+		return nil
+	}
+	return json.Unmarshal(o.State, v)
+}
+
+// Save encodes v as the state of the instance.
+func (o *SagaInstance) Save(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	o.State = data
+	return nil
+}
+
+// Send sends the command to the domain and returns its ID.
+func (o *SagaInstance) Send(domain string, cmd ICommand) (string, error) {
+	rec, err := o.encode(domain, cmd)
+	if err != nil {
+		return "", err
+	}
+	o.commands = append(o.commands, rec)
+	return rec.ID, nil
+}
+
+// Schedule sends the command to be processed at the given time and returns
+// its ID. It is the way to implement timeouts: schedule the command that
+// handles the timeout and Cancel it when it is not needed anymore.
+// Scheduled commands are always saved in the event store.
+func (o *SagaInstance) Schedule(domain string, cmd ICommand, at time.Time) (string, error) {
+	rec, err := o.encode(domain, cmd)
+	if err != nil {
+		return "", err
+	}
+	at = at.UTC()
+	rec.NotBefore = &at
+	o.commands = append(o.commands, rec)
+	return rec.ID, nil
+}
+
+// encode encodes the command with the codec of the registry of the saga.
+func (o *SagaInstance) encode(domain string, cmd ICommand) (CommandRecord, error) {
+	if o.registry == nil {
+		return CommandToCommandRecord(domain, cmd)
+	}
+	return o.registry.EncodeCommand(domain, cmd)
+}
+
+// Cancel cancels a scheduled command if it is still pending.
+func (o *SagaInstance) Cancel(commandID string) {
+	o.cancels = append(o.cancels, commandID)
+}
+
+// AddCompensation registers the command that undoes the last step.
+func (o *SagaInstance) AddCompensation(domain string, cmd ICommand) error {
+	rec, err := o.encode(domain, cmd)
+	if err != nil {
+		return err
+	}
+	o.Compensations = append(o.Compensations, rec)
+	return nil
+}
+
+// Compensate sends the compensations in reverse order and ends the instance.
+func (o *SagaInstance) Compensate() {
+	for i := len(o.Compensations) - 1; i >= 0; i-- {
+		rec := o.Compensations[i]
+		rec.ID = lib.MustNewULID()
+		rec.CreatedAt = time.Now().UTC()
+		o.commands = append(o.commands, rec)
+	}
+	o.Compensations = nil
+	o.Status = SagaStatusCompensated
+}
+
+// Complete ends the instance. Its compensations are dropped.
+func (o *SagaInstance) Complete() {
+	o.Compensations = nil
+	o.Status = SagaStatusCompleted
+}
+
+// SagaCommands are command records stored as JSON.
+type SagaCommands []CommandRecord
+
+func (o SagaCommands) Value() (driver.Value, error) {
+	if o == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]CommandRecord(o))
+}
+
+func (o *SagaCommands) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	case nil:
+		*o = nil
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into saga commands", src)
+	}
+	var ans []CommandRecord
+	if err := json.Unmarshal(data, &ans); err != nil {
+		return err
+	}
+	if len(ans) == 0 {
+		ans = nil
+	}
+	*o = ans
+	return nil
+}
+
+// SagaOption configures a saga publisher.
+type SagaOption func(*sagaPublisher) error
+
+// WithSagaDispatcher sends the commands of the domain through the dispatcher
+// instead of saving them in the event store together with the instance.
+// The dispatched commands are sent before the instance is saved, so a crash
+// in between sends them again.
+func WithSagaDispatcher(domain string, dispatcher CommandDispatcher) SagaOption {
+	return func(o *sagaPublisher) error {
+		if dispatcher == nil {
+			return errors.New("dispatcher cannot be nil")
+		}
+		o.dispatchers[domain] = dispatcher
+		return nil
+	}
+}
+
+var _ Publisher = (*sagaPublisher)(nil)
+
+type sagaPublisher struct {
+	store       EventStore
+	registry    *Registry
+	saga        Saga
+	dispatchers map[string]CommandDispatcher
+	log         logging.Logger
+}
+
+// NewSagaPublisher returns the publisher that drives the saga. Subscribe it
+// to the event store like any other publisher. Only the events of the
+// registry are passed to the saga, the registry also needs the commands that
+// are sent through a dispatcher. With a key store it needs all the commands of
+// the saga, their personal data is encrypted, see Registry.EncryptCommandRecord.
+// Every event is handled once per instance: the instance remembers the
+// position of its last event and the commands are saved with the instance in
+// a single transaction.
+func NewSagaPublisher(store EventStore, registry *Registry, saga Saga, options ...SagaOption) (Publisher, error) {
+	ans := sagaPublisher{
+		store:       store,
+		registry:    registry,
+		saga:        saga,
+		dispatchers: make(map[string]CommandDispatcher),
+		log:         logging.Get().With("component", "es/saga", "saga", saga.Name()),
+	}
+	for _, opt := range options {
+		if err := opt(&ans); err != nil {
+			return nil, err
+		}
+	}
+	return &ans, nil
+}
+
+func (o *sagaPublisher) Name() string {
+	return o.saga.Name()
+}
+
+func (o *sagaPublisher) Publish(ctx context.Context, events ...EventRecord) error {
+	for i := range events {
+		if err := o.handle(ctx, events[i]); err != nil {
+			return fmt.Errorf("%w when handling event %s", err, events[i].ID)
+		}
+	}
+	return nil
+}
+
+func (o *sagaPublisher) handle(ctx context.Context, record EventRecord) error {
+	if _, ok := o.registry.GetEvent(record.EventType); !ok {
+		return nil
+	}
+	event, err := EventRecordToEvent(o.registry, record)
+	if err != nil {
+		return err
+	}
+	id := o.saga.Correlate(event)
+	if id == "" {
+		return nil
+	}
+	// the instances and the commands belong to the tenant of the event
+	ctx = ContextWithTenant(ctx, record.Tenant)
+	instance, err := o.store.GetSagaInstance(ctx, o.saga.Name(), id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		instance = SagaInstance{
+			Saga:      o.saga.Name(),
+			ID:        id,
+			Status:    SagaStatusActive,
+			CreatedAt: time.Now().UTC(),
+		}
+	case err != nil:
+		return err
+	}
+	if instance.Status != SagaStatusActive || instance.Position >= record.GlobalPosition {
+		return nil
+	}
+	instance.registry = o.registry
+	// the commands of the saga are caused by the event and inherit its metadata
+	ctx = ContextWithCorrelation(ctx, CausedBy(record.ID, record.CorrelationID))
+	ctx = ContextWithMetadata(ctx, record.Metadata)
+	if err := o.saga.Handle(ctx, &instance, event); err != nil {
+		return err
+	}
+	instance.Position = record.GlobalPosition
+	return o.commit(ctx, &instance)
+}
+
+// commit cancels, dispatches and saves the changes of the instance. The
+// cancellations and the dispatches are idempotent or at least once, they
+// run before the instance is saved so they are retried when the save fails.
+func (o *sagaPublisher) commit(ctx context.Context, instance *SagaInstance) error {
+	for _, commandID := range instance.cancels {
+		err := o.store.CancelCommand(ctx, commandID)
+		if err != nil && !errors.Is(err, ErrCommandNotPending) && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w when cancelling command %s", err, commandID)
+		}
+	}
+	// the compensations are stored with the instance, their personal data too
+	for i := range instance.Compensations {
+		rec, err := o.registry.EncryptCommandRecord(ctx, instance.Compensations[i])
+		if err != nil {
+			return fmt.Errorf("%w when encrypting compensation %s", err, rec.ID)
+		}
+		instance.Compensations[i] = rec
+	}
+	correlation := CorrelationFromContext(ctx)
+	md := MetadataFromContext(ctx)
+	var records []CommandRecord
+	for _, rec := range instance.commands {
+		rec.SetCorrelation(correlation)
+		rec.Metadata = md.Merge(rec.Metadata)
+		dispatcher, ok := o.dispatchers[rec.Domain()]
+		if !ok || rec.NotBefore != nil {
+			rec, err := o.registry.EncryptCommandRecord(ctx, rec)
+			if err != nil {
+				return fmt.Errorf("%w when encrypting command %s", err, rec.ID)
+			}
+			records = append(records, rec)
+			continue
+		}
+		if err := o.dispatch(ctx, dispatcher, rec); err != nil {
+			return err
+		}
+	}
+	instance.Version++
+	instance.UpdatedAt = time.Now().UTC()
+	if err := o.store.SaveSagaInstance(ctx, *instance, records...); err != nil {
+		return fmt.Errorf("%w when saving saga instance %s", err, instance.ID)
+	}
+	o.log.With(correlation.LogArgs()...).Debug("saga instance saved", "id", instance.ID, "status", instance.Status, "commands", len(instance.commands))
+	instance.commands, instance.cancels = nil, nil
+	return nil
+}
+
+func (o *sagaPublisher) dispatch(ctx context.Context, dispatcher CommandDispatcher, rec CommandRecord) error {
+	cmd, err := CommandRecordToCommand(o.registry, rec)
+	if err != nil {
+		return err
+	}
+	if _, err := dispatcher.DispatchCommand(ctx, cmd); err != nil {
+		return fmt.Errorf("%w when dispatching command %s", err, rec.ID)
+	}
+	return nil
+}
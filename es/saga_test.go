@@ -0,0 +1,317 @@
+package es_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gosom/kit/es"
+	"github.com/gosom/kit/es/mock"
+	"github.com/gosom/kit/lib"
+	"github.com/stretchr/testify/require"
+)
+
+type placeOrder struct {
+	es.CommandBase
+	ID       string `json:"id" aggregateID:"true" validate:"required"`
+	Quantity int    `json:"quantity" validate:"required"`
+}
+
+func (c *placeOrder) Handle(ctx context.Context, h es.AggregateLoader) ([]es.IEvent, error) {
+	return []es.IEvent{&orderPlaced{Quantity: c.Quantity}}, nil
+}
+
+type cancelOrder struct {
+	es.CommandBase
+	ID string `json:"id" aggregateID:"true" validate:"required"`
+}
+
+func (c *cancelOrder) Handle(ctx context.Context, h es.AggregateLoader) ([]es.IEvent, error) {
+	return []es.IEvent{&orderCancelled{}}, nil
+}
+
+type reserveStock struct {
+	es.CommandBase
+	ID       string `json:"id" aggregateID:"true" validate:"required"`
+	Quantity int    `json:"quantity" validate:"required"`
+}
+
+func (c *reserveStock) Handle(ctx context.Context, h es.AggregateLoader) ([]es.IEvent, error) {
+	if c.Quantity > 5 {
+		return []es.IEvent{&stockUnavailable{}}, nil
+	}
+	return []es.IEvent{&stockReserved{}}, nil
+}
+
+type orderPlaced struct {
+	es.EventBase
+	Quantity int `json:"quantity"`
+}
+
+type orderCancelled struct {
+	es.EventBase
+}
+
+type stockReserved struct {
+	es.EventBase
+}
+
+type stockUnavailable struct {
+	es.EventBase
+}
+
+func newOrderRegistry() *es.Registry {
+	reg := es.NewRegistry()
+	for _, err := range []error{
+		es.RegisterCommand[placeOrder](reg),
+		es.RegisterCommand[cancelOrder](reg),
+		es.RegisterCommand[reserveStock](reg),
+		es.RegisterEvent[orderPlaced](reg),
+		es.RegisterEvent[orderCancelled](reg),
+		es.RegisterEvent[stockReserved](reg),
+		es.RegisterEvent[stockUnavailable](reg),
+	} {
+		if err != nil {
+			panic(err)
+		}
+	}
+	return reg
+}
+
+// orderSaga reserves the stock of placed orders and cancels the orders
+// when there is no stock or the reservation times out.
+type orderSaga struct{}
+
+type orderSagaState struct {
+	Timeout string `json:"timeout"`
+}
+
+func (s orderSaga) Name() string {
+	return "order-saga"
+}
+
+func (s orderSaga) Correlate(event es.IEvent) string {
+	_, id, _ := strings.Cut(event.GetAggregateID(), "-")
+	return id
+}
+
+func (s orderSaga) Handle(ctx context.Context, instance *es.SagaInstance, event es.IEvent) error {
+	var state orderSagaState
+	if err := instance.Load(&state); err != nil {
+		return err
+	}
+	switch ev := event.(type) {
+	case *orderPlaced:
+		if _, err := instance.Send("stock", &reserveStock{ID: instance.ID, Quantity: ev.Quantity}); err != nil {
+			return err
+		}
+		if err := instance.AddCompensation("order", &cancelOrder{ID: instance.ID}); err != nil {
+			return err
+		}
+		timeout, err := instance.Schedule("order", &cancelOrder{ID: instance.ID}, time.Now().Add(time.Hour))
+		if err != nil {
+			return err
+		}
+		state.Timeout = timeout
+	case *stockReserved:
+		instance.Cancel(state.Timeout)
+		instance.Complete()
+	case *stockUnavailable:
+		instance.Cancel(state.Timeout)
+		instance.Compensate()
+	}
+	return instance.Save(state)
+}
+
+// storeDispatcher dispatches the commands of a domain to the event store.
+type storeDispatcher struct {
+	mu         sync.Mutex
+	store      es.EventStore
+	domain     string
+	dispatched []string
+}
+
+func (d *storeDispatcher) DispatchCommandRequest(ctx context.Context, request es.CommandRequest) (string, error) {
+	panic("not implemented")
+}
+
+func (d *storeDispatcher) DispatchCommand(ctx context.Context, command es.ICommand) (string, error) {
+	rec, err := es.CommandToCommandRecord(d.domain, command)
+	if err != nil {
+		return "", err
+	}
+	rec.SetCorrelation(es.CorrelationFromContext(ctx))
+	if _, err := d.store.SaveCommandRecords(ctx, rec); err != nil {
+		return "", err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dispatched = append(d.dispatched, rec.EventType)
+	return rec.ID, nil
+}
+
+func (d *storeDispatcher) Close() {}
+
+func (d *storeDispatcher) Dispatched() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.dispatched...)
+}
+
+func TestSaga(t *testing.T) {
+	for _, dispatched := range []bool{false, true} {
+		dispatched := dispatched
+		name := "Store"
+		if dispatched {
+			name = "Dispatcher"
+		}
+		t.Run(name, func(t *testing.T) {
+			store := mock.NewEventStore()
+			registry := newOrderRegistry()
+			dispatcher := &storeDispatcher{store: store, domain: "stock"}
+			var options []es.SagaOption
+			if dispatched {
+				options = append(options, es.WithSagaDispatcher("stock", dispatcher))
+			}
+			publisher, err := es.NewSagaPublisher(store, registry, orderSaga{}, options...)
+			require.NoError(t, err)
+			sub, err := es.NewSubscriber(store, publisher, publisher.Name())
+			require.NoError(t, err)
+			processor, err := es.NewCommandProcessor(2, store, registry, "order")
+			require.NoError(t, err)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			done := make(chan error)
+			go func() {
+				done <- processor.Start(ctx)
+			}()
+			defer func() {
+				cancel()
+				require.NoError(t, <-done)
+			}()
+			defer runSubscriber(t, sub)()
+
+			place := func(id string, quantity int) {
+				rec, err := es.CommandToCommandRecord("order", &placeOrder{ID: id, Quantity: quantity})
+				require.NoError(t, err)
+				rec.SetCorrelation(es.CorrelationFromContext(lib.NewContextWithRequestID(ctx, "request-"+id)))
+				_, err = store.SaveCommandRecords(ctx, rec)
+				require.NoError(t, err)
+			}
+			waitFor := func(id string, status string) es.SagaInstance {
+				var instance es.SagaInstance
+				require.Eventually(t, func() bool {
+					instance, err = store.GetSagaInstance(ctx, "order-saga", id)
+					return err == nil && instance.Status == status
+				}, 4*time.Second, 10*time.Millisecond)
+				return instance
+			}
+			eventTypes := func(aggregateID string) []string {
+				events, err := store.LoadEvents(ctx, aggregateID)
+				require.NoError(t, err)
+				ans := make([]string, len(events))
+				for i := range events {
+					ans[i] = events[i].EventType
+				}
+				return ans
+			}
+			timeoutOf := func(instance es.SagaInstance) es.CommandRecord {
+				var state orderSagaState
+				require.NoError(t, instance.Load(&state))
+				timeout, err := store.GetCommand(ctx, state.Timeout)
+				require.NoError(t, err)
+				return timeout
+			}
+
+			place("1", 2)
+			instance := waitFor("1", es.SagaStatusCompleted)
+			require.Equal(t, 2, instance.Version, "every event is handled once")
+			require.Empty(t, instance.Compensations)
+			require.Equal(t, es.CommandStatusCancelled, timeoutOf(instance).Status)
+			require.Equal(t, []string{"stockReserved"}, eventTypes("stock-1"))
+
+			// the events and the commands of the flow share the correlation ID of the request
+			placed, err := store.LoadEvents(ctx, "order-1")
+			require.NoError(t, err)
+			reserved, err := store.LoadEvents(ctx, "stock-1")
+			require.NoError(t, err)
+			reserve, err := store.GetCommand(ctx, reserved[0].CommandID)
+			require.NoError(t, err)
+			require.Equal(t, es.Correlation{CorrelationID: "request-1", CausationID: placed[0].ID}, reserve.Correlation())
+			require.Equal(t, es.Correlation{CorrelationID: "request-1", CausationID: reserve.ID}, reserved[0].Correlation())
+
+			place("2", 10)
+			instance = waitFor("2", es.SagaStatusCompensated)
+			require.Equal(t, es.CommandStatusCancelled, timeoutOf(instance).Status)
+			require.Eventually(t, func() bool {
+				return len(eventTypes("order-2")) == 2
+			}, 4*time.Second, 10*time.Millisecond)
+			require.Equal(t, []string{"orderPlaced", "orderCancelled"}, eventTypes("order-2"))
+			require.Equal(t, []string{"orderPlaced"}, eventTypes("order-1"))
+
+			if dispatched {
+				require.Equal(t, []string{"reserveStock", "reserveStock"}, dispatcher.Dispatched())
+			} else {
+				require.Empty(t, dispatcher.Dispatched())
+			}
+		})
+	}
+}
+
+type apologize struct {
+	es.CommandBase
+	ID    string `json:"id" aggregateID:"true" validate:"required" es:"subject"`
+	Email string `json:"email" validate:"required" es:"pii"`
+}
+
+// welcomeSaga registers the apology for a registered customer as a compensation.
+type welcomeSaga struct{}
+
+func (s welcomeSaga) Name() string {
+	return "welcome-saga"
+}
+
+func (s welcomeSaga) Correlate(event es.IEvent) string {
+	return event.(*customerRegistered).CustomerID
+}
+
+func (s welcomeSaga) Handle(ctx context.Context, instance *es.SagaInstance, event es.IEvent) error {
+	ev := event.(*customerRegistered)
+	return instance.AddCompensation("customer", &apologize{ID: ev.CustomerID, Email: ev.Email})
+}
+
+func TestSagaCompensationEncryption(t *testing.T) {
+	ctx := context.Background()
+	store := mock.NewEventStore()
+	registry := es.NewRegistry()
+	require.NoError(t, es.RegisterCommand[apologize](registry))
+	require.NoError(t, es.RegisterEvent[customerRegistered](registry))
+	registry.SetKeyStore(store)
+	publisher, err := es.NewSagaPublisher(store, registry, welcomeSaga{})
+	require.NoError(t, err)
+
+	registered := &customerRegistered{CustomerID: "1", Email: "alice@example.com"}
+	registered.SetEventType("customerRegistered")
+	registered.SetAggregateID("customer-1")
+	encrypted, err := registry.EncryptEvent(ctx, registered)
+	require.NoError(t, err)
+	rec, err := registry.EncodeEvent(encrypted)
+	require.NoError(t, err)
+	rec.GlobalPosition = 1
+	require.NoError(t, publisher.Publish(ctx, rec))
+
+	instance, err := store.GetSagaInstance(ctx, "welcome-saga", "1")
+	require.NoError(t, err)
+	require.Len(t, instance.Compensations, 1)
+	require.NotContains(t, string(instance.Compensations[0].Data), "alice@example.com")
+	cmd, err := es.CommandRecordToCommand(registry, instance.Compensations[0])
+	require.NoError(t, err)
+	require.Equal(t, "alice@example.com", cmd.(*apologize).Email)
+
+	require.NoError(t, store.ForgetSubject(ctx, "1"))
+	cmd, err = es.CommandRecordToCommand(registry, instance.Compensations[0])
+	require.NoError(t, err)
+	require.Equal(t, es.Redacted, cmd.(*apologize).Email)
+}
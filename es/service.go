@@ -108,6 +108,22 @@ func WithPublishers(publisher ...Publisher) option {
 	}
 }
 
+// WithPublisher subscribes the publisher to the event store using
+// the given subscriber options.
+func WithPublisher(publisher Publisher, options ...SubscriberOption) option {
+	return func(a *appService) error {
+		if a.store == nil {
+			return errors.New("event store is not set")
+		}
+		sub, err := NewSubscriber(a.store, publisher, publisher.Name(), options...)
+		if err != nil {
+			return err
+		}
+		a.subscribers = append(a.subscribers, sub)
+		return nil
+	}
+}
+
 func WithCommandBusListener(listener CommandBusListener) option {
 	return func(a *appService) error {
 		a.commandBusListener = listener
@@ -0,0 +1,149 @@
+package es
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Snapshot is the serialized state of an aggregate at a given version.
+type Snapshot struct {
+	AggregateID   string
+	AggregateType string
+	Version       int
+	SchemaVersion int
+	Data          []byte
+	CreatedAt     time.Time
+}
+
+func (o *Snapshot) Bind() []any {
+	return []any{
+		&o.AggregateID,
+		&o.AggregateType,
+		&o.Version,
+		&o.SchemaVersion,
+		&o.Data,
+		&o.CreatedAt,
+	}
+}
+
+// SnapshotStore is the interface that wraps the snapshot persistence methods.
+type SnapshotStore interface {
+	//SaveSnapshot saves the snapshot. Older snapshots of the aggregate are replaced.
+	SaveSnapshot(ctx context.Context, snapshot Snapshot) error
+	//LoadSnapshot loads the latest snapshot for the aggregate.
+	// It returns ErrSnapshotNotFound when there is none.
+	LoadSnapshot(ctx context.Context, aggregateID string) (Snapshot, error)
+}
+
+// SchemaVersioner can be implemented by aggregates to version their snapshot layout.
+// Bump the version every time the aggregate struct changes in an incompatible way,
+// snapshots with a different schema version are ignored.
+type SchemaVersioner interface {
+	SchemaVersion() int
+}
+
+// Snapshotter restores aggregates from snapshots and takes a new snapshot
+// every N versions.
+type Snapshotter struct {
+	store SnapshotStore
+	every int
+}
+
+// NewSnapshotter creates a snapshotter that snapshots an aggregate every
+// `every` versions.
+func NewSnapshotter(store SnapshotStore, every int) (*Snapshotter, error) {
+	if store == nil {
+		return nil, errors.New("snapshot store is required")
+	}
+	if every <= 0 {
+		return nil, errors.New("snapshot frequency must be positive")
+	}
+	ans := Snapshotter{
+		store: store,
+		every: every,
+	}
+	return &ans, nil
+}
+
+// Restore restores the aggregate from its latest snapshot.
+// It returns false when there is no usable snapshot.
+func (s *Snapshotter) Restore(ctx context.Context, aggregateID string, agg AggregateRoot) (bool, error) {
+	snapshot, err := s.store.LoadSnapshot(ctx, aggregateID)
+	if err != nil {
+		if errors.Is(err, ErrSnapshotNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if snapshot.SchemaVersion != schemaVersion(agg) {
+		return false, nil
+	}
+	if err := json.Unmarshal(snapshot.Data, agg); err != nil {
+		return false, err
+	}
+	agg.SetID(snapshot.AggregateID)
+	agg.SetVersion(uint64(snapshot.Version))
+	return true, nil
+}
+
+// ShouldSnapshot returns true when the aggregate crossed a snapshot boundary
+// while moving from version `from` to version `to`.
+func (s *Snapshotter) ShouldSnapshot(from, to int) bool {
+	return to > from && to/s.every > from/s.every
+}
+
+// Take saves a snapshot of the aggregate at its current version.
+func (s *Snapshotter) Take(ctx context.Context, aggregateID string, agg AggregateRoot) error {
+	data, err := json.Marshal(agg)
+	if err != nil {
+		return err
+	}
+	snapshot := Snapshot{
+		AggregateID:   aggregateID,
+		AggregateType: agg.GetType(),
+		Version:       int(agg.GetVersion()),
+		SchemaVersion: schemaVersion(agg),
+		Data:          data,
+		CreatedAt:     time.Now().UTC(),
+	}
+	return s.store.SaveSnapshot(ctx, snapshot)
+}
+
+// LoadAggregate loads the aggregate from the store.
+// When a snapshotter is given the aggregate is restored from its latest snapshot
+// and only the newer events are replayed. It never takes snapshots, the
+// command processor takes them once the events are stored, see WithSnapshotter.
+func LoadAggregate(ctx context.Context, store EventStore, registry *Registry, snapshotter *Snapshotter, aggregateID string, agg AggregateRoot) error {
+	_, err := loadAggregate(ctx, store, registry, snapshotter, aggregateID, agg)
+	return err
+}
+
+// loadAggregate loads the aggregate and returns the version of the snapshot
+// it was restored from, 0 without one.
+func loadAggregate(ctx context.Context, store EventStore, registry *Registry, snapshotter *Snapshotter, aggregateID string, agg AggregateRoot) (int, error) {
+	fromVersion := 0
+	if snapshotter != nil {
+		if _, err := snapshotter.Restore(ctx, aggregateID, agg); err != nil {
+			return 0, err
+		}
+		fromVersion = int(agg.GetVersion())
+	}
+	records, err := store.LoadEventsFromVersion(ctx, aggregateID, fromVersion)
+	if err != nil {
+		return 0, err
+	}
+	events, err := EventRecordsToEvents(registry, records)
+	if err != nil {
+		return 0, err
+	}
+	return fromVersion, Load(agg, events)
+}
+
+func schemaVersion(agg AggregateRoot) int {
+	if v, ok := agg.(SchemaVersioner); ok {
+		return v.SchemaVersion()
+	}
+	return 0
+}
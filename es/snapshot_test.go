@@ -0,0 +1,183 @@
+package es_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gosom/kit/es"
+	"github.com/gosom/kit/es/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type snapshotStore struct {
+	snapshots map[string]es.Snapshot
+}
+
+func (s *snapshotStore) SaveSnapshot(ctx context.Context, snapshot es.Snapshot) error {
+	s.snapshots[snapshot.AggregateID] = snapshot
+	return nil
+}
+
+func (s *snapshotStore) LoadSnapshot(ctx context.Context, aggregateID string) (es.Snapshot, error) {
+	snapshot, ok := s.snapshots[aggregateID]
+	if !ok {
+		return es.Snapshot{}, es.ErrSnapshotNotFound
+	}
+	return snapshot, nil
+}
+
+type counterAggregate struct {
+	*es.AggregateBase
+	Count  int
+	schema int
+}
+
+func (a *counterAggregate) SchemaVersion() int {
+	return a.schema
+}
+
+func newCounterAggregate(schema int) *counterAggregate {
+	base, _ := es.NewAggregateBase()
+	base.SetType("counter")
+	return &counterAggregate{AggregateBase: base, schema: schema}
+}
+
+func TestSnapshotter(t *testing.T) {
+	t.Run("NewSnapshotterValidation", func(t *testing.T) {
+		_, err := es.NewSnapshotter(nil, 10)
+		require.Error(t, err)
+		_, err = es.NewSnapshotter(&snapshotStore{}, 0)
+		require.Error(t, err)
+	})
+	t.Run("ShouldSnapshot", func(t *testing.T) {
+		s, err := es.NewSnapshotter(&snapshotStore{}, 10)
+		require.NoError(t, err)
+		require.False(t, s.ShouldSnapshot(0, 9))
+		require.True(t, s.ShouldSnapshot(0, 10))
+		require.True(t, s.ShouldSnapshot(9, 12))
+		require.False(t, s.ShouldSnapshot(10, 19))
+		require.False(t, s.ShouldSnapshot(10, 10))
+	})
+	t.Run("TakeAndRestore", func(t *testing.T) {
+		store := &snapshotStore{snapshots: map[string]es.Snapshot{}}
+		s, err := es.NewSnapshotter(store, 10)
+		require.NoError(t, err)
+		ctx := context.Background()
+
+		agg := newCounterAggregate(1)
+		restored, err := s.Restore(ctx, "counter-1", agg)
+		require.NoError(t, err)
+		require.False(t, restored)
+
+		agg.Count = 42
+		agg.SetVersion(10)
+		require.NoError(t, s.Take(ctx, "counter-1", agg))
+		require.Equal(t, 10, store.snapshots["counter-1"].Version)
+		require.Equal(t, 1, store.snapshots["counter-1"].SchemaVersion)
+		require.Equal(t, "counter", store.snapshots["counter-1"].AggregateType)
+
+		other := newCounterAggregate(1)
+		restored, err = s.Restore(ctx, "counter-1", other)
+		require.NoError(t, err)
+		require.True(t, restored)
+		require.Equal(t, 42, other.Count)
+		require.Equal(t, uint64(10), other.GetVersion())
+		require.Equal(t, "counter-1", other.GetID())
+
+		// a changed schema invalidates the snapshot
+		changed := newCounterAggregate(2)
+		restored, err = s.Restore(ctx, "counter-1", changed)
+		require.NoError(t, err)
+		require.False(t, restored)
+		require.Equal(t, 0, changed.Count)
+	})
+	t.Run("LoadAggregateFromSnapshot", func(t *testing.T) {
+		store := &snapshotStore{snapshots: map[string]es.Snapshot{}}
+		s, err := es.NewSnapshotter(store, 10)
+		require.NoError(t, err)
+		ctx := context.Background()
+
+		agg := newCounterAggregate(0)
+		agg.Count = 7
+		agg.SetVersion(20)
+		require.NoError(t, s.Take(ctx, "counter-1", agg))
+
+		loaded := newCounterAggregate(0)
+		err = es.LoadAggregate(ctx, mock.NewEventStore(), es.NewRegistry(), s, "counter-1", loaded)
+		require.NoError(t, err)
+		require.Equal(t, 7, loaded.Count)
+		require.Equal(t, uint64(20), loaded.GetVersion())
+	})
+}
+
+type incrementCounter struct {
+	es.CommandBase
+	ID string `json:"id" aggregateID:"true" validate:"required"`
+	By int    `json:"by" validate:"required"`
+}
+
+func (c *incrementCounter) Handle(ctx context.Context, h es.AggregateLoader) ([]es.IEvent, error) {
+	agg := newCounterAggregate(0)
+	if err := h.Load(ctx, c.GetAggregateID(), agg); err != nil {
+		return nil, err
+	}
+	return []es.IEvent{&counterIncremented{By: c.By}}, nil
+}
+
+// TestCommandProcessorEventVersions guards the numbering of the events: the
+// first event of an aggregate has version 1 and every event has the version
+// of the aggregate after it is applied. With version 0 the first event cannot
+// be raised on a new aggregate and every later command fails to load it.
+func TestCommandProcessorEventVersions(t *testing.T) {
+	store := mock.NewEventStore()
+	registry := es.NewRegistry()
+	require.NoError(t, es.RegisterCommand[incrementCounter](registry))
+	require.NoError(t, es.RegisterEvent[counterIncremented](registry))
+	snapshotter, err := es.NewSnapshotter(store, 2)
+	require.NoError(t, err)
+	processor, err := es.NewCommandProcessor(1, store, registry, "counter", es.WithSnapshotter(snapshotter))
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- processor.Start(ctx)
+	}()
+	defer func() {
+		cancel()
+		require.NoError(t, <-done)
+	}()
+
+	for i := 1; i <= 3; i++ {
+		rec, err := es.CommandToCommandRecord("counter", &incrementCounter{ID: "1", By: i})
+		require.NoError(t, err)
+		_, err = store.SaveCommandRecords(ctx, rec)
+		require.NoError(t, err)
+		result, err := es.WaitForCommand(ctx, store, rec.ID)
+		require.NoError(t, err)
+		require.NoError(t, result.Err())
+		require.Len(t, result.Events, 1)
+		require.Equal(t, i, result.Events[0].Version)
+	}
+
+	snapshot, err := store.LoadSnapshot(ctx, "counter-1")
+	require.NoError(t, err)
+	require.Equal(t, 2, snapshot.Version, "the snapshot version is the version of its last event")
+	agg := newCounterAggregate(0)
+	require.NoError(t, json.Unmarshal(snapshot.Data, agg))
+	require.Equal(t, 3, agg.Count, "the snapshot holds the events of the command")
+
+	agg = newCounterAggregate(0)
+	require.NoError(t, es.LoadAggregate(ctx, store, registry, snapshotter, "counter-1", agg))
+	require.Equal(t, uint64(3), agg.GetVersion())
+	require.Equal(t, 6, agg.Count)
+
+	// loading does not take snapshots
+	reads := &snapshotStore{snapshots: map[string]es.Snapshot{}}
+	reader, err := es.NewSnapshotter(reads, 1)
+	require.NoError(t, err)
+	require.NoError(t, es.LoadAggregate(ctx, store, registry, reader, "counter-1", newCounterAggregate(0)))
+	require.Empty(t, reads.snapshots)
+}
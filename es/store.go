@@ -1,33 +1,106 @@
 package es
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 // EventStore is the interface that wraps the basic event store methods.
 type EventStore interface {
 	//Migrate runs the migrations for the event store.
 	Migrate(ctx context.Context) error
 
-	//SaveCommandRecord saves the command record.
+	//SaveCommandRecords saves the command records and returns the ids of the saved ones.
+	// A record whose idempotency key was already used in its domain and has not expired
+	// is not saved, the id of the original command is returned for it instead.
 	SaveCommandRecords(ctx context.Context, records ...CommandRecord) ([]string, error)
 	// GetCommand returns the command record for the given id.
 	GetCommand(ctx context.Context, commandID string) (CommandRecord, error)
 
-	//StoreCommandResults stores the command results.
+	//StoreCommandResults stores the command results and marks the command as finished.
 	StoreCommandResults(ctx context.Context, commandID string, expectedVersion int, events ...EventRecord) error
+	//MarkCommandRunning marks the command as running and increments its attempts.
+	// It returns the number of attempts including the current one.
+	// Only pending and running commands can be marked, for others it returns sql.ErrNoRows.
+	MarkCommandRunning(ctx context.Context, commandID string) (int, error)
+	//MarkCommandFailed records the error of the last attempt.
+	// When final is true the command moves to failure, otherwise it is pending again and
+	// it is not processed before retryAt. A zero retryAt retries it right away.
+	// The later commands of its aggregate are not selected while it waits.
+	MarkCommandFailed(ctx context.Context, commandID string, lastError string, final bool, retryAt time.Time) error
+	//CancelCommand moves a pending command to cancelled so it is never processed.
+	// It returns ErrCommandNotPending when the command is running or done and
+	// sql.ErrNoRows when it does not exist.
+	CancelCommand(ctx context.Context, commandID string) error
 
-	//SelectForProcessing selects the command records for processing.
-	SelectForProcessing(ctx context.Context, workers, limit int) ([][]CommandRecord, error)
+	//SelectForProcessing selects the pending and running command records for processing.
+	// Scheduled commands are selected once they are due.
+	// The commands are partitioned by their aggregate hash modulo workers. When partitions
+	// are given only the commands of those partitions are selected.
+	SelectForProcessing(ctx context.Context, workers, limit int, partitions ...int) ([][]CommandRecord, error)
 
 	//GetOrCreateVersion gets the version for the aggregate or creates it if it doesn't exist.
 	GetOrCreateVersion(ctx context.Context, aggregateID string) (int, error)
 
 	//InsertSubscription
 	InsertSubscription(ctx context.Context, subscription string) (Subscription, error)
-	//SelectEventsForSubscription selects the events for the subscription.
+	//SelectEventsForSubscription selects the events after the position of the subscription
+	// ordered by global position.
 	SelectEventsForSubscription(ctx context.Context, subscription Subscription, limit int) ([]EventRecord, error)
-	//UpdateSubscription updates the subscription.
-	UpdateSubscription(ctx context.Context, group string, lastSeen string) (Subscription, error)
+	//UpdateSubscription moves the subscription from one global position to another.
+	// It returns ErrSubscriptionChanged when the subscription is not at the from position,
+	// e.g. because it was reset meanwhile.
+	UpdateSubscription(ctx context.Context, group string, from, to int64) (Subscription, error)
+	//GetSubscription returns the subscription or ErrSubscriptionNotFound.
+	GetSubscription(ctx context.Context, group string) (Subscription, error)
+	//ListSubscriptions lists the subscriptions with their lag ordered by group.
+	ListSubscriptions(ctx context.Context) ([]SubscriptionInfo, error)
+	//ResetSubscription moves the subscription to the global position.
+	// It returns ErrSubscriptionNotFound when the subscription does not exist.
+	ResetSubscription(ctx context.Context, group string, position int64) (Subscription, error)
+	//SetSubscriptionPaused pauses or resumes the subscription.
+	// A paused subscription selects no events.
+	SetSubscriptionPaused(ctx context.Context, group string, paused bool) (Subscription, error)
+	//DeleteSubscription deletes the subscription and its dead letters.
+	DeleteSubscription(ctx context.Context, group string) error
+	//GetEventPosition returns the global position of the event.
+	GetEventPosition(ctx context.Context, eventID string) (int64, error)
+	//GetPositionAt returns the global position of the last event created before the time.
+	GetPositionAt(ctx context.Context, at time.Time) (int64, error)
 
+	//AcquireLease acquires or renews the named lease for the owner until the ttl elapses.
+	// It returns false when another owner holds the lease.
+	AcquireLease(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error)
+	//ReleaseLease releases the lease if the owner holds it.
+	ReleaseLease(ctx context.Context, name string, owner string) error
+	//ListLeases lists the leases that have not expired and whose name starts with the prefix.
+	ListLeases(ctx context.Context, prefix string) ([]Lease, error)
+
+	//InsertDeadLetter stores an event that the subscription group failed to publish.
+	InsertDeadLetter(ctx context.Context, group string, eventID string, lastError string) error
+	//ListDeadLetters lists the dead-lettered events of the subscription group ordered by global position.
+	// A limit of 0 returns all of them.
+	ListDeadLetters(ctx context.Context, group string, limit int) ([]DeadLetter, error)
+	//DeleteDeadLetter discards a dead-lettered event.
+	// It returns ErrDeadLetterNotFound when the event is not dead-lettered.
+	DeleteDeadLetter(ctx context.Context, group string, eventID string) error
+
+	//GetSagaInstance gets the instance of the saga. It returns sql.ErrNoRows when it does not exist.
+	GetSagaInstance(ctx context.Context, saga string, id string) (SagaInstance, error)
+	//SaveSagaInstance saves the instance together with the commands it sends, in one transaction.
+	// The stored instance must be at the previous version, a new instance has version 1.
+	// Otherwise it returns ErrWrongExpectedVersion.
+	SaveSagaInstance(ctx context.Context, instance SagaInstance, commands ...CommandRecord) error
+
+	//LoadCommandEvents loads the events produced by the command, including EventError.
+	LoadCommandEvents(ctx context.Context, commandID string) ([]EventRecord, error)
 	//LoadEvents loads the events for the aggregate.
 	LoadEvents(ctx context.Context, aggregateID string) ([]EventRecord, error)
+	//LoadEventsFromVersion loads the events for the aggregate with version greater than the given one.
+	LoadEventsFromVersion(ctx context.Context, aggregateID string, version int) ([]EventRecord, error)
+	//LoadEventsUntil loads the events for the aggregate up to the given version and stored up to the given time.
+	// A zero version or time does not bound the events.
+	LoadEventsUntil(ctx context.Context, aggregateID string, version int, at time.Time) ([]EventRecord, error)
+	//QueryEvents loads the events selected by the query ordered by their global position.
+	QueryEvents(ctx context.Context, query EventQuery) ([]EventRecord, error)
 }
@@ -2,9 +2,11 @@ package es
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
+	"github.com/gosom/kit/lib"
 	"github.com/gosom/kit/logging"
 )
 
@@ -12,46 +14,227 @@ type Subscriber interface {
 	Start(ctx context.Context) error
 }
 
+// ErrorMode decides what happens to an event that the publisher keeps failing to publish.
+type ErrorMode int
+
+const (
+	// RetryOnError retries the event until it is published.
+	// The subscription does not move past the event meanwhile.
+	RetryOnError ErrorMode = iota
+	// SkipOnError drops the event after the retries are exhausted.
+	SkipOnError
+	// DeadLetterOnError stores the event in the dead letters after the retries are exhausted.
+	DeadLetterOnError
+)
+
+// ErrorPolicy configures how a subscriber handles publishing errors.
+//
+// The delivery is at least once, so the publishers must be idempotent: when
+// a batch fails it is published again one event at a time, including the
+// events the publisher applied before the failure, and every retry publishes
+// the event again.
+type ErrorPolicy struct {
+	Mode ErrorMode
+	// MaxRetries is the number of retries before the event is skipped or dead-lettered.
+	MaxRetries int
+	// InitialBackoff is the wait before the first retry. It doubles on every retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between retries.
+	MaxBackoff time.Duration
+}
+
+// DefaultErrorPolicy retries failing events forever with exponential backoff.
+func DefaultErrorPolicy() ErrorPolicy {
+	return ErrorPolicy{
+		Mode:           RetryOnError,
+		MaxRetries:     3,
+		InitialBackoff: 300 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+	}
+}
+
+// SubscriberOption configures a subscriber.
+type SubscriberOption func(*subscriber) error
+
+// WithErrorPolicy sets the error policy of the subscriber.
+func WithErrorPolicy(policy ErrorPolicy) SubscriberOption {
+	return func(o *subscriber) error {
+		if policy.MaxRetries < 0 {
+			return errors.New("max retries cannot be negative")
+		}
+		if policy.InitialBackoff <= 0 || policy.MaxBackoff < policy.InitialBackoff {
+			return errors.New("invalid backoff")
+		}
+		o.policy = policy
+		return nil
+	}
+}
+
+// WithSubscriberWakeup sets when the subscriber looks for new events.
+// By default the event store is used as the trigger if it implements Trigger.
+func WithSubscriberWakeup(wakeup Wakeup) SubscriberOption {
+	return func(o *subscriber) error {
+		if err := wakeup.validate(); err != nil {
+			return err
+		}
+		o.wakeup = wakeup
+		return nil
+	}
+}
+
+// WithSubscriberLease sets the ttl of the lease that makes sure only one
+// instance drives the subscription group. A ttl of 0 disables the lease,
+// which is only safe when a single instance runs the group.
+func WithSubscriberLease(ttl time.Duration) SubscriberOption {
+	return func(o *subscriber) error {
+		if ttl < 0 {
+			return errors.New("lease ttl cannot be negative")
+		}
+		o.leaseTTL = ttl
+		return nil
+	}
+}
+
+// WithSubscriberTenant makes the subscription group receive only the events
+// of the tenant. Every tenant has its own groups, by default the group belongs
+// to the default tenant and receives the events of all the tenants in the
+// system scope, see ContextWithSystemScope.
+func WithSubscriberTenant(tenant string) SubscriberOption {
+	return func(o *subscriber) error {
+		o.tenant = tenant
+		return nil
+	}
+}
+
 var _ Subscriber = (*subscriber)(nil)
 
 type subscriber struct {
 	publisher    Publisher
 	store        EventStore
 	subscription Subscription
+	policy       ErrorPolicy
+	wakeup       Wakeup
+	leaseTTL     time.Duration
+	lease        *leaseHolder
+	tenant       string
 	log          logging.Logger
 }
 
-func NewSubscriber(store EventStore, publisher Publisher, subscription string) (Subscriber, error) {
-	sub, err := store.InsertSubscription(context.Background(), subscription)
+func NewSubscriber(store EventStore, publisher Publisher, subscription string, options ...SubscriberOption) (Subscriber, error) {
+	ans := subscriber{
+		publisher: publisher,
+		store:     store,
+		policy:    DefaultErrorPolicy(),
+		wakeup:    defaultWakeup(store),
+		leaseTTL:  DefaultLeaseTTL,
+		log:       logging.Get().With("component", "es/subscriber"),
+	}
+	for _, opt := range options {
+		if err := opt(&ans); err != nil {
+			return nil, err
+		}
+	}
+	if ans.tenant != DefaultTenant {
+		ans.log = ans.log.With("tenant", ans.tenant)
+	}
+	sub, err := store.InsertSubscription(ans.scope(context.Background()), subscription)
 	if err != nil {
 		return nil, err
 	}
-	ans := subscriber{
-		publisher:    publisher,
-		store:        store,
-		subscription: sub,
-		log:          logging.Get().With("component", "es/subscriber"),
+	ans.subscription = sub
+	if ans.leaseTTL > 0 {
+		ans.lease = newLeaseHolder(store, subscriptionLease(ans.tenant, subscription), lib.MustNewULID(), ans.leaseTTL, ans.log)
 	}
 	return &ans, nil
 }
 
+// scope returns ctx scoped to the tenant of the subscriber, the groups of
+// the default tenant serve all the tenants.
+func (o *subscriber) scope(ctx context.Context) context.Context {
+	if o.tenant == DefaultTenant {
+		return ContextWithSystemScope(ctx)
+	}
+	return ContextWithTenant(ctx, o.tenant)
+}
+
 func (o *subscriber) Start(ctx context.Context) error {
 	o.log.Info("starting subscriber", "subscription", o.subscription.Group)
 	defer o.log.Info("subscriber stopped", "subscription", o.subscription.Group)
-	ticker := time.NewTicker(300 * time.Millisecond)
-	defer ticker.Stop()
+	ctx, cancel := context.WithCancel(o.scope(ctx))
+	defer cancel()
+	wake, err := newPoller(ctx, o.wakeup, EventsChannel)
+	if err != nil {
+		o.log.Warn("Cannot subscribe to trigger, polling only", "subscription", o.subscription.Group, "error", err)
+	}
+	if o.lease != nil {
+		defer o.lease.release()
+	}
 	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-ticker.C:
-			if num, err := o.process(ctx); err != nil {
-				o.log.Error("Error processing events", "subscription", o.subscription.Group, "error", err)
-			} else if num > 0 {
-				o.log.Info("Processed events", "subscription", o.subscription.Group, "num", num)
+		if !o.leader(ctx) {
+			if !wake.wait(ctx, false) {
+				return nil
 			}
+			continue
 		}
+		num, err := o.process(ctx)
+		if errors.Is(err, ErrSubscriptionChanged) {
+			o.log.Info("Subscription changed, continuing from its new position", "subscription", o.subscription.Group,
+				"position", o.subscription.Position, "paused", o.subscription.Paused)
+		} else if err != nil {
+			o.log.Error("Error processing events", "subscription", o.subscription.Group, "error", err)
+		} else if num > 0 {
+			o.log.Info("Processed events", "subscription", o.subscription.Group, "num", num)
+		}
+		if !wake.wait(ctx, num > 0) {
+			return nil
+		}
+	}
+}
+
+// subscriptionLease returns the name of the lease of the subscription group.
+func subscriptionLease(tenant string, group string) string {
+	if tenant != DefaultTenant {
+		return "subscription:" + tenant + ":" + group
+	}
+	return "subscription:" + group
+}
+
+// leader reports whether this instance drives the subscription group.
+// The instance that takes over continues from the current position.
+// The subscription is reloaded whenever the lease is acquired or renewed, the
+// lease is released while the subscription is paused so that
+// RebuildSubscription can take it.
+func (o *subscriber) leader(ctx context.Context) bool {
+	if o.lease == nil {
+		return true
+	}
+	if o.subscription.Paused && !o.reload(ctx) {
+		o.lease.release()
+		return false
 	}
+	held, renewAt := o.lease.held, o.lease.renewAt
+	if !o.lease.hold(ctx) {
+		return false
+	}
+	if held && o.lease.renewAt == renewAt {
+		return true
+	}
+	if !o.reload(ctx) {
+		o.lease.release()
+		return false
+	}
+	return true
+}
+
+// reload reloads the subscription and reports whether it is not paused.
+func (o *subscriber) reload(ctx context.Context) bool {
+	sub, err := o.store.GetSubscription(ctx, o.subscription.Group)
+	if err != nil {
+		o.log.Error("Error reloading subscription", "subscription", o.subscription.Group, "error", err)
+		return false
+	}
+	o.subscription = sub
+	return !sub.Paused
 }
 
 func (o *subscriber) process(ctx context.Context) (int, error) {
@@ -59,14 +242,86 @@ func (o *subscriber) process(ctx context.Context) (int, error) {
 	if err != nil {
 		return 0, fmt.Errorf("%w when selecting events for subscription", err)
 	}
-	if len(items) > 0 {
-		if err := o.publisher.Publish(ctx, items...); err != nil {
-			return 0, fmt.Errorf("%w when publishing events", err)
+	if len(items) == 0 {
+		return 0, nil
+	}
+	err = o.publisher.Publish(ctx, items...)
+	if err == nil {
+		return len(items), o.advance(ctx, items[len(items)-1].GlobalPosition)
+	}
+	// the batch failed, publish the events one by one to find the bad ones,
+	// those applied before the failure are published again
+	o.log.Warn("Error publishing events, publishing one by one", "subscription", o.subscription.Group, "error", err)
+	for i := range items {
+		if err := o.publish(ctx, items[i]); err != nil {
+			return i, err
 		}
-		o.subscription, err = o.store.UpdateSubscription(ctx, o.subscription.Group, items[len(items)-1].ID)
-		if err != nil {
-			return 0, fmt.Errorf("%w when updating subscription", err)
+		if err := o.advance(ctx, items[i].GlobalPosition); err != nil {
+			return i, err
 		}
 	}
 	return len(items), nil
 }
+
+// publish publishes a single event applying the error policy.
+// It returns an error only when the subscription cannot move past the event.
+func (o *subscriber) publish(ctx context.Context, event EventRecord) error {
+	backoff := o.policy.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		err := o.publisher.Publish(ctx, event)
+		if err == nil {
+			return nil
+		}
+		if o.policy.Mode != RetryOnError && attempt >= o.policy.MaxRetries {
+			return o.handleFailure(ctx, event, err)
+		}
+		o.log.Error("Error publishing event, retrying", "subscription", o.subscription.Group,
+			"event_id", event.ID, "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w when publishing event %s", err, event.ID)
+		case <-time.After(backoff):
+		}
+		if o.lease != nil && !o.lease.hold(ctx) {
+			return fmt.Errorf("%w when publishing event %s", errLeaseLost, event.ID)
+		}
+		backoff *= 2
+		if backoff > o.policy.MaxBackoff {
+			backoff = o.policy.MaxBackoff
+		}
+	}
+}
+
+func (o *subscriber) handleFailure(ctx context.Context, event EventRecord, cause error) error {
+	switch o.policy.Mode {
+	case SkipOnError:
+		o.log.Error("Skipping event", "subscription", o.subscription.Group, "event_id", event.ID, "error", cause)
+		return nil
+	case DeadLetterOnError:
+		o.log.Error("Dead-lettering event", "subscription", o.subscription.Group, "event_id", event.ID, "error", cause)
+		if err := o.store.InsertDeadLetter(ctx, o.subscription.Group, event.ID, cause.Error()); err != nil {
+			return fmt.Errorf("%w when dead-lettering event %s", err, event.ID)
+		}
+		return nil
+	default:
+		return cause
+	}
+}
+
+// advance moves the subscription to the position. When the subscription was
+// changed meanwhile, e.g. it was reset, it reloads it and returns ErrSubscriptionChanged.
+func (o *subscriber) advance(ctx context.Context, position int64) error {
+	sub, err := o.store.UpdateSubscription(ctx, o.subscription.Group, o.subscription.Position, position)
+	if errors.Is(err, ErrSubscriptionChanged) {
+		if sub, err = o.store.GetSubscription(ctx, o.subscription.Group); err != nil {
+			return fmt.Errorf("%w when reloading subscription", err)
+		}
+		o.subscription = sub
+		return ErrSubscriptionChanged
+	}
+	if err != nil {
+		return fmt.Errorf("%w when updating subscription", err)
+	}
+	o.subscription = sub
+	return nil
+}
@@ -0,0 +1,339 @@
+package es_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gosom/kit/es"
+	"github.com/gosom/kit/es/estest"
+	"github.com/gosom/kit/es/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyPublisher fails to publish the events in bad.
+type flakyPublisher struct {
+	mu        sync.Mutex
+	bad       map[string]bool
+	published []string
+}
+
+func (p *flakyPublisher) Name() string {
+	return "flaky"
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, events ...es.EventRecord) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range events {
+		if p.bad[events[i].ID] {
+			return errors.New("cannot publish")
+		}
+	}
+	for i := range events {
+		p.published = append(p.published, events[i].ID)
+	}
+	return nil
+}
+
+func (p *flakyPublisher) Published() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.published...)
+}
+
+func (p *flakyPublisher) Fix() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bad = nil
+}
+
+func storeTestEvents(t *testing.T, store es.EventStore, num int) []string {
+	ctx := context.Background()
+	cmd := estest.NewCommandRecord("test-1")
+	_, err := store.SaveCommandRecords(ctx, cmd)
+	require.NoError(t, err)
+	version, err := store.GetOrCreateVersion(ctx, cmd.AggregateID)
+	require.NoError(t, err)
+	events := make([]es.EventRecord, num)
+	ids := make([]string, num)
+	for i := range events {
+		events[i] = estest.NewEventRecord(cmd.AggregateID, version+i+1)
+		ids[i] = events[i].ID
+	}
+	require.NoError(t, store.StoreCommandResults(ctx, cmd.ID, version, events...))
+	return ids
+}
+
+func runSubscriber(t *testing.T, sub es.Subscriber) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- sub.Start(ctx)
+	}()
+	return func() {
+		cancel()
+		require.NoError(t, <-done)
+	}
+}
+
+func TestSubscriberErrorPolicy(t *testing.T) {
+	policy := es.ErrorPolicy{
+		MaxRetries:     2,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+	}
+	t.Run("InvalidPolicy", func(t *testing.T) {
+		_, err := es.NewSubscriber(mock.NewEventStore(), &flakyPublisher{}, "flaky", es.WithErrorPolicy(es.ErrorPolicy{}))
+		require.Error(t, err)
+	})
+	t.Run("Retry", func(t *testing.T) {
+		store := mock.NewEventStore()
+		ids := storeTestEvents(t, store, 3)
+		publisher := &flakyPublisher{bad: map[string]bool{ids[1]: true}}
+		sub, err := es.NewSubscriber(store, publisher, "flaky", es.WithErrorPolicy(policy))
+		require.NoError(t, err)
+		stop := runSubscriber(t, sub)
+		defer stop()
+
+		require.Eventually(t, func() bool {
+			return len(publisher.Published()) == 1
+		}, 2*time.Second, 10*time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		require.Equal(t, ids[:1], publisher.Published(), "the subscription must stall on the bad event")
+
+		publisher.Fix()
+		require.Eventually(t, func() bool {
+			return len(publisher.Published()) == 3
+		}, 2*time.Second, 10*time.Millisecond)
+		require.Equal(t, ids, publisher.Published())
+	})
+	t.Run("Skip", func(t *testing.T) {
+		store := mock.NewEventStore()
+		ids := storeTestEvents(t, store, 3)
+		publisher := &flakyPublisher{bad: map[string]bool{ids[1]: true}}
+		skip := policy
+		skip.Mode = es.SkipOnError
+		sub, err := es.NewSubscriber(store, publisher, "flaky", es.WithErrorPolicy(skip))
+		require.NoError(t, err)
+		stop := runSubscriber(t, sub)
+		defer stop()
+
+		require.Eventually(t, func() bool {
+			return len(publisher.Published()) == 2
+		}, 2*time.Second, 10*time.Millisecond)
+		require.Equal(t, []string{ids[0], ids[2]}, publisher.Published())
+
+		items, err := store.ListDeadLetters(context.Background(), "flaky", 0)
+		require.NoError(t, err)
+		require.Empty(t, items)
+	})
+	t.Run("DeadLetter", func(t *testing.T) {
+		store := mock.NewEventStore()
+		ids := storeTestEvents(t, store, 3)
+		publisher := &flakyPublisher{bad: map[string]bool{ids[0]: true}}
+		deadLetter := policy
+		deadLetter.Mode = es.DeadLetterOnError
+		sub, err := es.NewSubscriber(store, publisher, "flaky", es.WithErrorPolicy(deadLetter))
+		require.NoError(t, err)
+		stop := runSubscriber(t, sub)
+
+		require.Eventually(t, func() bool {
+			return len(publisher.Published()) == 2
+		}, 2*time.Second, 10*time.Millisecond)
+		stop()
+		require.Equal(t, ids[1:], publisher.Published())
+
+		ctx := context.Background()
+		items, err := store.ListDeadLetters(ctx, "flaky", 0)
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+		require.Equal(t, ids[0], items[0].Event.ID)
+		require.Equal(t, "cannot publish", items[0].LastError)
+
+		// replaying fails while the publisher is still broken
+		_, err = es.ReplayDeadLetters(ctx, store, publisher, "flaky")
+		require.Error(t, err)
+
+		_, err = es.ReplayDeadLetters(ctx, store, publisher, "flaky", "missing")
+		require.ErrorIs(t, err, es.ErrDeadLetterNotFound)
+
+		publisher.Fix()
+		replayed, err := es.ReplayDeadLetters(ctx, store, publisher, "flaky", ids[0])
+		require.NoError(t, err)
+		require.Equal(t, 1, replayed)
+		require.Equal(t, []string{ids[1], ids[2], ids[0]}, publisher.Published())
+
+		items, err = store.ListDeadLetters(ctx, "flaky", 0)
+		require.NoError(t, err)
+		require.Empty(t, items)
+	})
+}
+
+func TestSubscriberWakeup(t *testing.T) {
+	store := mock.NewEventStore()
+	publisher := &flakyPublisher{}
+	// polling is effectively disabled, only notifications wake up the subscriber
+	wakeup := es.Wakeup{Trigger: store, MinInterval: time.Hour, MaxInterval: time.Hour}
+	_, err := es.NewSubscriber(store, publisher, "flaky", es.WithSubscriberWakeup(es.Wakeup{}))
+	require.Error(t, err)
+	sub, err := es.NewSubscriber(store, publisher, "flaky", es.WithSubscriberWakeup(wakeup))
+	require.NoError(t, err)
+	stop := runSubscriber(t, sub)
+	defer stop()
+
+	// give the subscriber time to go idle
+	time.Sleep(50 * time.Millisecond)
+	ids := storeTestEvents(t, store, 2)
+	require.Eventually(t, func() bool {
+		return len(publisher.Published()) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, ids, publisher.Published())
+}
+
+// projection is a publisher that can be reset.
+type projection struct {
+	flakyPublisher
+	resets int
+}
+
+func (p *projection) Reset(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.published = nil
+	p.resets++
+	return nil
+}
+
+func TestSubscriberReset(t *testing.T) {
+	ctx := context.Background()
+	store := mock.NewEventStore()
+	publisher := &projection{}
+	// the subscriber sees the pause of the rebuild when it renews its lease
+	sub, err := es.NewSubscriber(store, publisher, "flaky", es.WithSubscriberLease(300*time.Millisecond))
+	require.NoError(t, err)
+	stop := runSubscriber(t, sub)
+	defer stop()
+
+	ids := storeTestEvents(t, store, 3)
+	require.Eventually(t, func() bool {
+		return len(publisher.Published()) == 3
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// a running subscriber follows the reset
+	_, err = es.ResetSubscriptionToEvent(ctx, store, "flaky", ids[1])
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(publisher.Published()) == 5
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, append(ids, ids[1:]...), publisher.Published())
+
+	// a paused subscriber does not receive events
+	_, err = store.SetSubscriptionPaused(ctx, "flaky", true)
+	require.NoError(t, err)
+	more := storeTestEvents(t, store, 1)
+	time.Sleep(100 * time.Millisecond)
+	require.Len(t, publisher.Published(), 5)
+
+	// rebuilding resets the publisher, resumes the subscriber and replays everything
+	require.NoError(t, store.InsertDeadLetter(ctx, "flaky", ids[0], "error"))
+	rebuilt, err := es.RebuildSubscription(ctx, store, publisher, "flaky")
+	require.NoError(t, err)
+	require.False(t, rebuilt.Paused)
+	require.Equal(t, int64(0), rebuilt.Position)
+	require.Eventually(t, func() bool {
+		return len(publisher.Published()) == 4
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, append(ids, more...), publisher.Published())
+	require.Equal(t, 1, publisher.resets)
+	deadLetters, err := store.ListDeadLetters(ctx, "flaky", 0)
+	require.NoError(t, err)
+	require.Empty(t, deadLetters)
+}
+
+// slowProjection blocks the batches until it is released.
+type slowProjection struct {
+	projection
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p *slowProjection) Publish(ctx context.Context, events ...es.EventRecord) error {
+	select {
+	case p.started <- struct{}{}:
+	default:
+	}
+	<-p.release
+	return p.projection.Publish(ctx, events...)
+}
+
+func (p *slowProjection) Resets() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resets
+}
+
+func TestRebuildSubscriptionInFlight(t *testing.T) {
+	ctx := context.Background()
+	store := mock.NewEventStore()
+	publisher := &slowProjection{started: make(chan struct{}, 1), release: make(chan struct{})}
+	sub, err := es.NewSubscriber(store, publisher, "slow", es.WithSubscriberLease(300*time.Millisecond))
+	require.NoError(t, err)
+	stop := runSubscriber(t, sub)
+	defer stop()
+
+	ids := storeTestEvents(t, store, 2)
+	<-publisher.started
+	rebuilt := make(chan error)
+	go func() {
+		_, err := es.RebuildSubscription(ctx, store, publisher, "slow")
+		rebuilt <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	resets := publisher.Resets()
+	close(publisher.release)
+	require.Zero(t, resets, "the reset waits for the batch in flight")
+	require.NoError(t, <-rebuilt)
+	require.Equal(t, 1, publisher.Resets())
+	require.Eventually(t, func() bool {
+		return len(publisher.Published()) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, ids, publisher.Published(), "the batch in flight is published before the reset")
+}
+
+func TestSubscriberLease(t *testing.T) {
+	store := mock.NewEventStore()
+	first, second := &flakyPublisher{}, &flakyPublisher{}
+	_, err := es.NewSubscriber(store, first, "flaky", es.WithSubscriberLease(-time.Second))
+	require.Error(t, err)
+	leader, err := es.NewSubscriber(store, first, "flaky")
+	require.NoError(t, err)
+	standby, err := es.NewSubscriber(store, second, "flaky")
+	require.NoError(t, err)
+
+	stopLeader := runSubscriber(t, leader)
+	ids := storeTestEvents(t, store, 2)
+	require.Eventually(t, func() bool {
+		return len(first.Published()) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	stopStandby := runSubscriber(t, standby)
+	defer stopStandby()
+
+	more := storeTestEvents(t, store, 2)
+	require.Eventually(t, func() bool {
+		return len(first.Published()) == 4
+	}, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, second.Published(), "only the leader publishes")
+
+	// the standby takes over from where the leader stopped
+	stopLeader()
+	last := storeTestEvents(t, store, 1)
+	require.Eventually(t, func() bool {
+		return len(second.Published()) == 1
+	}, 3*time.Second, 10*time.Millisecond)
+	require.Equal(t, append(ids, more...), first.Published())
+	require.Equal(t, last, second.Published())
+}
@@ -1,15 +1,125 @@
 package es
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"time"
+
+	"github.com/gosom/kit/lib"
 )
 
 type Subscription struct {
-	Group           string
-	LastSeenEventID string
-	LastUpdatedAt   time.Time
+	Group string
+	// Position is the global position of the last event the group has seen.
+	Position      int64
+	Paused        bool
+	LastUpdatedAt time.Time
+	// Tenant is the tenant whose events the group receives. The groups of
+	// the default tenant receive the events of all the tenants when they are
+	// read in the system scope, see ContextWithSystemScope.
+	Tenant string
 }
 
 func (o *Subscription) Bind() []any {
-	return []any{&o.Group, &o.LastSeenEventID, &o.LastUpdatedAt}
+	return []any{&o.Group, &o.Position, &o.Paused, &o.LastUpdatedAt, &o.Tenant}
+}
+
+// SubscriptionInfo is a subscription together with its lag.
+type SubscriptionInfo struct {
+	Subscription
+	// Lag is the number of events the group has not seen yet.
+	Lag int64
+}
+
+func (o *SubscriptionInfo) Bind() []any {
+	return append(o.Subscription.Bind(), &o.Lag)
+}
+
+// rebuildLeaseInterval is how often RebuildSubscription tries to acquire the
+// lease of the group.
+const rebuildLeaseInterval = 100 * time.Millisecond
+
+// Resetter is implemented by publishers that can discard everything they have
+// published, for example by truncating the tables of a projection.
+type Resetter interface {
+	Reset(ctx context.Context) error
+}
+
+// ResetSubscriptionToEvent resets the subscription so that the event is the
+// next one it receives.
+func ResetSubscriptionToEvent(ctx context.Context, store EventStore, group string, eventID string) (Subscription, error) {
+	position, err := store.GetEventPosition(ctx, eventID)
+	if err != nil {
+		return Subscription{}, fmt.Errorf("%w when getting the position of event %s", err, eventID)
+	}
+	return store.ResetSubscription(ctx, group, position-1)
+}
+
+// ResetSubscriptionToTime resets the subscription so that it receives the
+// events created from the given time on.
+func ResetSubscriptionToTime(ctx context.Context, store EventStore, group string, at time.Time) (Subscription, error) {
+	position, err := store.GetPositionAt(ctx, at)
+	if err != nil {
+		return Subscription{}, fmt.Errorf("%w when getting the position at %s", err, at)
+	}
+	return store.ResetSubscription(ctx, group, position)
+}
+
+// RebuildSubscription replays all the events to the publisher of the group.
+// The subscription is paused, then the publisher is reset, if it implements
+// Resetter, its dead letters are discarded and it restarts from the
+// beginning. On error the subscription stays paused.
+// The group is the one of the tenant of ctx, so a Resetter can use ctx to
+// reset only the records of the tenant.
+//
+// The reset waits for the lease of the group, which the running subscribers
+// release once they see the subscription paused, at the latest a third of
+// their lease ttl later, so no batch in flight is published after the reset.
+// The wait is bounded by ctx. Subscribers without a lease, see
+// WithSubscriberLease, must be stopped before the rebuild.
+func RebuildSubscription(ctx context.Context, store EventStore, publisher Publisher, group string) (Subscription, error) {
+	sub, err := store.SetSubscriptionPaused(ctx, group, true)
+	if err != nil {
+		return Subscription{}, err
+	}
+	name, owner := subscriptionLease(TenantFromContext(ctx), group), lib.MustNewULID()
+	for {
+		ok, err := store.AcquireLease(ctx, name, owner, DefaultLeaseTTL)
+		if err != nil {
+			return sub, fmt.Errorf("%w when acquiring the lease of subscription %s", err, group)
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return sub, fmt.Errorf("%w when waiting for the subscribers of %s to pause", ctx.Err(), group)
+		case <-time.After(rebuildLeaseInterval):
+		}
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = store.ReleaseLease(ctx, name, owner)
+	}()
+	if resetter, ok := publisher.(Resetter); ok {
+		if err := resetter.Reset(ctx); err != nil {
+			return sub, fmt.Errorf("%w when resetting publisher %s", err, publisher.Name())
+		}
+	}
+	deadLetters, err := store.ListDeadLetters(ctx, group, 0)
+	if err != nil {
+		return sub, err
+	}
+	for i := range deadLetters {
+		err := store.DeleteDeadLetter(ctx, group, deadLetters[i].Event.ID)
+		if err != nil && !errors.Is(err, ErrDeadLetterNotFound) {
+			return sub, err
+		}
+	}
+	if _, err := store.ResetSubscription(ctx, group, 0); err != nil {
+		return sub, err
+	}
+	return store.SetSubscriptionPaused(ctx, group, false)
 }
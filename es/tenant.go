@@ -0,0 +1,71 @@
+package es
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gosom/kit/lib"
+)
+
+// DefaultTenant is the tenant of the records stored without one.
+// It is a tenant like any other, a context without a tenant only sees the
+// records of the default tenant. Reading or writing the records of all the
+// tenants needs the system scope, see ContextWithSystemScope.
+const DefaultTenant = ""
+
+type tenantKey struct{}
+
+type tenantScope struct {
+	tenant string
+	system bool
+}
+
+// ContextWithTenant returns a context that carries the tenant.
+// The event stores scope every query to the tenant of the context.
+// It drops the system scope of ctx.
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantScope{tenant: tenant})
+}
+
+// ContextWithSystemScope returns a context that is not bound to a tenant.
+// The event stores read the records of all the tenants and store records
+// for any tenant in its scope. It is meant for the internal components that
+// serve all the tenants, like the command processor, and must never be
+// derived from a request.
+func ContextWithSystemScope(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantScope{tenant: DefaultTenant, system: true})
+}
+
+// SystemScopeFromContext reports whether ctx has the system scope.
+func SystemScopeFromContext(ctx context.Context) bool {
+	scope, ok := ctx.Value(tenantKey{}).(tenantScope)
+	return ok && scope.system
+}
+
+// TenantFromContext returns the tenant of ctx. Without one it is the tenant
+// of the authenticated user, the MetadataTenant of its extra fields, or the
+// default tenant.
+func TenantFromContext(ctx context.Context) string {
+	if scope, ok := ctx.Value(tenantKey{}).(tenantScope); ok {
+		return scope.tenant
+	}
+	if user := lib.UserFromContext(ctx); user != nil {
+		return user.GetExtra()[MetadataTenant]
+	}
+	return DefaultTenant
+}
+
+// ResolveTenant returns the tenant a record is stored for. A record without
+// a tenant belongs to the tenant of ctx. Only the system scope can store
+// records of other tenants, otherwise it returns ErrTenantMismatch.
+func ResolveTenant(ctx context.Context, tenant string) (string, error) {
+	current := TenantFromContext(ctx)
+	switch {
+	case tenant == "" || tenant == current:
+		return current, nil
+	case SystemScopeFromContext(ctx):
+		return tenant, nil
+	default:
+		return "", fmt.Errorf("%w: %q in the context of %q", ErrTenantMismatch, tenant, current)
+	}
+}
@@ -0,0 +1,125 @@
+package es_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gosom/kit/es"
+	"github.com/gosom/kit/es/estest"
+	"github.com/gosom/kit/es/mock"
+	"github.com/gosom/kit/lib"
+	"github.com/stretchr/testify/require"
+)
+
+type tenantUser struct {
+	tenant string
+}
+
+func (u tenantUser) GetID() string { return "user-1" }
+func (u tenantUser) GetExtra() map[string]string {
+	return map[string]string{es.MetadataTenant: u.tenant}
+}
+
+func TestTenantFromContext(t *testing.T) {
+	ctx := context.Background()
+	require.Equal(t, es.DefaultTenant, es.TenantFromContext(ctx))
+
+	ctx = lib.NewContextWithUser(ctx, tenantUser{tenant: "acme"})
+	require.Equal(t, "acme", es.TenantFromContext(ctx))
+	require.Equal(t, "globex", es.TenantFromContext(es.ContextWithTenant(ctx, "globex")))
+}
+
+func TestResolveTenant(t *testing.T) {
+	none := context.Background()
+	system := es.ContextWithSystemScope(none)
+	acme := es.ContextWithTenant(system, "acme")
+
+	tenant, err := es.ResolveTenant(acme, "")
+	require.NoError(t, err)
+	require.Equal(t, "acme", tenant)
+	tenant, err = es.ResolveTenant(system, "globex")
+	require.NoError(t, err)
+	require.Equal(t, "globex", tenant)
+	_, err = es.ResolveTenant(acme, "globex")
+	require.ErrorIs(t, err, es.ErrTenantMismatch)
+	_, err = es.ResolveTenant(none, "globex")
+	require.ErrorIs(t, err, es.ErrTenantMismatch)
+}
+
+func TestSystemScope(t *testing.T) {
+	ctx := context.Background()
+	require.False(t, es.SystemScopeFromContext(ctx))
+	system := es.ContextWithSystemScope(lib.NewContextWithUser(ctx, tenantUser{tenant: "acme"}))
+	require.True(t, es.SystemScopeFromContext(system))
+	require.Equal(t, es.DefaultTenant, es.TenantFromContext(system))
+	require.False(t, es.SystemScopeFromContext(es.ContextWithTenant(system, "acme")))
+}
+
+func TestTenantWithoutTenant(t *testing.T) {
+	store := mock.NewEventStore()
+	globex := es.ContextWithTenant(context.Background(), "globex")
+	rec, err := es.CommandToCommandRecord("order", &placeOrder{ID: "1", Quantity: 1})
+	require.NoError(t, err)
+	_, err = store.SaveCommandRecords(globex, rec)
+	require.NoError(t, err)
+	_, err = store.GetOrCreateVersion(globex, "order-1")
+	require.NoError(t, err)
+	event := estest.NewEventRecord("order-1", 1)
+	require.NoError(t, store.StoreCommandResults(globex, rec.ID, 0, event))
+
+	// a request without a tenant has the default tenant and cannot read globex
+	ctx := context.Background()
+	events, err := store.QueryEvents(ctx, es.EventQuery{})
+	require.NoError(t, err)
+	require.Empty(t, events)
+	_, err = store.GetEventPosition(ctx, event.ID)
+	require.ErrorIs(t, err, sql.ErrNoRows)
+	sub, err := store.InsertSubscription(ctx, "reader")
+	require.NoError(t, err)
+	events, err = store.SelectEventsForSubscription(ctx, sub, 10)
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	events, err = store.SelectEventsForSubscription(es.ContextWithSystemScope(ctx), sub, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, "globex", events[0].Tenant)
+}
+
+func TestCommandProcessorTenants(t *testing.T) {
+	store := mock.NewEventStore()
+	processor, err := es.NewCommandProcessor(2, store, newOrderRegistry(), "order")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- processor.Start(ctx)
+	}()
+	defer func() {
+		cancel()
+		require.NoError(t, <-done)
+	}()
+
+	tenants := []string{"acme", "globex"}
+	for i, tenant := range tenants {
+		rec, err := es.CommandToCommandRecord("order", &placeOrder{ID: "1", Quantity: i + 1})
+		require.NoError(t, err)
+		_, err = store.SaveCommandRecords(es.ContextWithTenant(ctx, tenant), rec)
+		require.NoError(t, err)
+	}
+	for i, tenant := range tenants {
+		tctx := es.ContextWithTenant(ctx, tenant)
+		var events []es.EventRecord
+		require.Eventually(t, func() bool {
+			events, err = store.LoadEvents(tctx, "order-1")
+			return err == nil && len(events) == 1
+		}, 4*time.Second, 10*time.Millisecond)
+		require.Equal(t, tenant, events[0].Tenant)
+		require.Equal(t, 1, events[0].Version, "every tenant has its own aggregate")
+		require.JSONEq(t, fmt.Sprintf(`{"quantity":%d}`, i+1), string(events[0].Data))
+	}
+}
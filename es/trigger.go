@@ -0,0 +1,157 @@
+package es
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// CommandsChannel is notified when new commands are saved.
+	CommandsChannel = "es_commands"
+	// EventsChannel is notified when new events are stored.
+	EventsChannel = "es_events"
+	// CommandResultsChannel is notified when commands finish, fail or are cancelled.
+	CommandResultsChannel = "es_command_results"
+)
+
+// Trigger wakes up the command processor and the subscribers when there is
+// new work, so they do not have to poll the event store.
+// Event stores that implement Trigger are used as the default trigger.
+type Trigger interface {
+	// Subscribe returns a channel that receives a value when the channel is notified.
+	// Notifications may be coalesced. The subscription ends when ctx is done.
+	Subscribe(ctx context.Context, channel string) (<-chan struct{}, error)
+}
+
+// Wakeup decides when the command processor and the subscribers look for new work.
+// They wake up immediately on a notification of the trigger. When there is no
+// notification they poll, starting at MinInterval and backing off up to
+// MaxInterval while they are idle.
+type Wakeup struct {
+	// Trigger is optional. Without a trigger only polling is used.
+	Trigger     Trigger
+	MinInterval time.Duration
+	MaxInterval time.Duration
+}
+
+// DefaultWakeup polls between 50ms and 1s.
+func DefaultWakeup() Wakeup {
+	return Wakeup{
+		MinInterval: 50 * time.Millisecond,
+		MaxInterval: time.Second,
+	}
+}
+
+func (w Wakeup) validate() error {
+	if w.MinInterval <= 0 || w.MaxInterval < w.MinInterval {
+		return errors.New("invalid wakeup intervals")
+	}
+	return nil
+}
+
+// defaultWakeup uses the store as the trigger when it implements Trigger.
+func defaultWakeup(store EventStore) Wakeup {
+	ans := DefaultWakeup()
+	if trigger, ok := store.(Trigger); ok {
+		ans.Trigger = trigger
+	}
+	return ans
+}
+
+// poller waits for a notification or for the poll interval to elapse.
+type poller struct {
+	wakeup   Wakeup
+	notify   <-chan struct{}
+	interval time.Duration
+}
+
+func newPoller(ctx context.Context, wakeup Wakeup, channel string) (*poller, error) {
+	ans := poller{wakeup: wakeup, interval: wakeup.MinInterval}
+	if wakeup.Trigger != nil {
+		notify, err := wakeup.Trigger.Subscribe(ctx, channel)
+		if err != nil {
+			return &ans, err
+		}
+		ans.notify = notify
+	}
+	return &ans, nil
+}
+
+// wait blocks until there may be new work. busy tells if the last
+// iteration found work, which resets the poll interval.
+// It returns false when ctx is done.
+func (p *poller) wait(ctx context.Context, busy bool) bool {
+	if busy {
+		p.interval = p.wakeup.MinInterval
+	}
+	timer := time.NewTimer(p.interval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-p.notify:
+		p.interval = p.wakeup.MinInterval
+	case <-timer.C:
+		p.interval *= 2
+		if p.interval > p.wakeup.MaxInterval {
+			p.interval = p.wakeup.MaxInterval
+		}
+	}
+	return true
+}
+
+// Broadcaster fans out notifications to the subscribers of a channel.
+// It implements Trigger and is meant to be embedded by event stores.
+type Broadcaster struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]struct{}
+}
+
+var _ Trigger = (*Broadcaster)(nil)
+
+func (b *Broadcaster) Subscribe(ctx context.Context, channel string) (<-chan struct{}, error) {
+	ch := make(chan struct{}, 1)
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[string]map[chan struct{}]struct{})
+	}
+	if b.subs[channel] == nil {
+		b.subs[channel] = make(map[chan struct{}]struct{})
+	}
+	b.subs[channel][ch] = struct{}{}
+	b.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs[channel], ch)
+	}()
+	return ch, nil
+}
+
+// Notify wakes up the subscribers of the channel.
+func (b *Broadcaster) Notify(channel string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[channel] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// NotifyAll wakes up the subscribers of all the channels.
+func (b *Broadcaster) NotifyAll() {
+	b.mu.Lock()
+	channels := make([]string, 0, len(b.subs))
+	for channel := range b.subs {
+		channels = append(channels, channel)
+	}
+	b.mu.Unlock()
+	for _, channel := range channels {
+		b.Notify(channel)
+	}
+}
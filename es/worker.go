@@ -31,11 +31,16 @@ func (o *saveCommandWorker) Process(ctx context.Context, key, value []byte, time
 		Key:       key,
 		Data:      value,
 		Timestamp: timestamp,
+		Headers:   HeadersFromContext(ctx),
 	}
 	var cr CommandRecord
 	if err := BusMessageToCommandRecord(busMsg, &cr); err != nil {
 		return err
 	}
-	_, err := o.store.SaveCommandRecords(ctx, cr)
+	if cr.CorrelationID == "" {
+		cr.SetCorrelation(CorrelationFromContext(ctx))
+	}
+	// the command belongs to the tenant of the message
+	_, err := o.store.SaveCommandRecords(ContextWithTenant(ctx, cr.Tenant), cr)
 	return err
 }
@@ -48,6 +48,8 @@ func run(ctx context.Context) error {
 	}
 
 	store := postgres.NewEventStore(db)
+	defer store.Close()
+
 	if err := store.Migrate(ctx); err != nil {
 		return err
 	}
@@ -69,26 +71,35 @@ func run(ctx context.Context) error {
 		es.NewSaveCommandWorker(store, registry),
 	)
 
+	snapshotter, err := es.NewSnapshotter(store, 100)
+	if err != nil {
+		return err
+	}
+
 	commandProcessor, err := es.NewCommandProcessor(
 		4,
 		store,
 		registry,
 		todo.DOMAIN,
+		es.WithSnapshotter(snapshotter),
 	)
 	if err != nil {
 		return err
 	}
 
-	webServer := getWebServer(store, registry)
-
 	projectionBuilder := todo.NewProjectionBuilder(db, registry)
 
+	webServer := getWebServer(store, registry, snapshotter, projectionBuilder)
+
+	projectionPolicy := es.DefaultErrorPolicy()
+	projectionPolicy.Mode = es.DeadLetterOnError
+
 	appSvc, err := es.New(
 		es.WithLogger(logging.Get().Level(logging.DEBUG)),
 		es.WithEventStore(store),
 		es.WithCommandProcessor(commandProcessor),
 		es.WithWebServer(webServer),
-		es.WithPublishers(projectionBuilder),
+		es.WithPublisher(projectionBuilder, es.WithErrorPolicy(projectionPolicy)),
 		es.WithCommandBusListener(kafkaCommandListener),
 	)
 	if err != nil {
@@ -104,14 +115,18 @@ func getDb(dsn string) (*sqldb.DB, error) {
 	return dbconn, dbconn.Open()
 }
 
-func getWebServer(store es.EventStore, registry *es.Registry) *web.HttpServer {
+func getWebServer(store es.EventStore, registry *es.Registry, snapshotter *es.Snapshotter, publishers ...es.Publisher) *web.HttpServer {
 	routerCfg := web.RouterConfig{}
 	mux := web.NewRouter(routerCfg)
 	mux.Get("/health", func(w http.ResponseWriter, r *http.Request) {
 		web.JSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
 	})
 
-	eshttp.RegisterDomainRoutes(todo.DOMAIN, mux, store, registry, todo.NewTodoAggregate)
+	eshttp.RegisterDomainRoutes(
+		todo.DOMAIN, mux, store, registry, todo.NewTodoAggregate,
+		eshttp.WithSnapshotter(snapshotter),
+	)
+	eshttp.RegisterSubscriptionRoutes(mux, store, publishers...)
 
 	api.RegisterHandlers(mux)
 
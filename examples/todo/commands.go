@@ -7,8 +7,6 @@ import (
 	"github.com/gosom/kit/es"
 )
 
-var _ es.ICommand = (*CreateTodo)(nil)
-
 type CreateTodo struct {
 	es.CommandBase
 
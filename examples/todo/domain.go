@@ -1,5 +1,7 @@
 package todo
 
+//go:generate go run github.com/gosom/kit/es/cmd/esgen
+
 const (
 	DOMAIN        = "todo"
 	COMMAND_TOPIC = "todo-commands"
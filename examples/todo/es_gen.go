@@ -0,0 +1,36 @@
+// Code generated by esgen. DO NOT EDIT.
+
+package todo
+
+import "github.com/gosom/kit/es"
+
+var (
+	_ es.ICommand = (*CreateTodo)(nil)
+	_ es.ICommand = (*UpdateTodoStatus)(nil)
+	_ es.IEvent   = (*TodoCreated)(nil)
+	_ es.IEvent   = (*TodoStatusUpdated)(nil)
+)
+
+// Register registers the commands and the events of the package.
+func Register(registry *es.Registry) {
+	registry.RegisterCommandType("CreateTodo", newCreateTodo)
+	registry.RegisterCommandType("UpdateTodoStatus", newUpdateTodoStatus)
+	registry.RegisterEventType("TodoCreated", newTodoCreated)
+	registry.RegisterEventType("TodoStatusUpdated", newTodoStatusUpdated)
+}
+
+func newCreateTodo() es.ICommand {
+	return &CreateTodo{}
+}
+
+func newUpdateTodoStatus() es.ICommand {
+	return &UpdateTodoStatus{}
+}
+
+func newTodoCreated() es.IEvent {
+	return &TodoCreated{}
+}
+
+func newTodoStatusUpdated() es.IEvent {
+	return &TodoStatusUpdated{}
+}
@@ -10,6 +10,8 @@ import (
 	"github.com/gosom/kit/sqldb"
 )
 
+var _ es.Resetter = (*ProjectionBuilder)(nil)
+
 type ProjectionBuilder struct {
 	db       *sqldb.DB
 	registry *es.Registry
@@ -60,6 +62,12 @@ func (p *ProjectionBuilder) Name() string {
 	return "todo_projection"
 }
 
+// Reset truncates the projection so it can be rebuilt from the events.
+func (p *ProjectionBuilder) Reset(ctx context.Context) error {
+	_, err := p.db.Conn().ExecContext(ctx, `TRUNCATE todos`)
+	return err
+}
+
 func (p *ProjectionBuilder) processTodoCreated(ctx context.Context, tx *sql.Tx, ts time.Time, e *TodoCreated) error {
 	const q = `INSERT INTO todos
 	(id, title, status, created_at, updated_at)